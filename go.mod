@@ -3,10 +3,17 @@ module github.com/yeya24/backfiller
 go 1.13
 
 require (
+	github.com/alecthomas/units v0.0.0-20190924025748-f65c72e2690d
 	github.com/go-kit/kit v0.10.0
+	github.com/gogo/protobuf v1.3.1
+	github.com/golang/snappy v0.0.1
+	github.com/oklog/ulid v1.3.1
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/client_golang v1.6.0
 	github.com/prometheus/common v0.9.1
 	github.com/prometheus/prometheus v1.8.2-0.20200507164740-ecee9c8abfd1
+	google.golang.org/grpc v1.29.0
+	google.golang.org/protobuf v1.21.0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v2 v2.2.8
 )
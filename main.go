@@ -2,271 +2,505 @@ package main
 
 import (
 	"context"
-	"math"
+	"encoding/json"
+	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
+	"github.com/alecthomas/units"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
-	"github.com/prometheus/prometheus/pkg/labels"
-	"github.com/prometheus/prometheus/pkg/logging"
-	"github.com/prometheus/prometheus/pkg/rulefmt"
 	"github.com/prometheus/prometheus/pkg/timestamp"
-	"github.com/prometheus/prometheus/promql"
-	"github.com/prometheus/prometheus/promql/parser"
-	prom_rules "github.com/prometheus/prometheus/rules"
-	"github.com/prometheus/prometheus/tsdb"
-	"github.com/prometheus/prometheus/tsdb/wal"
 	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/yeya24/backfiller/pkg/backfill"
 )
 
 const (
 	defaultDBPath = "data/"
 )
 
-type recordingRule struct {
-	name   string
-	vector parser.Expr
-	lset   labels.Labels
-}
-
 func main() {
 	app := kingpin.New(filepath.Base(os.Args[0]), "Tooling for backfilling Prometheus Recording Rules.")
-	app.Version("v0.0.1")
+	app.Version(backfill.Version)
 	app.HelpFlag.Short('h')
 
-	ruleFile := app.Arg("rule-file", "The rule file for backfilling.").Required().ExistingFile()
-
-	dbPath := app.Arg("db path", "tsdb path (default is "+defaultDBPath+")").Default(defaultDBPath).String()
-
-	destPath := app.Arg("dest path", "path to generate new block (default is "+defaultDBPath+")").Default(defaultDBPath).String()
-
-	maxSamples := app.Flag("max-samples", "Maximum number of samples a single query can load into memory. Note that queries will fail if they try to load more samples than this into memory, so this also limits the number of samples a query can return.").
-		Default("50000000").Int()
-
-	timeout := app.Flag("timeout", "Maximum time a query may take before being aborted.").
-		Default("2m").Duration()
-
-	start := app.Flag("start", "Start time (RFC3339 or Unix timestamp).").String()
-	end := app.Flag("end", "End time (RFC3339 or Unix timestamp).").String()
-
-	evalInterval := app.Flag("eval-interval", "How frequently to evaluate the recording rules.").Default("30s").Duration()
-	maxSamplesInMem := app.Flag("max-samples-in-mem", "maximum number of samples to process in a cycle.").Default("10000").Int()
-	queryLogFile := app.Flag("query-log-file", "File to which PromQL queries are logged.").Default("").String()
+	var opts backfill.Options
+	var skipOlderThan, destRetention model.Duration
+	backfillCmd := app.Command("backfill", "Backfill the recording rules of a rule file. The default command.").Default()
+
+	// With --rule-url, the rule file arg is omitted and the other args move up.
+	args := backfillCmd.Arg("rule-file", "The rule file for backfilling, or an http or https URL to fetch it from. Omitted with --rule-url and --rules-from-url.").String()
+
+	backfillCmd.Arg("db path", "tsdb path (default is "+defaultDBPath+")").StringVar(&opts.DBPath)
+
+	backfillCmd.Arg("dest path", "path to generate new block (default is "+defaultDBPath+")").StringVar(&opts.DestPath)
+
+	backfillCmd.Flag("rule-url", "http or https URL to fetch the rule file from instead of reading a local rule file.").StringVar(&opts.RuleURL.URL)
+	backfillCmd.Flag("rules-from-url", "Base URL of a Prometheus server to fetch the recording rules it evaluates from, with its rules API, instead of reading a local rule file. Uses the --rule-url.* credentials and timeout.").StringVar(&opts.RulesFromURL)
+	backfillCmd.Flag("rule-url.username", "Username to fetch the rule file with basic auth.").StringVar(&opts.RuleURL.Username)
+	backfillCmd.Flag("rule-url.password-file", "File with the password to fetch the rule file with basic auth.").ExistingFileVar(&opts.RuleURL.PasswordFile)
+	backfillCmd.Flag("rule-url.bearer-token-file", "File with the bearer token to fetch the rule file with.").ExistingFileVar(&opts.RuleURL.BearerTokenFile)
+	backfillCmd.Flag("rule-url.timeout", "Timeout of fetching the rule file.").Default(backfill.DefaultRuleURLTimeout.String()).DurationVar(&opts.RuleURL.Timeout)
+	backfillCmd.Flag("rules-sha256", "Hex encoded SHA-256 hash the rule file, local or fetched, has to have.").StringVar(&opts.RulesSHA256)
+
+	backfillCmd.Flag("validate-promql-against-engine", "Evaluate every expression against empty data before the backfill, to report all rules that parse but fail to evaluate, e.g. returning a range vector, up front.").BoolVar(&opts.ValidateExpressions)
+	backfillCmd.Flag("enable-feature", "Comma-separated PromQL engine features to enable, like the server's flag. None of promql-at-modifier and promql-negative-offset is supported by the engine of this Prometheus version. Can be repeated.").StringsVar(&opts.EnableFeatures)
+
+	backfillCmd.Flag("output.format", "Output format of the evaluated samples. With csv no blocks are created.").Default(backfill.OutputFormatTSDB).EnumVar(&opts.OutputFormat, backfill.OutputFormatTSDB, backfill.OutputFormatCSV)
+	backfillCmd.Flag("output.file", "File the CSV output is written to. Defaults to stdout.").StringVar(&opts.OutputFile)
+	backfillCmd.Flag("csv.columns", "Label written to a dedicated CSV column, in the order given. Can be repeated.").StringsVar(&opts.CSVColumns)
+	backfillCmd.Flag("csv.drop-other-labels", "Drop the labels without a dedicated CSV column instead of serializing them into the labels column.").BoolVar(&opts.CSVDropOtherLabels)
+	backfillCmd.Flag("output.receive-url", "Remote write URL of a Thanos Receive, e.g. http://receive:19291/api/v1/receive, to send the samples to instead of creating blocks.").StringVar(&opts.Receive.URL)
+	backfillCmd.Flag("output.receive.tenant", "Tenant of the samples sent to receive.").StringVar(&opts.Receive.Tenant)
+	backfillCmd.Flag("output.receive.tenant-header", "HTTP header the tenant is sent in, like the --receive.tenant-header of receive.").Default(backfill.DefaultReceiveTenantHeader).StringVar(&opts.Receive.TenantHeader)
+	backfillCmd.Flag("output.receive.bearer-token-file", "File with the bearer token to send to receive.").ExistingFileVar(&opts.Receive.BearerTokenFile)
+	backfillCmd.Flag("output.receive.tls.ca-file", "CA file to verify receive with instead of the system roots.").StringVar(&opts.Receive.CAFile)
+	backfillCmd.Flag("output.receive.tls.cert-file", "Client certificate file to present to receive.").StringVar(&opts.Receive.CertFile)
+	backfillCmd.Flag("output.receive.tls.key-file", "Key file of the client certificate.").StringVar(&opts.Receive.KeyFile)
+	backfillCmd.Flag("output.receive.tls.server-name", "Server name to verify the certificate of receive with.").StringVar(&opts.Receive.ServerName)
+	backfillCmd.Flag("output.receive.tls.insecure-skip-verify", "Don't verify the certificate of receive.").BoolVar(&opts.Receive.InsecureSkipVerify)
+	backfillCmd.Flag("compression", "Compression of the requests to receive: snappy, as the remote write protocol requires, or none for endpoints without snappy support or for debugging.").Default(backfill.ReceiveCompressionSnappy).EnumVar(&opts.Receive.Compression, backfill.ReceiveCompressionSnappy, backfill.ReceiveCompressionNone)
+	backfillCmd.Flag("output.receive.timeout", "Timeout of a request to receive.").Default(backfill.DefaultReceiveTimeout.String()).DurationVar(&opts.Receive.Timeout)
+	backfillCmd.Flag("output.receive.batch-size", "Maximum number of samples of a request to receive.").Default(strconv.Itoa(backfill.DefaultReceiveBatchSize)).IntVar(&opts.Receive.BatchSize)
+	backfillCmd.Flag("output.receive.max-retries", "Number of retries of a request to receive failing with a network error, 429 or a 5xx status, with a doubling backoff.").Default(strconv.Itoa(backfill.DefaultReceiveMaxRetries)).IntVar(&opts.Receive.MaxRetries)
+	backfillCmd.Flag("output.replication-aware", "Count requests receive rejects with 409 Conflict as ingested, as it rejects samples it already has, e.g. when re-running a backfill. Without it, the conflicting series and timestamp fail the backfill.").BoolVar(&opts.Receive.ReplicationAware)
+	backfillCmd.Flag("tenant-label", "Label whose value is the tenant of a sample. The blocks of every tenant are written into a directory named after it in the dest path.").StringVar(&opts.TenantLabel)
+	backfillCmd.Flag("tenant-label.default", "Tenant directory of the samples without the tenant label. Without it, such samples fail the backfill.").StringVar(&opts.DefaultTenant)
+	backfillCmd.Flag("tenant-from-rules", "Write the blocks of every rule into the directory of its tenant in the dest path, set by the backfill.tenant annotation of its group or the tenant of its range override. Rules without a tenant fail the backfill.").BoolVar(&opts.TenantFromRules)
+
+	backfillCmd.Flag("max-samples", "Maximum number of samples a single query can load into memory. Note that queries will fail if they try to load more samples than this into memory, so this also limits the number of samples a query can return.").
+		Default("50000000").IntVar(&opts.MaxSamples)
+
+	backfillCmd.Flag("timeout", "Maximum time a query may take before being aborted.").
+		Default("2m").DurationVar(&opts.Timeout)
+	backfillCmd.Flag("max-query-duration", "Cancel the query of a single evaluation step once it takes longer than this and continue with the next step, which is left without samples. Applies to the instant queries of the steps, including those of a failed range query. 0 means no limit other than --timeout.").Default("0").DurationVar(&opts.MaxQueryDuration)
+	backfillCmd.Flag("quarantine-after", "Abandon a rule for the rest of the run once this many consecutive steps failed with a timeout, of --timeout or --max-query-duration, or by exceeding the max samples, and continue with the other rules. The first step that wasn't evaluated is written to the failures file, and the exit code is 7. 0 never abandons rules.").Default("0").IntVar(&opts.QuarantineAfter)
+	backfillCmd.Flag("auto-extend-timeout", "Double --timeout and --max-query-duration for a rule the first time it would be abandoned with --quarantine-after after timeouts and continue its evaluation, abandoning it only if it fails as often again.").BoolVar(&opts.AutoExtendTimeout)
+
+	backfillCmd.Flag("log-queries-slower-than", "Log the queries of a rule that take longer than this, with a summary per rule at its end. 0 disables it.").Default("0").DurationVar(&opts.SlowQueryThreshold)
+
+	backfillCmd.Flag("start", "Start time (RFC3339 or Unix timestamp in seconds, or with an ms or ns suffix).").StringVar(&opts.Start)
+	backfillCmd.Flag("end", "End time (RFC3339 or Unix timestamp in seconds, or with an ms or ns suffix).").StringVar(&opts.End)
+	backfillCmd.Flag("skip-older-than", "Only backfill samples at most this old, raising the start time to now minus this duration, e.g. to skip what the retention of the destination would delete right away. E.g. 90d. 0 disables it.").SetValue(&skipOlderThan)
+	backfillCmd.Flag("dest-retention", "Retention of the Prometheus server loading the backfilled blocks, like its --storage.tsdb.retention.time. Samples older than that are skipped, like with --skip-older-than.").SetValue(&destRetention)
+	backfillCmd.Flag("min-sample-age", "Only backfill samples at least this old, capping the end time to now minus this duration, e.g. to stay clear of the data the live server is still writing. 0 disables it.").DurationVar(&opts.MinSampleAge)
+	backfillCmd.Flag("timestamp-shift", "Add this duration to the timestamp of every backfilled sample, e.g. 168h to replay the data of last week as this week's. Negative durations shift into the past. The start and end times still refer to the source data.").DurationVar(&opts.TimestampShift)
+	backfillCmd.Flag("end-exclusive", "Don't evaluate at the end time, so the backfill covers [start, end) and doesn't duplicate the live evaluation at end.").BoolVar(&opts.EndExclusive)
+	backfillCmd.Flag("timestamp-mode", "Timestamp the samples are recorded at: the evaluation step with eval, like the rule manager of Prometheus, or the timestamp the engine returned with sample, which is the step minus the query offset of the rule.").Default(backfill.TimestampModeEval).EnumVar(&opts.TimestampMode, backfill.TimestampModeEval, backfill.TimestampModeSample)
+
+	var evalIntervalSet bool
+	evalInterval := backfillCmd.Flag("eval-interval", "How frequently to evaluate the recording rules. With auto, the scrape interval detected in the source data is used. Overrides the intervals of --prometheus-config.").Default("30s").Action(func(*kingpin.ParseContext) error {
+		evalIntervalSet = true
+		return nil
+	}).String()
+	backfillCmd.Flag("prometheus-config", "Prometheus configuration file to evaluate the rules at the interval of their group, or else at its global evaluation_interval, unless --eval-interval is set.").ExistingFileVar(&opts.PrometheusConfigFile)
+	backfillCmd.Flag("timestamps-file", "File with newline-separated RFC3339 or Unix timestamps to evaluate the rules at instead of every eval interval. Timestamps outside of the range of a rule are skipped.").ExistingFileVar(&opts.TimestampsFile)
+	backfillCmd.Flag("failures-file", "File to write the evaluation steps whose query failed to, as JSON lines with the group, rule, timestamp and error.").StringVar(&opts.FailuresFile)
+	backfillCmd.Flag("retry-from-failures", "Evaluate the rules again only at the steps in this failures file, instead of over their ranges, and write the steps that still fail back to it, or to --failures-file if set.").ExistingFileVar(&opts.RetryFromFailures)
+	backfillCmd.Flag("timestamp-reference", "Series selector, e.g. 'job:up:sum{job=\"node\"}', whose sample timestamps in the source the rules are evaluated at instead of every eval interval, so backfilled samples line up with the existing data.").StringVar(&opts.TimestampReference)
+	backfillCmd.Flag("fill-gaps-from", "Only evaluate the rules where the series they record have gaps, in the TSDB at this path or, with "+backfill.FillGapsSource+", in the source data. The TSDB is only read.").StringVar(&opts.FillGapsFrom)
+	backfillCmd.Flag("align-evaluations-to-interval", "Snap the first evaluation timestamp up to the next multiple of the eval interval, so backfilled samples line up with live evaluations.").BoolVar(&opts.AlignEvaluations)
+	backfillCmd.Flag("max-series-per-block", "Fail when a block would have more series than this. 0 means no limit, but blocks with more than a million series are logged.").Default("0").IntVar(&opts.MaxSeriesPerBlock)
+	backfillCmd.Flag("max-block-series", "Cut a block at the end of the step at which it has this many series, e.g. to keep the index of blocks with few samples across many series small. 0 means no limit.").Default("0").IntVar(&opts.MaxBlockSeries)
+	backfillCmd.Flag("max-series-per-rule", "Stop evaluating a rule once it produced more series than this, and continue with the next rule. 0 means no limit.").Default("0").IntVar(&opts.MaxSeriesPerRule)
+	backfillCmd.Flag("on-series-limit", "What to do with the samples of a rule exceeding --max-series-per-rule that aren't written yet: drop or keep them. Samples already written into blocks are kept either way.").Default(backfill.SeriesLimitDrop).EnumVar(&opts.OnSeriesLimit, backfill.SeriesLimitDrop, backfill.SeriesLimitKeep)
+	backfillCmd.Flag("bench", "Measure the latency of this many instant queries per rule, evenly spaced across its range, and print the projected time of the backfill instead of backfilling.").IntVar(&opts.Bench)
+	backfillCmd.Flag("estimate", "Evaluate each rule at this many steps, evenly spaced across its range, and print the projected samples, size and time of the backfill instead of backfilling. The projection is an approximation.").IntVar(&opts.Estimate)
+	backfillCmd.Flag("compare-against", "TSDB path or URL of a Prometheus server with the series of the rules recorded live. The evaluated samples are compared with them and a report is printed instead of backfilling.").StringVar(&opts.CompareAgainst)
+	backfillCmd.Flag("compare.tolerance", "Relative difference up to which the values of compared samples match.").Default("0.001").Float64Var(&opts.CompareTolerance)
+	backfillCmd.Flag("compare.max-mismatch-rate", "Share of the samples of a rule, from 0 to 1, that may mismatch or exist on one side only before the comparison fails.").Default("0.01").Float64Var(&opts.MaxMismatchRate)
+	backfillCmd.Flag("max-samples-in-mem", "maximum number of samples to process in a cycle. 0 means no limit, prefer --max-memory.").Default("10000").IntVar(&opts.MaxSamplesInMem)
+	sourceCacheSize := backfillCmd.Flag("source-cache-size", "Estimated memory of the source samples cached across the queries of the rules, e.g. 1GiB. The samples of a selector are read an hour at a time for all steps and rules selecting them while cached, evicting the least recently used. The hit ratio is logged at the end. 0 disables the cache.").Default("0").Bytes()
+	maxMemory := backfillCmd.Flag("max-memory", "Estimated memory of the buffered samples at which a block is cut, e.g. 2GiB. Blocks are cut at whichever of --max-memory and --max-samples-in-mem is reached first. 0 means no limit.").Default("0").Bytes()
+	backfillCmd.Flag("range-queries", "Evaluate rules with one range query per batch of steps instead of one instant query per step. Expressions with subqueries always use instant queries.").Default("true").BoolVar(&opts.RangeQueries)
+	backfillCmd.Flag("cpu-profile", "File to write a CPU profile of the evaluation to.").StringVar(&opts.CPUProfile)
+	backfillCmd.Flag("mem-profile", "File to write a heap profile at the end of the evaluation to.").StringVar(&opts.MemProfile)
+	backfillCmd.Flag("max-concurrent-blocks", "Maximum number of blocks written at the same time while the evaluation goes on. Each holds its samples in memory until it is written. 1 writes one block at a time and waits for it.").Default("1").IntVar(&opts.MaxConcurrentBlocks)
+	backfillCmd.Flag("step-batch-size", "Number of evaluation steps processed as a batch. The results of a batch evaluated with a range query are held in memory in addition to --max-samples-in-mem.").Default(strconv.Itoa(backfill.DefaultStepBatchSize)).IntVar(&opts.StepBatchSize)
+	backfillCmd.Flag("skip-empty-ranges", "Skip the runs of steps at which the source has no data for the selectors of a rule, checked an hour of steps at a time, including the lookback of the expression. Rules that may evaluate without data, like absent(), are always evaluated.").Default("true").BoolVar(&opts.SkipEmptyRanges)
+	backfillCmd.Flag("preflight-skip", "Skip rules whose selectors match no series in the source within their range. Disable for rules expected to evaluate on missing series, like absent().").Default("true").BoolVar(&opts.PreflightSkip)
+	backfillCmd.Flag("only-missing", "Skip the rules whose recorded series already have a sample in every aligned 2h window of their range in the dest path, e.g. when extending a backfill forward in time.").BoolVar(&opts.OnlyMissing)
+	backfillCmd.Flag("query-log-file", "File to which PromQL queries are logged.").Default("").StringVar(&opts.QueryLogFile)
+	backfillCmd.Flag("query-log-required", "Abort if the query log file can't be created instead of disabling query logging.").BoolVar(&opts.QueryLogRequired)
+	backfillCmd.Flag("follow", "Keep running after the backfill and backfill the source data appearing after it until --follow-until or SIGTERM. A restarted follow run continues after the blocks the previous one wrote to the dest path.").BoolVar(&opts.Follow)
+	backfillCmd.Flag("follow-poll", "How often the source is checked for new data with --follow. Defaults to the eval interval.").Default("0").DurationVar(&opts.FollowPoll)
+	backfillCmd.Flag("follow-flush-interval", "Minimum time between two backfills of the new source data with --follow, each writing its own blocks.").Default(backfill.DefaultFollowFlushInterval.String()).DurationVar(&opts.FollowFlushInterval)
+	backfillCmd.Flag("follow-until", "Stop following the source once it's backfilled up to this time, in RFC3339 or Unix timestamp format. Empty means no limit.").StringVar(&opts.FollowUntil)
+	backfillCmd.Flag("active-query-tracker-dir", "Directory the engine tracks the queries in flight in, in the file queries.active. The queries of an interrupted or crashed run are logged by the next run with the same directory.").StringVar(&opts.ActiveQueryTrackerDir)
+	backfillCmd.Flag("range-overrides", "YAML file mapping group or record names to their own start and end times and max samples limits. Rules without an override use the global range and --max-samples.").ExistingFileVar(&opts.RangeOverridesFile)
+	maxDiskUsage := backfillCmd.Flag("max-disk-usage", "Maximum disk usage of the backfilled blocks, e.g. 50GiB, or of the filesystem of the dest path in percent, e.g. 90%. Checked before the backfill against the projected usage and after every block, stopping the backfill once exceeded. 0 means no limit other than the free space of the destination.").Default("0").String()
+	backfillCmd.Flag("allow-overlapping-output", "Start even if blocks in the dest path overlap the backfill range. Prometheus needs --storage.tsdb.allow-overlapping-blocks to load the result.").BoolVar(&opts.AllowOverlappingOutput)
+	backfillCmd.Flag("fail-on-overlap", "Refuse to start if any block in the dest path overlaps the backfill range, even with --allow-overlapping-output or --dest-is-prometheus-data-dir.").BoolVar(&opts.FailOnOverlap)
+	backfillCmd.Flag("overwrite", "Move blocks in the dest path that overlap the backfill range and only contain series of the backfilled rules aside before writing.").BoolVar(&opts.Overwrite)
+	backfillCmd.Flag("correct", "Write tombstones for the series of the backfilled rules over their ranges into the blocks of previous backfills overlapping the backfill range once the run completed, so queries only return the new samples. Requires a stopped Prometheus server.").BoolVar(&opts.Correct)
+	backfillCmd.Flag("run-timeout", "Maximum time the whole backfill may take. When exceeded, the buffered samples are written and the tool exits with code 3. 0 means no timeout.").Default("0").DurationVar(&opts.RunTimeout)
+	backfillCmd.Flag("dest-lock", "Lock the dest path while writing into it, so a second backfill on it fails right away naming the pid and host of the first. Disable on filesystems where locking is unreliable.").Default("true").BoolVar(&opts.DestLock)
+	backfillCmd.Flag("dest-is-prometheus-data-dir", "Allow the dest path to be the data directory of a Prometheus server. The backfill range must end before its head block, and a running server must have --storage.tsdb.allow-overlapping-blocks set, which has to be confirmed with --force.").BoolVar(&opts.DestIsPrometheusDataDir)
+	backfillCmd.Flag("strict", "Fail instead of warning when a record name is already used by series with different label names in the source, which usually means a rule was renamed.").BoolVar(&opts.Strict)
+	backfillCmd.Flag("strict-range", "Fail instead of dropping a sample outside of the range of its rule, e.g. recorded before the start with --timestamp-mode=sample and a query offset.").BoolVar(&opts.StrictRange)
+	backfillCmd.Flag("group", "Only backfill the rule group with this name. Can be repeated. All groups are backfilled if not set.").StringsVar(&opts.Groups)
+	backfillCmd.Flag("exclude-group", "Don't backfill the rule group with this name. Can be repeated.").StringsVar(&opts.ExcludeGroups)
+	backfillCmd.Flag("exclude-rule", `Don't backfill the rules with this record name, or matching this selector like 'job:up:sum{env="prod"}', whose matchers apply to the static labels of the rules. Can be repeated.`).StringsVar(&opts.ExcludeRules)
+	backfillCmd.Flag("created-blocks-file", "File the created blocks are listed in as JSON, with their time range and number of samples and series. Written on failed runs as well, listing the blocks completed before the failure.").StringVar(&opts.CreatedBlocksFile)
+	backfillCmd.Flag("series-manifest", "File the written series are listed in once the run ends, deduplicated across blocks, with their number of samples and the time of their oldest and newest sample. Written on failed runs as well.").StringVar(&opts.SeriesManifest)
+	backfillCmd.Flag("series-manifest.format", "Format of the series manifest.").Default(backfill.ManifestFormatJSON).EnumVar(&opts.SeriesManifestFormat, backfill.ManifestFormatJSON, backfill.ManifestFormatCSV)
+	backfillCmd.Flag("append-to-head", "Append samples within the window of the head of the dest path, a TSDB not in use by a running Prometheus server, to the head instead of writing them into blocks. Older samples are still written into blocks.").BoolVar(&opts.AppendToHead)
+	backfillCmd.Flag("append-batch-size", "Number of samples appended to the head with --append-to-head before they are committed. Committed samples are kept if the backfill fails.").Default(strconv.Itoa(backfill.DefaultAppendBatchSize)).IntVar(&opts.AppendBatchSize)
+	backfillCmd.Flag("compact", "Merge the blocks created by the run into larger blocks once all rules are evaluated. Blocks that existed before aren't touched.").BoolVar(&opts.Compact)
+	backfillCmd.Flag("compact.block-duration", "Maximum time range of a block merged by --compact.").Default("24h").DurationVar(&opts.CompactBlockDuration)
+	backfillCmd.Flag("deterministic", "Derive the ULID of every created block from the hash of its samples, which is recorded in its meta.json, so two runs over the same input create identical blocks. A block whose samples exist in the destination already fails the run. Can't be combined with --compact.").BoolVar(&opts.Deterministic)
+	backfillCmd.Flag("allow-duplicate-series", "Only warn instead of failing when two rules produce the same series.").BoolVar(&opts.AllowDuplicateSeries)
+	backfillCmd.Flag("relabel-config-file", "YAML file with a list of relabel configs, like the metric_relabel_configs of a scrape config, the final labels of every sample are relabeled with before --output-filter. Samples dropped by the relabeling aren't written.").ExistingFileVar(&opts.RelabelConfigFile)
+	backfillCmd.Flag("output-filter", `Label matchers like 'namespace=~"prod-.*"' the samples of all rules have to match to be written, applied to their final labels. Can be repeated.`).StringsVar(&opts.OutputFilters)
+	backfillCmd.Flag("skip-invalid-values", "Drop samples whose value is NaN or ±Inf instead of writing them, e.g. the results of divisions by zero.").BoolVar(&opts.SkipInvalidValues)
+	backfillCmd.Flag("round-to-decimals", "Round the value of every sample to this many decimal places, between 0 and 15, before writing it. Rounded values compress better, at the cost of their precision. Values are written exactly if not set.").Action(func(*kingpin.ParseContext) error {
+		opts.RoundValues = true
+		return nil
+	}).IntVar(&opts.RoundToDecimals)
+	backfillCmd.Flag("sample-interval-tolerance", "Drop samples whose timestamp is within this duration of the previous sample of their series, e.g. 5ms when the evaluation timestamps don't align perfectly with existing data. Has to be shorter than the eval interval. 0 disables it.").Default("0").DurationVar(&opts.SampleIntervalTolerance)
+	backfillCmd.Flag("fail-on-conflicting-duplicates", "Fail when a series gets two different values at the same timestamp, which indicates a nondeterministic expression.").BoolVar(&opts.FailOnConflictingDuplicates)
+	backfillCmd.Flag("fail-on-empty-rule", "Exit with code 4 when a rule didn't produce any samples in its range, after writing the samples of the other rules.").BoolVar(&opts.FailOnEmptyRule)
+	backfillCmd.Flag("force", "Start even if the projected disk usage exceeds --max-disk-usage or the free space of the destination, a Prometheus server is running on it, or it is the source TSDB.").BoolVar(&opts.Force)
+	backfillCmd.Flag("source.flush-wal", "Read the db path without writing to it, with the data in its WAL, e.g. of a crashed server or an agent, flushed into a temporary block.").BoolVar(&opts.FlushWAL)
+	backfillCmd.Flag("source.block-range", "Only open the blocks of the source TSDBs overlapping <start>,<end>, in the formats of --start and --end, and the block preceding it for the lookback of the first steps. Derived from --start and --end if not set, unless the rules have ranges of their own.").StringVar(&opts.SourceBlockRange)
+	backfillCmd.Flag("source.block-ulids", "ULID of a block of the source TSDBs to open, without their head. Can be repeated. All blocks are opened if neither this nor a block range is set.").StringsVar(&opts.SourceBlockULIDs)
+	backfillCmd.Flag("merge-db-path", "TSDB directory whose data is merged with the db path, e.g. of another replica. Can be repeated.").StringsVar(&opts.MergeDBPaths)
+	backfillCmd.Flag("dedup-replica-label", "Label telling the replicas of an HA pair apart in the source, e.g. prometheus_replica. It's removed from the source series, and series only differing by it are deduplicated like by the Thanos querier. Can be repeated.").StringsVar(&opts.DedupReplicaLabels)
+	backfillCmd.Flag("openmetrics-source", "OpenMetrics or Prometheus text exposition file with timestamped samples to use as the source instead of a TSDB.").ExistingFileVar(&opts.OpenMetricsSource)
+	backfillCmd.Flag("source.store-api", "Address (host:port) of a Thanos StoreAPI, e.g. a store gateway, to use as the source instead of a TSDB. Requires --start and --end.").StringVar(&opts.StoreAPI.Address)
+	backfillCmd.Flag("source.snapshot", "Take a snapshot of the TSDB of the Prometheus server at --source.prometheus-url and use it as the source instead of the db path. The server needs --web.enable-admin-api.").BoolVar(&opts.Snapshot.Take)
+	backfillCmd.Flag("source.prometheus-url", "URL of the Prometheus server to take the snapshot of.").StringVar(&opts.Snapshot.PrometheusURL)
+	backfillCmd.Flag("source.snapshot-dir", "Directory the snapshots of the server are readable at, i.e. the snapshots directory in its data directory, mounted if the server runs on another host.").StringVar(&opts.Snapshot.Dir)
+	backfillCmd.Flag("source.snapshot.skip-head", "Leave the in-memory data of the server out of the snapshot.").BoolVar(&opts.Snapshot.SkipHead)
+	backfillCmd.Flag("source.snapshot.cleanup", "Delete the taken snapshot after the backfill.").BoolVar(&opts.Snapshot.Cleanup)
+	backfillCmd.Flag("source.snapshot-path", "Snapshot taken before to use as the source instead of the db path. It is only read.").StringVar(&opts.Snapshot.Path)
+	backfillCmd.Flag("source.store-api.tls", "Connect to the StoreAPI with TLS.").BoolVar(&opts.StoreAPI.TLS)
+	backfillCmd.Flag("source.store-api.tls.ca-file", "CA file to verify the StoreAPI with instead of the system roots.").StringVar(&opts.StoreAPI.CAFile)
+	backfillCmd.Flag("source.store-api.tls.cert-file", "Client certificate file to present to the StoreAPI.").StringVar(&opts.StoreAPI.CertFile)
+	backfillCmd.Flag("source.store-api.tls.key-file", "Key file of the client certificate.").StringVar(&opts.StoreAPI.KeyFile)
+	backfillCmd.Flag("source.store-api.tls.server-name", "Server name to verify the StoreAPI certificate with.").StringVar(&opts.StoreAPI.ServerName)
+	backfillCmd.Flag("source.store-api.tls.insecure-skip-verify", "Don't verify the StoreAPI certificate.").BoolVar(&opts.StoreAPI.InsecureSkipVerify)
+	backfillCmd.Flag("source.store-api.max-series", "Maximum number of series a single select may return from the StoreAPI. 0 means no limit.").Default("0").IntVar(&opts.StoreAPI.MaxSeries)
+	backfillCmd.Flag("source.store-api.max-samples", "Maximum number of samples a single select may return from the StoreAPI. 0 means no limit.").Default("0").IntVar(&opts.StoreAPI.MaxSamples)
+
+	blocksCmd := app.Command("blocks", "List the blocks and the head of a TSDB, the gaps between them and the range of its data, without writing to it.")
+	blocksDBPath := blocksCmd.Flag("db-path", "TSDB path.").Default(defaultDBPath).String()
+	blocksGap := blocksCmd.Flag("gap-threshold", "Report the gaps between blocks longer than this.").Default("5m").Duration()
+	blocksFormat := blocksCmd.Flag("format", "Output format.").Default("table").Enum("table", "json")
 
 	logCfg := &promlog.Config{}
 	flag.AddFlags(app, logCfg)
+	logTimestampFormat := app.Flag("log.timestamp-format", "Format of the timestamps of log messages, RFC3339 in UTC with milliseconds, seconds or nanoseconds, or with milliseconds in the local time zone. One of: [rfc3339-millis, rfc3339, rfc3339-nano, local]").Default(defaultLogTimestampFormat).Enum("rfc3339-millis", "rfc3339", "rfc3339-nano", "local")
+	logCaller := app.Flag("log.caller", "Log the file and line of the caller of every log message.").Default("true").Bool()
 
-	kingpin.MustParse(app.Parse(os.Args[1:]))
-	logger := promlog.New(logCfg)
-
-	rules, errs := parseRules(*ruleFile, logger)
-	if errs != nil {
-		for _, e := range errs {
-			level.Error(logger).Log("msg", "loading groups failed", "err", e)
+	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
+	if cmd == blocksCmd.FullCommand() {
+		logger := newLogger(logCfg, *logTimestampFormat, *logCaller)
+		c, err := backfill.ReadCoverage(*blocksDBPath, *blocksGap, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to read blocks", "err", err)
+			os.Exit(1)
+		}
+		if *blocksFormat == "json" {
+			err = printCoverageJSON(c)
+		} else {
+			printCoverage(c)
+		}
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to print blocks", "err", err)
+			os.Exit(1)
 		}
 		return
 	}
-
-	opts := &tsdb.Options{
-		WALSegmentSize: wal.DefaultSegmentSize,
-		NoLockfile:     true,
+	if err := ruleFileArgs(&opts, *args); err != nil {
+		app.Fatalf("%s", err)
 	}
-
-	db, err := tsdb.Open(*dbPath, logger, prometheus.DefaultRegisterer, opts)
-	if err != nil {
-		level.Error(logger).Log("msg", "failed to open TSDB", "path", *dbPath, "err", err)
-		return
+	logger := newLogger(logCfg, *logTimestampFormat, *logCaller)
+	if err := parseDiskUsage(&opts, *maxDiskUsage); err != nil {
+		app.Fatalf("invalid max disk usage %q: %s", *maxDiskUsage, err)
+	}
+	opts.MaxMemory = uint64(*maxMemory)
+	opts.SourceCacheSize = uint64(*sourceCacheSize)
+	opts.SkipOlderThan = time.Duration(skipOlderThan)
+	opts.DestRetention = time.Duration(destRetention)
+
+	switch {
+	case *evalInterval == "auto":
+		opts.AutoEvalInterval = true
+	case opts.PrometheusConfigFile != "" && !evalIntervalSet:
+		// The intervals are read from the Prometheus config.
+	default:
+		d, err := time.ParseDuration(*evalInterval)
+		if err != nil || d <= 0 {
+			app.Fatalf("invalid eval interval %q", *evalInterval)
+		}
+		opts.EvalInterval = d
 	}
-	defer db.Close()
 
-	tr, err := getTimeRange(db, *start, *end)
+	// SIGTERM and SIGINT stop the backfill after writing the buffered
+	// samples, a second signal exits right away.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-sigs
+		level.Info(logger).Log("msg", "received signal, writing the buffered samples")
+		cancel()
+		<-sigs
+		os.Exit(1)
+	}()
+
+	b := backfill.New(logger, prometheus.DefaultRegisterer)
+	res, err := b.Run(ctx, opts)
+	if opts.Bench > 0 {
+		printBench(res.Bench)
+	}
+	if opts.Estimate > 0 {
+		printEstimate(res.Estimate)
+	}
+	if opts.CompareAgainst != "" {
+		printComparison(res.Comparison)
+	}
 	if err != nil {
-		level.Error(logger).Log("err", err)
-		return
+		level.Error(logger).Log("msg", "backfill failed", "err", err)
+		os.Exit(exitCode(err))
 	}
+}
+
+// defaultLogTimestampFormat is the timestamp format of promlog.
+const defaultLogTimestampFormat = "rfc3339-millis"
+
+// logTimestampLayouts are the layouts of the timestamp formats of log messages.
+var logTimestampLayouts = map[string]string{
+	"rfc3339-millis": "2006-01-02T15:04:05.000Z07:00",
+	"rfc3339":        time.RFC3339,
+	"rfc3339-nano":   time.RFC3339Nano,
+	"local":          "2006-01-02T15:04:05.000Z07:00",
+}
 
-	queryEngine := newQueryEngine(*maxSamples, *timeout, logger)
-	if *queryLogFile == "" {
-		queryEngine.SetQueryLogger(nil)
+// newLogger returns the logger of promlog.New with the given timestamp format
+// and the caller of every message only if caller is set. The defaults log
+// exactly like promlog.
+func newLogger(cfg *promlog.Config, tsFormat string, caller bool) log.Logger {
+	if tsFormat == defaultLogTimestampFormat && caller {
+		return promlog.New(cfg)
+	}
+	var l log.Logger
+	if cfg.Format.String() == "json" {
+		l = log.NewJSONLogger(log.NewSyncWriter(os.Stderr))
 	} else {
-		l, err := logging.NewJSONFileLogger(*queryLogFile)
-		if err != nil {
-			level.Error(logger).Log("msg", "failed to create query logger", "err", err)
-		}
-		queryEngine.SetQueryLogger(l)
+		l = log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
+	}
+	var lvl level.Option
+	switch cfg.Level.String() {
+	case "debug":
+		lvl = level.AllowDebug()
+	case "warn":
+		lvl = level.AllowWarn()
+	case "error":
+		lvl = level.AllowError()
+	default:
+		lvl = level.AllowInfo()
 	}
+	l = level.NewFilter(l, lvl)
 
-	queryFunc := prom_rules.EngineQueryFunc(queryEngine, db)
-	backfillRules(rules, *destPath, tr, evalInterval.Milliseconds(), *maxSamplesInMem, queryFunc, logger)
+	now := func() time.Time { return time.Now().UTC() }
+	if tsFormat == "local" {
+		now = time.Now
+	}
+	kvs := []interface{}{"ts", log.TimestampFormat(now, logTimestampLayouts[tsFormat])}
+	if caller {
+		kvs = append(kvs, "caller", log.DefaultCaller)
+	}
+	return log.With(l, kvs...)
+}
 
-	return
+// exitCode returns the exit code of a failed backfill, which is 1 unless the
+// cause of the failure has its own.
+func exitCode(err error) int {
+	switch errors.Cause(err) {
+	case backfill.ErrDiskFull, backfill.ErrDiskUsageLimit:
+		return 2
+	case backfill.ErrRunTimeout:
+		return 3
+	case backfill.ErrEmptyRules:
+		return 4
+	case backfill.ErrCompareMismatch:
+		return 5
+	case backfill.ErrRulePanic:
+		return 6
+	case backfill.ErrRulesQuarantined:
+		return 7
+	}
+	return 1
 }
 
-func newQueryEngine(maxSamples int, timeout time.Duration, logger log.Logger) *promql.Engine {
-	return promql.NewEngine(promql.EngineOpts{
-		Logger:     logger,
-		Reg:        prometheus.DefaultRegisterer,
-		MaxSamples: maxSamples,
-		Timeout:    timeout,
-	})
+// ruleFileArgs assigns the positional args, which start with the db path
+// instead of the rule file with --rule-url or --rules-from-url, and applies
+// their defaults. The rule file arg may be a URL, too.
+func ruleFileArgs(opts *backfill.Options, first string) error {
+	if opts.RuleURL.URL != "" && opts.RulesFromURL != "" {
+		return errors.New("both --rule-url and --rules-from-url are given")
+	}
+	if strings.HasPrefix(first, "http://") || strings.HasPrefix(first, "https://") {
+		if opts.RuleURL.URL != "" || opts.RulesFromURL != "" {
+			return errors.New("both a rule URL arg and --rule-url or --rules-from-url are given")
+		}
+		// The rule file arg is a URL, so the args don't move up.
+		opts.RuleURL.URL = first
+		defaultDBPaths(opts)
+		return nil
+	}
+	flag := "--rule-url"
+	if opts.RulesFromURL != "" {
+		flag = "--rules-from-url"
+	}
+	if opts.RuleURL.URL == "" && opts.RulesFromURL == "" {
+		if first == "" {
+			return errors.New("required argument 'rule-file' not provided")
+		}
+		if fi, err := os.Stat(first); err != nil || fi.IsDir() {
+			return errors.Errorf("rule file %s doesn't exist or is a directory", first)
+		}
+		opts.RuleFile = first
+	} else {
+		if opts.DestPath != "" {
+			return errors.Errorf("both a rule file and %s are given", flag)
+		}
+		// A TSDB is a directory, so a file can only be meant as rule file.
+		if fi, err := os.Stat(first); err == nil && !fi.IsDir() {
+			return errors.Errorf("both the rule file %s and %s are given", first, flag)
+		}
+		opts.DBPath, opts.DestPath = first, opts.DBPath
+	}
+	defaultDBPaths(opts)
+	return nil
 }
 
-func parseRules(filename string, logger log.Logger) ([]*recordingRule, []error) {
-	rgs, errs := rulefmt.ParseFile(filename)
-	if errs != nil {
-		return nil, errs
-	}
-
-	var rules []*recordingRule
-	for _, rg := range rgs.Groups {
-		for _, rule := range rg.Rules {
-			// We only consider recording rules.
-			if rule.Record.Value != "" {
-				expr, err := parser.ParseExpr(rule.Expr.Value)
-				if err != nil {
-					level.Error(logger).Log("msg", "failed to parse expr", "expr", rule.Expr, "err", err)
-					return nil, []error{errors.Wrap(err, filename)}
-				}
-				rules = append(rules, &recordingRule{rule.Record.Value, expr, labels.FromMap(rule.Labels)})
-			}
+// parseDiskUsage sets the max disk usage of opts to s, bytes or a percentage.
+func parseDiskUsage(opts *backfill.Options, s string) error {
+	if p := strings.TrimSuffix(s, "%"); p != s {
+		pct, err := strconv.ParseFloat(p, 64)
+		if err != nil || pct <= 0 || pct > 100 {
+			return errors.New("percentage must be in (0, 100]")
 		}
+		opts.MaxDiskUsagePercent = pct
+		return nil
+	}
+	b, err := units.ParseBase2Bytes(s)
+	if err != nil {
+		return err
 	}
+	opts.MaxDiskUsage = uint64(b)
+	return nil
+}
 
-	return rules, nil
+func defaultDBPaths(opts *backfill.Options) {
+	if opts.DBPath == "" {
+		opts.DBPath = defaultDBPath
+	}
+	if opts.DestPath == "" {
+		opts.DestPath = defaultDBPath
+	}
 }
 
-type timeRange struct {
-	start time.Time
-	end   time.Time
+func printBench(bench []backfill.RuleBench) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tRULE\tQUERIES\tERRORS\tP50\tP95\tMAX\tAVG SAMPLES\tSTEPS\tPROJECTED")
+	var total time.Duration
+	for _, rb := range bench {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\t%s\t%.1f\t%d\t%s\n", rb.Group, rb.Name, rb.Queries, rb.Errors, rb.P50, rb.P95, rb.Max, rb.AvgSamples, rb.Steps, rb.Projected.Round(time.Second))
+		total += rb.Projected
+	}
+	fmt.Fprintf(w, "\t\t\t\t\t\t\t\t\t%s\n", total.Round(time.Second))
+	w.Flush()
 }
 
-func getTimeRange(db *tsdb.DB, start, end string) (*timeRange, error) {
+func printEstimate(estimate []backfill.RuleEstimate) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tRULE\tQUERIES\tERRORS\tAVG SERIES\tSTDDEV\tAVG LATENCY\tSTEPS\tSAMPLES\tSIZE\tDURATION")
 	var (
-		stime, etime time.Time
-		err          error
+		samples, bytes int64
+		total          time.Duration
 	)
-
-	minTime, maxTime := db.Head().MinTime(), db.Head().MaxTime()
-	for _, block := range db.Blocks() {
-		minTime = min(minTime, block.MinTime())
+	for _, re := range estimate {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%.1f\t%.1f\t%s\t%d\t%d\t%s\t%s\n", re.Group, re.Name, re.Queries, re.Errors, re.AvgSeries, re.StddevSeries, re.AvgLatency, re.Steps, re.Samples, units.Base2Bytes(re.Bytes), re.Duration.Round(time.Second))
+		samples += re.Samples
+		bytes += re.Bytes
+		total += re.Duration
 	}
+	fmt.Fprintf(w, "\t\t\t\t\t\t\t\t%d\t%s\t%s\n", samples, units.Base2Bytes(bytes), total.Round(time.Second))
+	w.Flush()
+	fmt.Println("\nThe estimate is extrapolated from the sampled steps, rules with a high stddev of series are less reliable.")
+}
 
-	if start != "" {
-		stime, err = parseTime(start)
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to parse start time")
-		}
-		if timestamp.FromTime(stime) < minTime {
-			stime = timestamp.Time(minTime)
-		}
-	} else {
-		stime = timestamp.Time(minTime)
+func printComparison(comparison []backfill.RuleComparison) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tRULE\tMATCHED\tMISMATCHED\tONLY BACKFILLED\tONLY REFERENCE\tMISMATCH RATE\tMEAN ABS DIFF\tMAX ABS DIFF\tMEAN REL DIFF\tMAX REL DIFF")
+	for _, rc := range comparison {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%.2f%%\t%g\t%g\t%.2f%%\t%.2f%%\n", rc.Group, rc.Name, rc.Matched, rc.Mismatched, rc.OnlyBackfilled, rc.OnlyReference, 100*rc.MismatchRate(), rc.MeanAbsDiff, rc.MaxAbsDiff, 100*rc.MeanRelDiff, 100*rc.MaxRelDiff)
 	}
+	w.Flush()
 
-	if end != "" {
-		etime, err = parseTime(end)
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to parse end time")
+	for _, rc := range comparison {
+		if len(rc.Worst) == 0 {
+			continue
 		}
-		if timestamp.FromTime(etime) > maxTime {
-			etime = timestamp.Time(maxTime)
+		fmt.Printf("\nworst samples of %s/%s:\n", rc.Group, rc.Name)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SERIES\tTIME\tREFERENCE TIME\tBACKFILLED\tREFERENCE")
+		for _, d := range rc.Worst {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%g\t%g\n", d.Series, d.T.Format(time.RFC3339), d.RefT.Format(time.RFC3339), d.Backfilled, d.Reference)
 		}
-	} else {
-		etime = timestamp.Time(maxTime)
-	}
-
-	if stime.After(etime) {
-		return nil, errors.New("start time should be before end time")
+		w.Flush()
 	}
-
-	return &timeRange{stime, etime}, nil
 }
 
-func parseTime(s string) (time.Time, error) {
-	if t, err := strconv.ParseFloat(s, 64); err == nil {
-		s, ns := math.Modf(t)
-		return time.Unix(int64(s), int64(ns*float64(time.Second))), nil
+func printCoverage(c *backfill.Coverage) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BLOCK\tMIN TIME\tMAX TIME\tDURATION\tSERIES\tSAMPLES\tSIZE")
+	printBlock := func(name string, b backfill.BlockInfo) {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%s\n", name, formatTime(b.MinTime), formatTime(b.MaxTime), time.Duration(b.MaxTime-b.MinTime)*time.Millisecond, b.NumSeries, b.NumSamples, units.Base2Bytes(b.Size))
 	}
-	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
-		return t, nil
+	for _, b := range c.Blocks {
+		printBlock(b.ULID, b)
 	}
-	return time.Time{}, errors.Errorf("cannot parse %q to a valid timestamp", s)
-}
-
-func backfillRules(rules []*recordingRule, dest string, tr *timeRange, evalInterval int64, maxSamples int, queryFunc prom_rules.QueryFunc, logger log.Logger) {
-	start := timestamp.FromTime(tr.start)
-	end := timestamp.FromTime(tr.end)
-
-	var mss []*tsdb.MetricSample
-	var minTime int64 = math.MaxInt64
-	var maxTime int64 = math.MinInt64
-
-	for _, rule := range rules {
-		for t := start; t <= end; t += evalInterval {
-			vector, err := queryFunc(context.Background(), rule.vector.String(), timestamp.Time(t))
-			if err != nil {
-				level.Warn(logger).Log("err", err)
-				continue
-			}
-			for _, sample := range vector {
-				lb := labels.NewBuilder(sample.Metric)
-				lb.Set(labels.MetricName, rule.name)
-
-				for _, l := range rule.lset {
-					lb.Set(l.Name, l.Value)
-				}
-				mss = append(mss, &tsdb.MetricSample{Labels: lb.Labels(), Value: sample.V, TimestampMs: sample.T})
-
-				// update the samples time range
-				minTime = min(minTime, sample.T)
-				maxTime = max(maxTime, sample.T)
-
-				if len(mss) == maxSamples {
-					blockID, err := tsdb.CreateBlock(mss, dest, minTime, maxTime, logger)
-					if err != nil {
-						level.Error(logger).Log("msg", "failed to create block", "err", err)
-						return
-					}
-
-					minTime = math.MaxInt64
-					maxTime = math.MinInt64
-					mss = mss[:0]
-					level.Info(logger).Log("msg", "create block successfully", "block", blockID)
-				}
-			}
-		}
+	if c.Head != nil {
+		printBlock("head", *c.Head)
 	}
+	w.Flush()
 
-	// flush the remaining samples
-	if len(mss) > 0 {
-		blockID, err := tsdb.CreateBlock(mss, dest, minTime, maxTime, logger)
-		if err != nil {
-			level.Error(logger).Log("msg", "failed to create block", "err", err)
-			return
-		}
-		level.Info(logger).Log("msg", "create block successfully", "block", blockID)
+	for _, g := range c.Gaps {
+		fmt.Printf("\ngap from %s to %s (%s)", formatTime(g.Start), formatTime(g.End), time.Duration(g.End-g.Start)*time.Millisecond)
 	}
-
-	return
+	if len(c.Gaps) > 0 {
+		fmt.Println()
+	}
+	fmt.Printf("\ndata from %s to %s\n", formatTime(c.MinTime), formatTime(c.MaxTime))
 }
 
-func max(a, b int64) int64 {
-	if a > b {
-		return a
+func printCoverageJSON(c *backfill.Coverage) error {
+	b, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return err
 	}
-	return b
+	_, err = fmt.Println(string(b))
+	return err
 }
 
-func min(a, b int64) int64 {
-	if a > b {
-		return b
-	}
-	return a
+func formatTime(ms int64) string {
+	return timestamp.Time(ms).Format(time.RFC3339)
 }
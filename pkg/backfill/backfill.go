@@ -0,0 +1,2214 @@
+// Package backfill evaluates Prometheus recording rules over historical data
+// and writes the results as TSDB blocks.
+package backfill
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/logging"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	tsdb_errors "github.com/prometheus/prometheus/tsdb/errors"
+)
+
+// Output formats.
+const (
+	// OutputFormatTSDB writes the evaluated samples as TSDB blocks.
+	OutputFormatTSDB = "tsdb"
+	// OutputFormatCSV writes the evaluated samples as CSV rows, no blocks are created.
+	OutputFormatCSV = "csv"
+)
+
+// Policies for the buffered samples of a rule exceeding Options.MaxSeriesPerRule.
+const (
+	// SeriesLimitDrop drops the buffered samples of the rule.
+	SeriesLimitDrop = "drop"
+	// SeriesLimitKeep writes the buffered samples of the rule.
+	SeriesLimitKeep = "keep"
+)
+
+// Timestamps the samples are recorded at.
+const (
+	// TimestampModeEval records the samples at their evaluation step, like
+	// the rule manager of Prometheus.
+	TimestampModeEval = "eval"
+	// TimestampModeSample records the samples at the timestamp the engine
+	// returned, which is the query time, i.e. the step minus the query
+	// offset of the rule.
+	TimestampModeSample = "sample"
+)
+
+// seriesLimitExamples is the number of series logged for a rule exceeding
+// Options.MaxSeriesPerRule.
+const seriesLimitExamples = 5
+
+// Options configures a backfill run.
+type Options struct {
+	// RuleFile is the rule file whose recording rules are backfilled.
+	RuleFile string
+	// RuleURL configures fetching the rule file over HTTP instead, if its URL
+	// is set. RuleFile must be empty then.
+	RuleURL RuleURLOptions
+	// RulesFromURL is the base URL of a Prometheus server whose recording
+	// rules are fetched from its rules API instead, with the credentials and
+	// timeout of RuleURL. RuleFile and the URL of RuleURL must be empty then.
+	RulesFromURL string
+	// RulesSHA256 is the hex encoded SHA-256 hash the content of the rule
+	// file has to have, if set, to make sure exactly the reviewed rules are
+	// backfilled.
+	RulesSHA256 string
+	// DestIsPrometheusDataDir allows DestPath to be the data directory of a
+	// Prometheus server. The backfill range must end before its head block.
+	DestIsPrometheusDataDir bool
+	// Strict fails the backfill on record names colliding with metrics of a
+	// different label shape in the source instead of warning.
+	Strict bool
+	// StrictRange fails the backfill on a sample outside of the range of its
+	// rule instead of dropping it.
+	StrictRange bool
+	// ValidateExpressions evaluates the expression of every rule against empty
+	// data before the backfill, to report all rules that fail to evaluate
+	// regardless of the data up front.
+	ValidateExpressions bool
+	// EnableFeatures are features of the PromQL engine to enable, given like
+	// the --enable-feature flag of the server.
+	EnableFeatures []string
+	// Groups restricts the backfill to the named rule groups, all groups are
+	// backfilled if empty. ExcludeGroups are skipped.
+	Groups, ExcludeGroups []string
+	// ExcludeRules skips the rules matching any of these selectors, like
+	// `job:up:sum` or `job:up:sum{env="prod"}`, which match the record name
+	// and the static labels of a rule.
+	ExcludeRules []string
+	// DBPath is the TSDB directory to evaluate the rules against.
+	DBPath string
+	// MergeDBPaths are TSDB directories merged with DBPath, e.g. of other
+	// replicas. Samples present in several of them are deduplicated.
+	MergeDBPaths []string
+	// DedupReplicaLabels are the labels that tell the replicas of an HA pair
+	// apart in the source, e.g. prometheus_replica. They are removed from the
+	// source series, and series that only differed by them are deduplicated.
+	DedupReplicaLabels []string
+	// FillGapsFrom restricts the evaluation of every rule to the gaps of the
+	// series it records, in the TSDB at this path or in the source data with
+	// FillGapsSource. Blocks are cut at the end of every gap.
+	FillGapsFrom string
+	// FlushWAL reads DBPath without writing to it: the data in its WAL, e.g.
+	// of a server that crashed before cutting a block or of an agent, is
+	// written into a block in a temporary directory, which is removed after
+	// the backfill.
+	FlushWAL bool
+	// SourceBlockRange restricts the blocks of DBPath and MergeDBPaths that
+	// are opened to those overlapping the range given as <start>,<end>, and
+	// the block preceding it for the lookback of the first steps. It's
+	// derived from Start and End if empty. SourceBlockULIDs are the blocks to
+	// open instead, the head is left out with them.
+	SourceBlockRange string
+	SourceBlockULIDs []string
+	// OpenMetricsSource is an OpenMetrics or Prometheus text exposition file
+	// with timestamped samples to use as the source instead of DBPath.
+	OpenMetricsSource string
+	// StoreAPI configures a Thanos StoreAPI to use as the source instead of
+	// DBPath, if its address is set.
+	StoreAPI StoreAPIOptions
+	// Snapshot configures a snapshot of a running Prometheus server to use as
+	// the source instead of DBPath, if it's taken or its path is set.
+	Snapshot SnapshotOptions
+	// DestPath is the directory the new blocks are written to.
+	DestPath string
+	// DestLock takes an advisory lock on DestPath while writing into it, so
+	// a concurrent run on the same destination fails right away.
+	DestLock bool
+	// TenantLabel partitions the samples by the value of this label into
+	// blocks in a directory per tenant in DestPath, if set. Samples without
+	// the label are written into the directory of DefaultTenant, or fail
+	// the backfill if it's empty.
+	TenantLabel, DefaultTenant string
+	// TenantFromRules writes the samples of every rule into blocks in the
+	// directory of its tenant in DestPath, set by the backfill.tenant
+	// annotation of its group or its range override. Rules without a
+	// tenant fail the backfill.
+	TenantFromRules bool
+
+	// OutputFormat is one of OutputFormatTSDB (the default) or OutputFormatCSV.
+	OutputFormat string
+	// OutputFile is the file CSV rows are written to, stdout if empty.
+	OutputFile string
+	// CSVColumns are the labels written to dedicated CSV columns.
+	CSVColumns []string
+	// CSVDropOtherLabels drops the labels without a dedicated CSV column
+	// instead of serializing them into a single column.
+	CSVDropOtherLabels bool
+	// Receive sends the samples to a remote write endpoint, like a Thanos
+	// Receive, instead of writing blocks if its URL is set.
+	Receive ReceiveOptions
+
+	// Start and End bound the backfill range (RFC3339 or Unix timestamp).
+	// They default to and are clamped by the range of the source data.
+	Start, End string
+	// RangeOverridesFile maps group or record names to their own ranges and
+	// max samples limits.
+	RangeOverridesFile string
+	// EvalInterval is how frequently the recording rules are evaluated. If
+	// it's 0, the intervals of PrometheusConfigFile are used instead.
+	EvalInterval time.Duration
+	// PrometheusConfigFile is the configuration file of the Prometheus
+	// server evaluating the rules. Unless EvalInterval is set, the rules are
+	// evaluated at the interval of their group, or else the global
+	// evaluation_interval of the config.
+	PrometheusConfigFile string
+	// AutoEvalInterval sets EvalInterval to the scrape interval detected in
+	// the source data.
+	AutoEvalInterval bool
+	// SkipOlderThan raises the start of the backfill to this long before now,
+	// as blocks older than the retention of the destination would be deleted
+	// right away. DestRetention is the same as the retention of the
+	// destination's Prometheus server; the shorter of both applies.
+	SkipOlderThan, DestRetention time.Duration
+	// MinSampleAge caps the end of the backfill to this long before now, so
+	// the samples the live server may still be writing are left out.
+	MinSampleAge time.Duration
+	// TimestampShift is added to the timestamp of every sample, e.g. to
+	// replay the data of last week as this week's. It may be negative. The
+	// range of the rules still refers to the source data.
+	TimestampShift time.Duration
+	// EndExclusive excludes End from the evaluations, so the backfill covers
+	// [Start, End) and live evaluations can own End onwards.
+	EndExclusive bool
+	// TimestampMode is one of TimestampModeEval (the default) or
+	// TimestampModeSample.
+	TimestampMode string
+	// AlignEvaluations snaps the first evaluation timestamp of each rule up
+	// to the next multiple of EvalInterval.
+	AlignEvaluations bool
+	// TimestampsFile is a file with newline-separated timestamps the rules are
+	// evaluated at instead of every EvalInterval. Timestamps outside of the
+	// range of a rule are skipped.
+	TimestampsFile string
+	// FailuresFile is the file the evaluation steps whose query failed are
+	// written to, as JSON lines of Failure.
+	FailuresFile string
+	// RetryFromFailures is a failures file whose steps are evaluated again
+	// instead of the ranges of the rules. The steps that still fail, and
+	// those of rules that aren't in the rule file anymore, are written to
+	// FailuresFile, which defaults to RetryFromFailures.
+	RetryFromFailures string
+	// TimestampReference is a series selector whose samples in the source
+	// the rules are evaluated at instead of every EvalInterval, within the
+	// range of each rule, e.g. to fill a gap in line with the recorded data.
+	TimestampReference string
+
+	// MaxSamples is the maximum number of samples a single query can load into
+	// memory. The range overrides can set it per rule.
+	MaxSamples int
+	// SlowQueryThreshold logs the queries slower than this, 0 disables it.
+	SlowQueryThreshold time.Duration
+	// Timeout is the maximum time a query may take before being aborted.
+	Timeout time.Duration
+	// MaxQueryDuration cancels the instant query of a single evaluation
+	// step once it takes longer, and the evaluation continues with the next
+	// step. 0 means no limit other than Timeout.
+	MaxQueryDuration time.Duration
+	// QuarantineAfter abandons a rule for the rest of the run once this many
+	// consecutive steps failed with a timeout or by exceeding the max samples
+	// limit, and the other rules are evaluated. 0 means rules are never
+	// abandoned.
+	QuarantineAfter int
+	// AutoExtendTimeout doubles the timeout and max query duration of a rule
+	// the first time it would be abandoned after timeouts and continues its
+	// evaluation. It's abandoned if it fails as often again.
+	AutoExtendTimeout bool
+	// RangeQueries evaluates rules with one range query per batch of steps
+	// instead of one instant query per step, where the expression allows it.
+	RangeQueries bool
+	// StepBatchSize is the number of evaluation steps processed as a batch,
+	// DefaultStepBatchSize if not set.
+	StepBatchSize int
+	// SkipEmptyRanges skips the runs of steps at which the source has no
+	// data for the selectors of a rule, checked in chunks of an hour,
+	// including the lookback of its expression before each step.
+	SkipEmptyRanges bool
+	// PreflightSkip skips rules whose selectors match no series in the
+	// source within their range instead of evaluating them.
+	PreflightSkip bool
+	// OnlyMissing skips the rules whose recorded series already have a
+	// sample in every aligned two-hour window of their range in the
+	// destination.
+	OnlyMissing bool
+	// QueryLogFile is the file PromQL queries are logged to, if set.
+	QueryLogFile string
+	// QueryLogRequired fails the run if QueryLogFile can't be created
+	// instead of disabling query logging.
+	QueryLogRequired bool
+	// Follow keeps backfilling the source data that appears after the range
+	// once it's backfilled, every FollowFlushInterval, checking the source
+	// every FollowPoll, EvalInterval if zero. It stops at FollowUntil, if set,
+	// or when the context is canceled.
+	Follow              bool
+	FollowPoll          time.Duration
+	FollowFlushInterval time.Duration
+	FollowUntil         string
+	// ActiveQueryTrackerDir is the directory the queries in flight are
+	// tracked in, like in the data directory of a server. Queries of a run
+	// that was interrupted or crashed are logged by the next run.
+	ActiveQueryTrackerDir string
+
+	// Bench measures the latency of this many queries per rule and projects
+	// the time of the full backfill instead of backfilling, if set.
+	Bench int
+	// Estimate evaluates every rule at this many steps and projects the
+	// samples, size and time of the full backfill instead of backfilling, if
+	// set.
+	Estimate int
+	// CompareAgainst is a TSDB directory or the URL of a Prometheus server
+	// holding the series of the rules recorded live. If set, the evaluated
+	// samples are compared with them instead of backfilled, pairing the
+	// samples of a series within half an eval interval.
+	CompareAgainst string
+	// CompareTolerance is the relative difference up to which the values of
+	// paired samples match.
+	CompareTolerance float64
+	// MaxMismatchRate is the share of the samples of a rule that may mismatch
+	// the reference before the comparison fails.
+	MaxMismatchRate float64
+	// MaxSamplesInMem is the number of samples buffered before a block is cut,
+	// 0 means no limit.
+	MaxSamplesInMem int
+	// MaxSeriesPerBlock fails the backfill when a block would have more
+	// series, 0 means no limit.
+	MaxSeriesPerBlock int
+	// MaxBlockSeries cuts a block at the end of the step at which it reached
+	// this many series, 0 means no limit. Blocks are cut at whichever of
+	// MaxSamplesInMem, MaxMemory and MaxBlockSeries is reached first.
+	MaxBlockSeries int
+	// MaxSeriesPerRule stops the evaluation of a rule once it produced more
+	// series, 0 means no limit. OnSeriesLimit is SeriesLimitDrop (the
+	// default) or SeriesLimitKeep and decides whether the samples of the rule
+	// that are still buffered are written. Samples already written into
+	// blocks are kept either way.
+	MaxSeriesPerRule int
+	OnSeriesLimit    string
+	// MaxMemory is the estimated memory of the buffered samples at which a
+	// block is cut, 0 means no limit. Blocks are cut at whichever of
+	// MaxSamplesInMem and MaxMemory is reached first.
+	MaxMemory uint64
+	// SourceCacheSize is the estimated memory of the source samples cached
+	// for the queries of the rules, in windows of an hour per selector that
+	// are read once for all steps and rules selecting them while they are
+	// cached. 0 disables the cache.
+	SourceCacheSize uint64
+	// CPUProfile and MemProfile are files a CPU profile of the evaluation
+	// and a heap profile at its end are written to, if set.
+	CPUProfile, MemProfile string
+	// MaxConcurrentBlocks is the number of blocks written at the same time
+	// while the evaluation goes on. Each holds its samples in memory until
+	// it's written. 0 and 1 write blocks one at a time, before the evaluation
+	// continues.
+	MaxConcurrentBlocks int
+	// MaxDiskUsage is the maximum disk usage of the backfill, 0 means no
+	// limit. MaxDiskUsagePercent is the maximum usage of the filesystem of
+	// DestPath in percent, 0 means no limit. Both are checked against the
+	// projected usage before the backfill and the written blocks during it,
+	// which stops once one is exceeded, after writing the buffered samples.
+	MaxDiskUsage        uint64
+	MaxDiskUsagePercent float64
+	// Force starts the backfill even if the projected disk usage is too large,
+	// a Prometheus server is running on the destination or the destination is
+	// the source TSDB.
+	Force bool
+	// AllowOverlappingOutput starts the backfill even if blocks in DestPath
+	// overlap the backfill range.
+	AllowOverlappingOutput bool
+	// FailOnOverlap refuses to start if any block in DestPath overlaps the
+	// backfill range, including the ones that are only warned about otherwise.
+	FailOnOverlap bool
+	// Overwrite moves blocks in DestPath that overlap the backfill range and
+	// only contain series of the backfilled rules aside before writing.
+	Overwrite bool
+	// Correct writes tombstones for the series of the backfilled rules over
+	// their ranges into the blocks of previous backfills in DestPath that
+	// overlap the backfill range, once the run completed, so only the samples
+	// of the new blocks are queried.
+	Correct bool
+	// RunTimeout stops the evaluation cleanly once exceeded, 0 means no timeout.
+	// The buffered samples are still written.
+	RunTimeout time.Duration
+	// Compact merges the blocks created by the run into blocks spanning at
+	// most CompactBlockDuration once the evaluation finished. Blocks that
+	// existed before the run aren't touched.
+	Compact              bool
+	CompactBlockDuration time.Duration
+	// Deterministic derives the ULID of every created block from the hash of
+	// its samples, which is recorded in its meta.json, so two runs over the
+	// same input create identical blocks.
+	Deterministic bool
+	// CreatedBlocksFile is the file the created blocks are listed in as JSON
+	// once the run ends, if set. It's written on failed runs as well and then
+	// lists the blocks completed before the failure.
+	CreatedBlocksFile string
+	// SeriesManifest is the file the written series are listed in once the
+	// run ends, with their numbers of samples and time ranges, if set. Like
+	// CreatedBlocksFile, it's written on failed runs as well.
+	SeriesManifest string
+	// SeriesManifestFormat is one of ManifestFormatJSON (the default) or
+	// ManifestFormatCSV.
+	SeriesManifestFormat string
+	// AppendToHead appends samples within the window of the head of the
+	// destination TSDB to the head instead of writing them into blocks. The
+	// destination must not be used by a running Prometheus server.
+	AppendToHead bool
+	// AppendBatchSize is the number of samples appended to the head with
+	// AppendToHead before they are committed, DefaultAppendBatchSize if 0.
+	// The committed samples are kept if the backfill fails.
+	AppendBatchSize int
+	// AllowDuplicateSeries only warns instead of failing when two rules produce
+	// the same series.
+	AllowDuplicateSeries bool
+	// SkipInvalidValues drops samples whose value is NaN or ±Inf instead of
+	// writing them.
+	SkipInvalidValues bool
+	// RoundValues rounds the value of every sample to RoundToDecimals decimal
+	// places, which compresses better than values with full precision.
+	RoundValues     bool
+	RoundToDecimals int
+	// RelabelConfigFile is a YAML list of relabel configs the final labels
+	// of every sample are relabeled with before they are filtered by
+	// OutputFilters, like the metric_relabel_configs of a scrape config.
+	RelabelConfigFile string
+	// OutputFilters are label matchers like `namespace=~"prod-.*"` the
+	// samples of all rules have to match, with their final labels, to be
+	// written. The others are dropped.
+	OutputFilters []string
+	// FailOnConflictingDuplicates fails the backfill when a series gets two
+	// different values at the same timestamp.
+	FailOnConflictingDuplicates bool
+	// SampleIntervalTolerance drops the samples whose timestamp is this close
+	// to, but not the same as, that of the previous sample of their series,
+	// 0 disables it. It has to be shorter than EvalInterval.
+	SampleIntervalTolerance time.Duration
+	// FailOnEmptyRule fails the backfill when a rule didn't produce a single
+	// sample in its range.
+	FailOnEmptyRule bool
+}
+
+// Result summarizes a backfill run.
+type Result struct {
+	// Blocks are the ULIDs of the created blocks, with Options.TenantLabel or
+	// Options.TenantFromRules prefixed with the directory of their tenant.
+	Blocks []string
+	// BlockSeries are the numbers of series of Blocks, nil if they were
+	// compacted.
+	BlockSeries []int
+	// BlockStats describe the written Blocks, nil if they were compacted.
+	BlockStats []BlockStats
+	// ChunkBytes and IndexBytes are the on-disk sizes of the chunks and the
+	// indexes of the written blocks, BlockDuration the total time it took to
+	// create them.
+	ChunkBytes, IndexBytes int64
+	BlockDuration          time.Duration
+	// Samples is the number of samples written.
+	Samples int
+	// HeadSamples is the number of samples appended to the head of the
+	// destination with Options.AppendToHead, they are part of Samples.
+	HeadSamples int
+	// Duplicates is the number of dropped samples identical to one already written.
+	Duplicates int
+	// ConflictingDuplicates is the number of dropped samples whose series
+	// already had a different value at the same timestamp.
+	ConflictingDuplicates int
+	// NearDuplicates is the number of dropped samples within
+	// Options.SampleIntervalTolerance of the previous sample of their series.
+	NearDuplicates int
+	// InvalidValues is the number of dropped NaN and ±Inf samples.
+	InvalidValues int
+	// TimedOutSteps is the number of evaluation steps canceled at
+	// Options.MaxQueryDuration.
+	TimedOutSteps int
+	// SourceCacheHits and SourceCacheMisses are the numbers of windows of
+	// the series of a selector served from the source cache and read from
+	// the source with Options.SourceCacheSize.
+	SourceCacheHits, SourceCacheMisses int
+	// ReceiveConflicts is the number of requests with Options.Receive
+	// rejected with 409 Conflict and counted as ingested.
+	ReceiveConflicts int
+	// Rules are the results of the individual rules.
+	Rules []RuleResult
+	// Tenants are the blocks and samples written per tenant, with
+	// Options.TenantLabel or Options.TenantFromRules.
+	Tenants []TenantResult
+	// Bench are the query latencies of the rules in bench mode.
+	Bench []RuleBench
+	// Estimate are the projected outputs of the rules in estimate mode.
+	Estimate []RuleEstimate
+	// Comparison are the results of the rules in comparison mode.
+	Comparison []RuleComparison
+}
+
+// RuleResult summarizes the backfill of a single rule.
+type RuleResult struct {
+	Group string
+	Name  string
+	// Start and End are the effective backfill range of the rule.
+	Start, End time.Time
+	// TruncatedAt is the first timestamp that wasn't evaluated when the run
+	// was stopped early, zero if the rule was backfilled completely.
+	TruncatedAt time.Time
+	// Samples is the number of samples written for the rule.
+	Samples int
+	// InvalidValues is the number of dropped NaN and ±Inf samples.
+	InvalidValues int
+	// OutOfRange is the number of dropped samples whose timestamp is
+	// outside of the range of the rule.
+	OutOfRange int
+	// Filtered is the number of samples dropped by Options.OutputFilters.
+	Filtered int
+	// Relabeled and RelabelDropped are the numbers of samples whose labels
+	// were changed and of samples dropped by Options.RelabelConfigFile.
+	Relabeled, RelabelDropped int
+	// SlowQueries is the number of queries slower than
+	// Options.SlowQueryThreshold, MaxQueryDuration the duration of the
+	// slowest query.
+	SlowQueries      int
+	MaxQueryDuration time.Duration
+	// TimedOutSteps is the number of evaluation steps canceled at
+	// Options.MaxQueryDuration, which have no samples.
+	TimedOutSteps int
+	// FailedSteps is the number of evaluation steps whose query failed,
+	// besides TimedOutSteps, which have no samples.
+	FailedSteps int
+	// NoDataSteps is the number of steps that weren't evaluated as the
+	// source has no data for them, with Options.SkipEmptyRanges.
+	NoDataSteps int64
+	// Gaps are the gaps of the recorded series that were filled, with
+	// Options.FillGapsFrom.
+	Gaps []Gap
+	// Expired is the part of the requested range that was skipped as older
+	// than Options.SkipOlderThan or Options.DestRetention.
+	Expired time.Duration
+	// SeriesLimited is set if the evaluation of the rule was stopped as it
+	// produced more than Options.MaxSeriesPerRule series.
+	SeriesLimited bool
+	// Skipped is set if the rule wasn't evaluated as none of its selectors
+	// matched series in the source.
+	Skipped bool
+	// Covered is set if the rule wasn't evaluated as the destination has its
+	// recorded series throughout its range, with Options.OnlyMissing.
+	Covered bool
+	// Panic is the value of a panic that stopped the evaluation of the rule,
+	// whose samples up to it are written. The other rules are evaluated.
+	Panic string
+	// QuarantinedAt is the first step that wasn't evaluated as the rule was
+	// abandoned after Options.QuarantineAfter consecutive failed steps, zero
+	// if it wasn't.
+	QuarantinedAt time.Time
+	// TimeoutExtended is set if the timeout of the rule was doubled with
+	// Options.AutoExtendTimeout.
+	TimeoutExtended bool
+}
+
+// ErrRunTimeout is returned when the run was stopped by Options.RunTimeout.
+var ErrRunTimeout = errors.New("run timeout exceeded")
+
+// ErrEmptyRules is returned with Options.FailOnEmptyRule when rules didn't
+// produce any samples.
+var ErrEmptyRules = errors.New("rules produced no samples")
+
+// ErrRulePanic is returned when the evaluation of rules panicked. The
+// samples of the other rules are written.
+var ErrRulePanic = errors.New("evaluation of rules panicked")
+
+// ErrRulesQuarantined is returned when rules were abandoned after
+// Options.QuarantineAfter consecutive failed steps. The samples of the other
+// rules, and of the abandoned ones before they were abandoned, are written.
+var ErrRulesQuarantined = errors.New("rules were abandoned after consecutive failed steps")
+
+// Backfiller backfills recording rules.
+type Backfiller struct {
+	logger  log.Logger
+	reg     prometheus.Registerer
+	metrics *metrics
+}
+
+// New returns a Backfiller. The registerer may be nil.
+func New(logger log.Logger, reg prometheus.Registerer) *Backfiller {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &Backfiller{logger: logger, reg: reg, metrics: newMetrics(reg)}
+}
+
+// Run backfills the recording rules of opts.RuleFile, opts.RuleURL or
+// opts.RulesFromURL. The returned result covers the blocks created before a
+// failure, too.
+func (b *Backfiller) Run(ctx context.Context, opts Options) (Result, error) {
+	if opts.Follow {
+		return b.follow(ctx, opts)
+	}
+	if err := checkFeatures(opts.EnableFeatures); err != nil {
+		return Result{}, err
+	}
+	content, ruleFile, err := readRules(ctx, opts)
+	if err != nil {
+		return Result{}, errors.Wrap(err, "loading groups failed")
+	}
+	if opts.RulesSHA256 != "" {
+		if err := checkRulesSHA256(content, opts.RulesSHA256); err != nil {
+			return Result{}, errors.Wrap(err, ruleFile)
+		}
+	}
+	// The rule file is recorded in the blocks and the query log, a fetched
+	// one by its URL.
+	opts.RuleFile = ruleFile
+	rules, errs := parseRules(content, opts.RuleFile, b.logger)
+	if errs != nil {
+		var merr tsdb_errors.MultiError
+		for _, e := range errs {
+			merr.Add(e)
+		}
+		return Result{}, errors.Wrap(merr.Err(), "loading groups failed")
+	}
+	rules, err = filterGroups(rules, opts.Groups, opts.ExcludeGroups)
+	if err != nil {
+		return Result{}, errors.Wrap(err, opts.RuleFile)
+	}
+	rules, err = excludeRules(rules, opts.ExcludeRules, b.logger)
+	if err != nil {
+		return Result{}, errors.Wrap(err, opts.RuleFile)
+	}
+	if err := b.applyPrometheusConfig(&opts, rules, opts.RuleURL.URL == "" && opts.RulesFromURL == ""); err != nil {
+		return Result{}, err
+	}
+	if opts.ValidateExpressions {
+		engine := newQueryEngine(opts.MaxSamples, opts.Timeout, b.logger, nil, nil)
+		if errs := checkExpressions(ctx, rules, engine); errs != nil {
+			var merr tsdb_errors.MultiError
+			for _, e := range errs {
+				merr.Add(e)
+			}
+			return Result{}, errors.Wrap(merr.Err(), "rules fail to evaluate")
+		}
+	}
+
+	writeBlocks := opts.OutputFormat == "" || opts.OutputFormat == OutputFormatTSDB
+	if !writeBlocks && opts.OutputFormat != OutputFormatCSV {
+		return Result{}, errors.Errorf("unknown output format %q", opts.OutputFormat)
+	}
+	switch opts.SeriesManifestFormat {
+	case "", ManifestFormatJSON, ManifestFormatCSV:
+	default:
+		return Result{}, errors.Errorf("unknown series manifest format %q", opts.SeriesManifestFormat)
+	}
+	switch opts.TimestampMode {
+	case "", TimestampModeEval, TimestampModeSample:
+	default:
+		return Result{}, errors.Errorf("unknown timestamp mode %q", opts.TimestampMode)
+	}
+	switch opts.OnSeriesLimit {
+	case "", SeriesLimitDrop, SeriesLimitKeep:
+	default:
+		return Result{}, errors.Errorf("unknown series limit policy %q", opts.OnSeriesLimit)
+	}
+	perTenant := opts.TenantLabel != "" || opts.TenantFromRules
+	if opts.TenantLabel != "" && opts.TenantFromRules {
+		return Result{}, errors.New("the tenants can't be taken from both a tenant label and the rules")
+	}
+	if perTenant {
+		switch {
+		case opts.OutputFormat == OutputFormatCSV:
+			return Result{}, errors.New("per-tenant output requires the TSDB output format")
+		case opts.DestIsPrometheusDataDir, opts.AppendToHead, opts.Overwrite, opts.Correct, opts.Compact, opts.OnlyMissing:
+			return Result{}, errors.New("per-tenant output can't be combined with writing into a Prometheus data directory, appending to the head, overwriting, correcting, compacting blocks or only backfilling missing series")
+		}
+		if opts.DefaultTenant != "" {
+			if err := checkTenant(opts.DefaultTenant); err != nil {
+				return Result{}, errors.Wrap(err, "invalid default tenant")
+			}
+		}
+	}
+	filter, err := parseOutputFilters(opts.OutputFilters)
+	if err != nil {
+		return Result{}, err
+	}
+	var relabelCfgs []*relabel.Config
+	if opts.RelabelConfigFile != "" {
+		if relabelCfgs, err = loadRelabelConfigs(opts.RelabelConfigFile); err != nil {
+			return Result{}, errors.Wrap(err, "failed to load relabel configs")
+		}
+	}
+	// The compared, covered and filled series are at the unshifted timestamps.
+	if opts.TimestampShift != 0 && (opts.CompareAgainst != "" || opts.OnlyMissing || opts.FillGapsFrom != "") {
+		return Result{}, errors.New("a timestamp shift can't be combined with comparing, only backfilling missing series or filling gaps")
+	}
+	if opts.SourceBlockRange != "" && len(opts.SourceBlockULIDs) > 0 {
+		return Result{}, errors.New("a source block range and source block ULIDs can't be combined")
+	}
+	// The flushed WAL isn't a block the filter could select.
+	if opts.FlushWAL && (opts.SourceBlockRange != "" || len(opts.SourceBlockULIDs) > 0) {
+		return Result{}, errors.New("filtering the source blocks can't be combined with flushing the WAL")
+	}
+	if opts.Correct && (opts.Overwrite || opts.OutputFormat == OutputFormatCSV) {
+		return Result{}, errors.New("correcting can't be combined with overwriting or the CSV output format")
+	}
+	// Compaction creates blocks with random ULIDs.
+	if opts.Deterministic && opts.Compact {
+		return Result{}, errors.New("deterministic block ULIDs can't be combined with compacting blocks")
+	}
+	if opts.AppendBatchSize < 0 {
+		return Result{}, errors.New("the number of samples to append to the head before committing them can't be negative")
+	}
+	if opts.QuarantineAfter < 0 {
+		return Result{}, errors.New("the number of consecutive failed steps to abandon a rule after can't be negative")
+	}
+	if opts.AutoExtendTimeout && opts.QuarantineAfter == 0 {
+		return Result{}, errors.New("extending the timeout of rules requires the number of consecutive failed steps to do it after")
+	}
+	if opts.RoundValues && (opts.RoundToDecimals < 0 || opts.RoundToDecimals > maxRoundDecimals) {
+		return Result{}, errors.Errorf("the number of decimals to round to has to be between 0 and %d", maxRoundDecimals)
+	}
+	if opts.Receive.URL != "" {
+		switch {
+		case opts.OutputFormat == OutputFormatCSV:
+			return Result{}, errors.New("sending the samples to receive can't be combined with the CSV output format")
+		case perTenant, opts.DestIsPrometheusDataDir, opts.AppendToHead, opts.Overwrite, opts.Correct, opts.Compact, opts.Deterministic, opts.OnlyMissing:
+			return Result{}, errors.New("sending the samples to receive can't be combined with per-tenant output, writing into a Prometheus data directory, appending to the head, overwriting, correcting, compacting or deterministic blocks or only backfilling missing series")
+		}
+		writeBlocks = false
+	}
+	// Nothing is written in bench, estimate and comparison mode.
+	writeBlocks = writeBlocks && opts.Bench == 0 && opts.Estimate == 0 && opts.CompareAgainst == ""
+
+	if writeBlocks {
+		if err := checkDest(opts.DestPath); err != nil {
+			return Result{}, errors.Wrapf(err, "invalid destination %s", opts.DestPath)
+		}
+		// The lock covers the directories of the tenants in the destination.
+		if opts.DestLock {
+			lock, err := lockDest(opts.DestPath)
+			if err != nil {
+				return Result{}, err
+			}
+			defer lock.Release()
+		}
+		dataDir, err := isPrometheusDataDir(opts.DestPath)
+		if err != nil {
+			return Result{}, errors.Wrapf(err, "invalid destination %s", opts.DestPath)
+		}
+		if dataDir && !opts.DestIsPrometheusDataDir {
+			return Result{}, errors.Errorf("destination %s looks like the data directory of a Prometheus server, use --dest-is-prometheus-data-dir to write into it", opts.DestPath)
+		}
+		if opts.DestIsPrometheusDataDir {
+			running, err := isLocked(opts.DestPath)
+			if err != nil {
+				return Result{}, errors.Wrapf(err, "check lock file of %s", opts.DestPath)
+			}
+			// Whether the server allows overlapping blocks can't be told from its data directory.
+			if running && opts.AppendToHead {
+				return Result{}, errors.New("a Prometheus server is running on the destination, it has to be stopped to append to its head")
+			}
+			// The server only reads the tombstones of a block when loading it.
+			if running && opts.Correct {
+				return Result{}, errors.New("a Prometheus server is running on the destination, it has to be stopped to correct its blocks")
+			}
+			if running && !opts.Force {
+				return Result{}, errors.New("a Prometheus server is running on the destination, it has to run with --storage.tsdb.allow-overlapping-blocks to load the backfilled blocks, use --force to confirm")
+			}
+			if running {
+				level.Warn(b.logger).Log("msg", "writing into the data directory of a running Prometheus server, which has to run with --storage.tsdb.allow-overlapping-blocks")
+			}
+		}
+		if err := recoverDest(opts.DestPath, perTenant, b.logger); err != nil {
+			return Result{}, errors.Wrapf(err, "failed to clean up %s", opts.DestPath)
+		}
+		defer os.Remove(filepath.Join(opts.DestPath, stagingDir))
+		if perTenant {
+			defer func() {
+				dirs, _ := filepath.Glob(filepath.Join(opts.DestPath, "*", stagingDir))
+				for _, dir := range dirs {
+					os.Remove(dir)
+				}
+			}()
+		}
+
+		if opts.OpenMetricsSource == "" && opts.StoreAPI.Address == "" && !opts.Snapshot.Take && opts.Snapshot.Path == "" && !opts.DestIsPrometheusDataDir {
+			for _, dir := range append([]string{opts.DBPath}, opts.MergeDBPaths...) {
+				same, err := sameDir(dir, opts.DestPath)
+				if err != nil {
+					return Result{}, errors.Wrapf(err, "compare source %s and destination %s", dir, opts.DestPath)
+				}
+				if same && !opts.Force {
+					return Result{}, errors.Errorf("destination %s is the source TSDB, use a different dest path or --force to write into it", opts.DestPath)
+				}
+				if same {
+					level.Warn(b.logger).Log("msg", "writing into the source TSDB", "dir", opts.DestPath)
+				}
+			}
+		}
+	}
+
+	var src source
+	if opts.OpenMetricsSource != "" {
+		s, err := newOpenMetricsSource(opts.OpenMetricsSource, b.logger)
+		if err != nil {
+			return Result{}, errors.Wrap(err, "failed to load OpenMetrics source")
+		}
+		src = s
+	} else if opts.StoreAPI.Address != "" {
+		// The StoreAPI doesn't tell the time range of its data.
+		if opts.Start == "" || opts.End == "" {
+			return Result{}, errors.New("start and end are required with a StoreAPI source")
+		}
+		s, err := newStoreAPISource(opts.StoreAPI, b.logger)
+		if err != nil {
+			return Result{}, errors.Wrapf(err, "failed to connect to StoreAPI %s", opts.StoreAPI.Address)
+		}
+		src = s
+	} else if opts.Snapshot.Take || opts.Snapshot.Path != "" {
+		s, dir, err := openSnapshot(ctx, opts.Snapshot, b.logger)
+		if dir != "" && opts.Snapshot.Cleanup {
+			defer func() {
+				if err := os.RemoveAll(dir); err != nil {
+					level.Warn(b.logger).Log("msg", "failed to delete snapshot", "dir", dir, "err", err)
+				}
+			}()
+		}
+		if err != nil {
+			return Result{}, errors.Wrap(err, "failed to open snapshot")
+		}
+		if dir != "" {
+			level.Info(b.logger).Log("msg", "took snapshot", "dir", dir)
+		}
+		src = s
+	} else {
+		var filter *blockFilter
+		if !opts.FlushWAL {
+			if filter, err = sourceBlockFilter(opts, rules); err != nil {
+				return Result{}, err
+			}
+		}
+		var s source
+		if opts.FlushWAL {
+			s, err = openFlushedSource(opts.DBPath, b.logger)
+		} else if filter != nil {
+			s, err = openFilteredSource(opts.DBPath, *filter, b.logger)
+		} else {
+			s, err = openTSDBSource(opts.DBPath, b.logger, b.reg)
+		}
+		if err != nil {
+			return Result{}, errors.Wrapf(err, "failed to open TSDB %s", opts.DBPath)
+		}
+		src = s
+		if len(opts.MergeDBPaths) > 0 {
+			merged := &mergedSource{sources: []source{s}}
+			for _, dir := range opts.MergeDBPaths {
+				// The metrics of the first TSDB are registered already.
+				var s source
+				if opts.FlushWAL {
+					s, err = openFlushedSource(dir, b.logger)
+				} else if filter != nil {
+					s, err = openFilteredSource(dir, *filter, b.logger)
+				} else {
+					s, err = openTSDBSource(dir, b.logger, nil)
+				}
+				if err != nil {
+					merged.Close()
+					return Result{}, errors.Wrapf(err, "failed to open TSDB %s", dir)
+				}
+				merged.sources = append(merged.sources, s)
+			}
+			src = merged
+		}
+	}
+	if len(opts.DedupReplicaLabels) > 0 {
+		src = newDedupSource(src, opts.DedupReplicaLabels)
+	}
+	defer src.Close()
+
+	minTime, maxTime := src.MinTime(), src.MaxTime()
+	if minTime > maxTime {
+		return Result{}, errors.New("the source has no data")
+	}
+	var overrides *rangeOverrides
+	if opts.RangeOverridesFile != "" {
+		overrides, err = loadRangeOverrides(opts.RangeOverridesFile)
+		if err != nil {
+			return Result{}, errors.Wrap(err, "failed to load range overrides")
+		}
+	}
+	if opts.TenantFromRules {
+		var missing []string
+		for _, rule := range rules {
+			if overrides != nil {
+				if t := overrides.tenant(rule); t != "" {
+					rule.tenant = t
+				}
+			}
+			if rule.tenant == "" {
+				missing = append(missing, rule.group+"/"+rule.name)
+				continue
+			}
+			if err := checkTenant(rule.tenant); err != nil {
+				return Result{}, errors.Wrapf(err, "rule %s in group %s", rule.name, rule.group)
+			}
+		}
+		if len(missing) > 0 {
+			return Result{}, errors.Errorf("rules %s have no tenant, set the %s annotation on their group or a tenant in the range overrides", strings.Join(missing, ","), annotationTenant)
+		}
+	}
+	// The newest samples may still be written and evaluated by the live
+	// server, leave them out to not create blocks overlapping with its data.
+	var notAfter time.Time
+	if opts.MinSampleAge > 0 {
+		notAfter = timestamp.Time(timestamp.FromTime(time.Now().Add(-opts.MinSampleAge)))
+	}
+	// Blocks older than the retention of the destination would be deleted
+	// right away, so the range starts no earlier than the retention allows.
+	var notBefore time.Time
+	retention := opts.SkipOlderThan
+	if opts.DestRetention > 0 && (retention == 0 || opts.DestRetention < retention) {
+		retention = opts.DestRetention
+	}
+	if retention > 0 {
+		// The retention applies to the shifted samples.
+		notBefore = timestamp.Time(timestamp.FromTime(time.Now().Add(-retention - opts.TimestampShift)))
+	}
+	var capped, expired int
+	var maxExpired time.Duration
+	for _, rule := range rules {
+		// The range given in the options takes precedence over the one annotated on the group.
+		start, end := opts.Start, opts.End
+		if start == "" {
+			start = rule.start
+		}
+		if end == "" {
+			end = rule.end
+		}
+		tr, err := getTimeRange(minTime, maxTime, start, end, notAfter)
+		if err != nil {
+			return Result{}, errors.Wrapf(err, "group %s", rule.group)
+		}
+
+		rule.tr = tr
+		if overrides != nil {
+			rule.tr, err = overrides.timeRange(rule, tr, minTime, maxTime, b.logger)
+			if err != nil {
+				return Result{}, err
+			}
+			rule.maxSamples = overrides.maxSamples(rule)
+			var c bool
+			if rule.tr, c = rule.tr.capEnd(notAfter); c && rule.tr.start.After(rule.tr.end) {
+				return Result{}, errors.Errorf("start time override of rule %s is after %s, the newest time old enough to backfill", rule.name, notAfter.Format(time.RFC3339))
+			}
+		}
+		if rule.tr.end.Equal(notAfter) {
+			capped++
+		}
+		if rule.tr, rule.expired = rule.tr.capStart(notBefore); rule.expired > 0 {
+			if rule.tr.start.After(rule.tr.end) {
+				return Result{}, errors.Errorf("range of rule %s ends at %s, before %s, the oldest time the destination retains", rule.name, rule.tr.end.Format(time.RFC3339), notBefore.Format(time.RFC3339))
+			}
+			expired++
+			if rule.expired > maxExpired {
+				maxExpired = rule.expired
+			}
+		}
+	}
+	if capped > 0 {
+		level.Info(b.logger).Log("msg", "capped the end of the backfill to the minimum sample age", "end", notAfter, "min_sample_age", opts.MinSampleAge, "rules", capped)
+	}
+	if expired > 0 {
+		level.Info(b.logger).Log("msg", "skipping the part of the range older than the retention of the destination", "start", notBefore, "retention", retention, "skipped", maxExpired, "rules", expired)
+	}
+
+	if err := b.checkEvalInterval(ctx, &opts, src, rules); err != nil {
+		return Result{}, err
+	}
+	if interval := minEvalInterval(rules, opts); opts.SampleIntervalTolerance >= interval {
+		return Result{}, errors.Errorf("sample interval tolerance %s has to be shorter than the eval interval %s", opts.SampleIntervalTolerance, interval)
+	}
+	if opts.AlignEvaluations {
+		for _, rule := range rules {
+			rule.tr = &timeRange{alignTime(rule.tr.start, rule.evalInterval(opts)), rule.tr.end}
+		}
+	}
+	if opts.TimestampsFile != "" && opts.TimestampReference != "" {
+		return Result{}, errors.New("a timestamps file and a timestamp reference can't be combined")
+	}
+	var keptFailures []Failure
+	if opts.RetryFromFailures != "" {
+		if opts.TimestampsFile != "" || opts.TimestampReference != "" || opts.FillGapsFrom != "" {
+			return Result{}, errors.New("retrying failures can't be combined with explicit evaluation timestamps or filling gaps")
+		}
+		failures, err := loadFailures(opts.RetryFromFailures)
+		if err != nil {
+			return Result{}, errors.Wrapf(err, "failed to load failures from %s", opts.RetryFromFailures)
+		}
+		n := len(rules)
+		rules, keptFailures = retryFailures(failures, rules, opts.EndExclusive)
+		level.Info(b.logger).Log("msg", "retrying failed evaluations", "failures", len(failures), "rules", len(rules), "skipped_rules", n-len(rules))
+		if len(keptFailures) > 0 {
+			level.Warn(b.logger).Log("msg", "keeping failures of rules not in the rule file or outside of their range", "failures", len(keptFailures))
+		}
+		if opts.FailuresFile == "" {
+			opts.FailuresFile = opts.RetryFromFailures
+		}
+		if opts.Overwrite || opts.Correct {
+			return Result{}, errors.New("retrying failures can't be combined with overwriting or correcting, it would delete the samples of the failed run")
+		}
+	}
+	if opts.TimestampsFile != "" {
+		ts, err := loadTimestamps(opts.TimestampsFile)
+		if err != nil {
+			return Result{}, errors.Wrapf(err, "failed to load timestamps from %s", opts.TimestampsFile)
+		}
+		for _, rule := range rules {
+			rule.timestamps = timestampsIn(ts, timestamp.FromTime(rule.tr.start), rule.tr.lastEval(opts.EndExclusive))
+			if skipped := len(ts) - len(rule.timestamps); skipped > 0 {
+				level.Warn(b.logger).Log("msg", "skipping timestamps outside of the rule's range", "rule", rule.name, "group", rule.group, "start", rule.tr.start, "end", rule.tr.end, "skipped", skipped, "timestamps", len(rule.timestamps))
+			}
+		}
+	}
+	if opts.TimestampReference != "" {
+		mint, maxt := int64(math.MaxInt64), int64(math.MinInt64)
+		for _, rule := range rules {
+			mint = min(mint, timestamp.FromTime(rule.tr.start))
+			maxt = max(maxt, rule.tr.lastEval(opts.EndExclusive))
+		}
+		ts, series, err := referenceTimestamps(ctx, src, opts.TimestampReference, mint, maxt)
+		if err != nil {
+			return Result{}, errors.Wrapf(err, "failed to read the timestamps of %s", opts.TimestampReference)
+		}
+		if len(ts) == 0 {
+			return Result{}, errors.Errorf("timestamp reference %s has no samples in the backfill range", opts.TimestampReference)
+		}
+		if series > 1 {
+			level.Warn(b.logger).Log("msg", "timestamp reference matches several series, evaluating at the timestamps of all of them", "selector", opts.TimestampReference, "series", series)
+		}
+		for _, rule := range rules {
+			rule.timestamps = timestampsIn(ts, timestamp.FromTime(rule.tr.start), rule.tr.lastEval(opts.EndExclusive))
+		}
+		level.Info(b.logger).Log("msg", "evaluating at the timestamps of the reference series", "selector", opts.TimestampReference, "timestamps", len(ts))
+	}
+	if opts.FillGapsFrom != "" {
+		if err := b.fillGaps(ctx, opts, src, rules); err != nil {
+			return Result{}, errors.Wrapf(err, "failed to find gaps in %s", opts.FillGapsFrom)
+		}
+	}
+
+	var covered []*recordingRule
+	if writeBlocks && opts.OnlyMissing {
+		if covered, rules, err = b.skipCovered(ctx, opts, rules); err != nil {
+			return Result{}, errors.Wrapf(err, "failed to check the recorded series in %s", opts.DestPath)
+		}
+	}
+
+	var skipped []*recordingRule
+	if opts.PreflightSkip {
+		active := rules[:0:0]
+		for _, rule := range rules {
+			ok, err := hasSourceData(ctx, src, rule)
+			if err != nil {
+				return Result{}, errors.Wrapf(err, "failed to probe source data of rule %s", rule.name)
+			}
+			if !ok {
+				level.Warn(b.logger).Log("msg", "skipping rule, no source series match its selectors", "rule", rule.name, "group", rule.group, "start", rule.tr.start, "end", rule.tr.end)
+				skipped = append(skipped, rule)
+				continue
+			}
+			active = append(active, rule)
+		}
+		rules = active
+	}
+
+	var tracker *promql.ActiveQueryTracker
+	if opts.ActiveQueryTrackerDir != "" {
+		if tracker, err = newActiveQueryTracker(opts.ActiveQueryTrackerDir, b.logger); err != nil {
+			return Result{}, errors.Wrap(err, "failed to create active query tracker")
+		}
+	}
+	var (
+		queryable storage.Queryable = src
+		cache     *sourceCache
+	)
+	if opts.SourceCacheSize > 0 {
+		cache = newSourceCache(int64(opts.SourceCacheSize), b.metrics)
+		queryable = &cachedQueryable{src: src, cache: cache}
+	}
+	engines := newQueryEngines(queryable, opts.MaxSamples, opts.Timeout, b.logger, b.reg, tracker)
+	if opts.QueryLogFile != "" {
+		l, err := logging.NewJSONFileLogger(opts.QueryLogFile)
+		if err != nil {
+			if opts.QueryLogRequired {
+				return Result{}, errors.Wrap(err, "failed to create query logger")
+			}
+			level.Warn(b.logger).Log("msg", "failed to create query logger, query logging is disabled", "err", err)
+		} else {
+			defer l.Close()
+			engines.setQueryLogger(l)
+		}
+	}
+
+	collisions, err := checkRecordCollisions(ctx, src, rules, engines)
+	if err != nil {
+		return Result{}, errors.Wrap(err, "failed to check record names")
+	}
+	for _, c := range collisions {
+		if opts.Strict {
+			return Result{}, errors.Wrap(c, "refusing to start")
+		}
+		level.Warn(b.logger).Log("msg", "record name collides with a metric in the source", "err", c)
+	}
+
+	if opts.Bench > 0 {
+		bench, err := b.bench(ctx, rules, opts, engines)
+		return Result{Bench: bench}, err
+	}
+	if opts.Estimate > 0 {
+		estimate, err := b.estimate(ctx, rules, opts, engines)
+		return Result{Estimate: estimate}, err
+	}
+
+	var cmp *comparer
+	if opts.CompareAgainst != "" {
+		ref, err := openReference(opts.CompareAgainst, b.logger)
+		if err != nil {
+			return Result{}, errors.Wrapf(err, "failed to open reference %s", opts.CompareAgainst)
+		}
+		defer ref.Close()
+		cmp = newComparer(ref, minEvalInterval(rules, opts)/2, opts.CompareTolerance)
+	}
+
+	if writeBlocks {
+		samples := b.estimateSamples(ctx, rules, opts, engines)
+		if err := checkDiskUsage(opts.DestPath, samples, opts.MaxDiskUsage, opts.MaxDiskUsagePercent); err != nil {
+			if !opts.Force {
+				return Result{}, errors.Wrap(err, "refusing to start, use --force to override")
+			}
+			level.Warn(b.logger).Log("msg", "ignoring disk usage check", "err", err)
+		}
+	}
+
+	mint, maxt := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, rule := range rules {
+		steps := rule.evalSteps(opts)
+		// The samples of a rule with a query offset are recorded before
+		// its steps with TimestampModeSample, those before its start are
+		// dropped.
+		var offset int64
+		if opts.TimestampMode == TimestampModeSample {
+			offset = rule.queryOffset.Milliseconds()
+		}
+		mint = min(mint, steps.first)
+		maxt = max(maxt, steps.last-offset)
+	}
+
+	// The checks of the destination are about the range of the shifted samples.
+	if opts.TimestampShift != 0 && len(rules) > 0 {
+		mint, maxt = mint+opts.TimestampShift.Milliseconds(), maxt+opts.TimestampShift.Milliseconds()
+		level.Info(b.logger).Log("msg", "shifting the timestamps of the samples", "shift", opts.TimestampShift, "start", timestamp.Time(mint), "end", timestamp.Time(maxt))
+		// The head of a TSDB loading a block rejects samples older than its
+		// end, so a server would drop its scraped samples until then.
+		if now := timestamp.FromTime(time.Now()); writeBlocks && maxt > now && !opts.Force {
+			return Result{}, errors.Errorf("the shifted samples reach %s, which is in the future, and a Prometheus server loading their blocks would reject newer samples until then, use --force to override", timestamp.Time(maxt))
+		}
+	}
+
+	// Samples in the head's range are appended to it with AppendToHead.
+	if writeBlocks && opts.DestIsPrometheusDataDir && !opts.AppendToHead && len(rules) > 0 {
+		headMint, err := headMinTime(opts.DestPath)
+		if err != nil {
+			return Result{}, errors.Wrapf(err, "get head range of %s", opts.DestPath)
+		}
+		if maxt >= headMint {
+			return Result{}, errors.Errorf("backfill range ends at %s, which overlaps the head block of the destination starting at %s", timestamp.Time(maxt), timestamp.Time(headMint))
+		}
+	}
+
+	if writeBlocks && opts.Overwrite {
+		names := map[string]struct{}{}
+		for _, rule := range rules {
+			names[rule.name] = struct{}{}
+		}
+		if _, err := moveOverlappingBlocks(opts.DestPath, mint, maxt, names, b.logger); err != nil {
+			return Result{}, errors.Wrap(err, "failed to move overlapping blocks aside")
+		}
+	}
+
+	// corrected are the blocks of previous backfills tombstoned with opts.Correct.
+	var corrected []string
+	if writeBlocks {
+		overlapping, err := overlappingBlocks(opts.DestPath, mint, maxt, false)
+		if err == nil && perTenant {
+			overlapping, err = tenantOverlappingBlocks(opts.DestPath, mint, maxt)
+		}
+		if err != nil {
+			return Result{}, errors.Wrapf(err, "check blocks of %s", opts.DestPath)
+		}
+		// Overlapping the blocks of a Prometheus server is the point of writing
+		// into its data directory, overlapping a previous backfill only is
+		// when retrying its failures.
+		refused := overlapping
+		if opts.Correct {
+			// The blocks of previous backfills are corrected, only the others are refused.
+			if corrected, err = overlappingBlocks(opts.DestPath, mint, maxt, true); err != nil {
+				return Result{}, errors.Wrapf(err, "check blocks of %s", opts.DestPath)
+			}
+			refused = withoutBlocks(overlapping, corrected)
+		} else if opts.RetryFromFailures != "" {
+			refused = nil
+		} else if opts.DestIsPrometheusDataDir && len(overlapping) > 0 {
+			if refused, err = overlappingBlocks(opts.DestPath, mint, maxt, true); err != nil {
+				return Result{}, errors.Wrapf(err, "check blocks of %s", opts.DestPath)
+			}
+		}
+		switch {
+		case len(refused) > 0 && !opts.AllowOverlappingOutput:
+			return Result{}, errors.Errorf("blocks %s in %s overlap the backfill range [%s, %s], use --overwrite to replace the blocks of a previous run or --allow-overlapping-output to write anyway", strings.Join(refused, ","), opts.DestPath, timestamp.Time(mint), timestamp.Time(maxt))
+		case len(overlapping) > 0 && opts.FailOnOverlap:
+			return Result{}, errors.Errorf("blocks %s in %s overlap the backfill range [%s, %s]", strings.Join(overlapping, ","), opts.DestPath, timestamp.Time(mint), timestamp.Time(maxt))
+		case len(overlapping) > 0:
+			level.Warn(b.logger).Log("msg", "blocks in the destination overlap the backfill range, queries over it are slower until they are compacted", "blocks", strings.Join(overlapping, ","))
+		}
+	}
+
+	bctx := ctx
+	if opts.RunTimeout > 0 {
+		var cancel context.CancelFunc
+		bctx, cancel = context.WithTimeout(ctx, opts.RunTimeout)
+		defer cancel()
+	}
+	var head *headWriter
+	if writeBlocks && opts.AppendToHead {
+		head, err = openHeadWriter(opts.DestPath, opts.AppendBatchSize, b.logger)
+		if err != nil {
+			return Result{}, errors.Wrapf(err, "failed to open %s for appending", opts.DestPath)
+		}
+	}
+	var failures *failureWriter
+	if opts.FailuresFile != "" {
+		if failures, err = createFailureWriter(opts.FailuresFile); err != nil {
+			return Result{}, errors.Wrap(err, "failed to create failures file")
+		}
+		for _, f := range keptFailures {
+			if err := failures.write(f); err != nil {
+				failures.Close()
+				return Result{}, err
+			}
+		}
+	}
+	res, err := b.backfillRules(bctx, rules, opts, engines, head, cmp, failures, relabelCfgs, filter)
+	if cache != nil {
+		res.SourceCacheHits, res.SourceCacheMisses = cache.stats()
+		if lookups := res.SourceCacheHits + res.SourceCacheMisses; lookups > 0 {
+			level.Info(b.logger).Log("msg", "source cache summary", "hits", res.SourceCacheHits, "misses", res.SourceCacheMisses, "hit_ratio", fmt.Sprintf("%.3f", float64(res.SourceCacheHits)/float64(lookups)))
+		}
+	}
+	if head != nil {
+		if cerr := head.Close(); cerr != nil && err == nil {
+			err = errors.Wrapf(cerr, "failed to close %s", opts.DestPath)
+		}
+	}
+	if failures != nil {
+		if cerr := failures.Close(); cerr != nil && err == nil {
+			err = errors.Wrap(cerr, "failed to write failures file")
+		}
+		if failures.n > 0 {
+			level.Warn(b.logger).Log("msg", "wrote failed evaluations", "file", opts.FailuresFile, "failures", failures.n)
+		}
+	}
+	for _, rule := range skipped {
+		res.Rules = append(res.Rules, RuleResult{Group: rule.group, Name: rule.name, Start: rule.tr.start, End: rule.tr.end, Expired: rule.expired, Skipped: true})
+	}
+	for _, rule := range covered {
+		res.Rules = append(res.Rules, RuleResult{Group: rule.group, Name: rule.name, Start: rule.tr.start, End: rule.tr.end, Expired: rule.expired, Covered: true})
+	}
+	res, err = b.finish(ctx, opts, res, err)
+	if len(corrected) > 0 {
+		// Incomplete runs leave the previous samples in place.
+		if err != nil {
+			level.Warn(b.logger).Log("msg", "not correcting the blocks of previous backfills as the run didn't complete, their samples overlap the new ones", "blocks", strings.Join(corrected, ","))
+		} else if err = tombstoneBlocks(opts.DestPath, corrected, rules, opts.EndExclusive, opts.TimestampShift.Milliseconds(), b.logger); err != nil {
+			err = errors.Wrap(err, "failed to correct the blocks of previous backfills")
+		}
+	}
+	if err == nil && cmp != nil {
+		err = checkMismatchRate(res.Comparison, opts.MaxMismatchRate)
+	}
+	if writeBlocks && opts.CreatedBlocksFile != "" {
+		// Keep the error of the run, it's the more important one.
+		if werr := writeCreatedBlocks(opts.CreatedBlocksFile, opts.DestPath, res.Blocks, res.BlockStats); werr != nil && err != nil {
+			level.Error(b.logger).Log("msg", "failed to write created blocks file", "err", werr)
+		} else if werr != nil {
+			err = errors.Wrap(werr, "failed to write created blocks file")
+		}
+	}
+	return res, err
+}
+
+// finish compacts the blocks of a completed evaluation and reports the rules
+// that didn't produce samples. err is the error of the evaluation.
+func (b *Backfiller) finish(ctx context.Context, opts Options, res Result, err error) (Result, error) {
+	if errors.Cause(err) == context.DeadlineExceeded && ctx.Err() == nil {
+		return res, ErrRunTimeout
+	}
+	if err != nil {
+		return res, err
+	}
+
+	if opts.Compact && len(res.Blocks) > 1 {
+		blocks, err := compactBlocks(ctx, opts.DestPath, res.Blocks, opts.CompactBlockDuration, opts.RuleFile, b.logger, b.reg)
+		res.Blocks = blocks
+		res.BlockSeries = nil
+		res.BlockStats = nil
+		if err != nil {
+			return res, errors.Wrap(err, "failed to compact blocks")
+		}
+		level.Info(b.logger).Log("msg", "compaction finished", "blocks", strings.Join(res.Blocks, ","))
+	}
+	if opts.DestIsPrometheusDataDir && len(res.Blocks) > 0 {
+		level.Info(b.logger).Log("msg", "a running Prometheus server loads the new blocks with its next block reload, usually within a minute, a stopped one when it starts")
+	}
+
+	var empty, panicked, quarantined []string
+	for _, rr := range res.Rules {
+		if rr.Panic != "" {
+			panicked = append(panicked, rr.Group+"/"+rr.Name)
+			continue
+		}
+		if !rr.QuarantinedAt.IsZero() {
+			quarantined = append(quarantined, rr.Group+"/"+rr.Name)
+			continue
+		}
+		// Rules without gaps to fill or covered by the destination aren't
+		// expected to produce samples.
+		if rr.Samples == 0 && !rr.Covered && (opts.FillGapsFrom == "" || len(rr.Gaps) > 0) {
+			empty = append(empty, rr.Group+"/"+rr.Name)
+		}
+	}
+	if len(panicked) > 0 {
+		level.Error(b.logger).Log("msg", "evaluation of rules panicked, their samples after the panic are missing", "rules", strings.Join(panicked, ","))
+		return res, errors.Wrap(ErrRulePanic, strings.Join(panicked, ","))
+	}
+	if len(quarantined) > 0 {
+		level.Error(b.logger).Log("msg", "rules were abandoned after consecutive failed steps, their samples after that are missing", "rules", strings.Join(quarantined, ","))
+		return res, errors.Wrap(ErrRulesQuarantined, strings.Join(quarantined, ","))
+	}
+	if len(empty) > 0 {
+		level.Warn(b.logger).Log("msg", "rules produced no samples in their range, check the metric names and the range of the source data", "rules", strings.Join(empty, ","))
+		if opts.FailOnEmptyRule {
+			return res, errors.Wrap(ErrEmptyRules, strings.Join(empty, ","))
+		}
+	}
+	return res, nil
+}
+
+// checkEvalInterval compares the eval interval with the scrape interval of the
+// source data and warns if they are far apart. With AutoEvalInterval, the
+// eval interval is set to the detected interval instead.
+func (b *Backfiller) checkEvalInterval(ctx context.Context, opts *Options, src source, rules []*recordingRule) error {
+	maxt := int64(math.MinInt64)
+	for _, rule := range rules {
+		maxt = max(maxt, timestamp.FromTime(rule.tr.end))
+	}
+	detected, err := detectScrapeInterval(ctx, src, rules, maxt)
+	if err != nil {
+		if opts.AutoEvalInterval {
+			return errors.Wrap(err, "failed to detect the scrape interval")
+		}
+		level.Debug(b.logger).Log("msg", "failed to detect the scrape interval", "err", err)
+		return nil
+	}
+
+	if opts.AutoEvalInterval {
+		if detected == 0 {
+			return errors.New("not enough source data to detect the scrape interval, set the eval interval explicitly")
+		}
+		opts.EvalInterval = roundInterval(detected)
+		level.Info(b.logger).Log("msg", "using the detected scrape interval as eval interval", "detected", detected, "eval_interval", opts.EvalInterval)
+		return nil
+	}
+	if detected > 0 && (opts.EvalInterval*2 < detected || opts.EvalInterval > detected*2) {
+		level.Warn(b.logger).Log("msg", "eval interval is far from the scrape interval of the source data, consider --eval-interval=auto", "eval_interval", opts.EvalInterval, "detected", detected)
+	}
+	return nil
+}
+
+func newQueryEngine(maxSamples int, timeout time.Duration, logger log.Logger, reg prometheus.Registerer, tracker *promql.ActiveQueryTracker) *promql.Engine {
+	return promql.NewEngine(promql.EngineOpts{
+		Logger:             logger,
+		Reg:                reg,
+		MaxSamples:         maxSamples,
+		Timeout:            timeout,
+		ActiveQueryTracker: tracker,
+	})
+}
+
+// estimateSamples projects the number of samples the backfill will produce
+// from the size of each rule's result at the end of its range.
+func (b *Backfiller) estimateSamples(ctx context.Context, rules []*recordingRule, opts Options, engines *queryEngines) int64 {
+	var samples int64
+	for _, rule := range rules {
+		vector, err := engines.queryFunc(rule)(ctx, rule.vector.String(), rule.tr.end)
+		if err != nil {
+			level.Debug(b.logger).Log("msg", "failed to estimate samples", "rule", rule.name, "err", err)
+			continue
+		}
+		samples += int64(len(vector)) * rule.evalSteps(opts).count()
+	}
+	level.Info(b.logger).Log("msg", "estimated samples to backfill", "samples", samples, "bytes", samples*estimatedBytesPerSample)
+	return samples
+}
+
+const (
+	// sampleOverhead is the estimated memory of a buffered sample besides its
+	// labels: the sample itself, the pointer to it and its entry in the map
+	// dropping duplicates.
+	sampleOverhead = 96
+	// labelOverhead is the memory of the string headers of a label.
+	labelOverhead = 32
+)
+
+// sampleSize estimates the memory of a buffered sample with the given labels.
+func sampleSize(lset labels.Labels) int64 {
+	size := int64(sampleOverhead)
+	for _, l := range lset {
+		size += labelOverhead + int64(len(l.Name)+len(l.Value))
+	}
+	return size
+}
+
+// exceedsBudget reports whether a query failed with a timeout or by exceeding
+// the max samples limit. timedOut is set if it was canceled at the max query
+// duration.
+func exceedsBudget(err error, timedOut bool) bool {
+	switch errors.Cause(err).(type) {
+	case promql.ErrQueryTimeout, promql.ErrTooManySamples:
+		return true
+	}
+	return timedOut
+}
+
+// maxRoundDecimals is the most decimal places values can be rounded to, more
+// than float64 values have for most magnitudes.
+const maxRoundDecimals = 15
+
+// roundValue rounds v to the given number of decimal places. Values too large
+// to have that many decimals, NaN and ±Inf are returned unchanged, so the
+// rounding never turns a finite value into ±Inf.
+func roundValue(v float64, decimals int) float64 {
+	p := math.Pow10(decimals)
+	r := math.Round(v*p) / p
+	if math.IsNaN(r) || math.IsInf(r, 0) {
+		return v
+	}
+	return r
+}
+
+// highCardinalityBlock is the number of series in a block above which a
+// warning is logged, unless a limit is set explicitly.
+const highCardinalityBlock = 1000000
+
+// rulePanic is a recovered panic and the stack it happened at.
+type rulePanic struct {
+	value interface{}
+	stack string
+}
+
+// recoverPanic calls f and returns its error, or the panic it recovered from.
+func recoverPanic(f func() error) (p *rulePanic, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			p = &rulePanic{value: v, stack: string(debug.Stack())}
+		}
+	}()
+	return nil, f()
+}
+
+// sampleKey identifies a sample of a series.
+type sampleKey struct {
+	hash uint64
+	t    int64
+}
+
+// queryOrigin returns the origin of a rule's query for the query log, the same
+// way the rules manager attaches it, plus the given key/value pairs.
+func queryOrigin(ruleFile string, rule *recordingRule, kvs ...interface{}) map[string]interface{} {
+	origin := map[string]interface{}{
+		"ruleGroup": map[string]string{
+			"file": ruleFile,
+			"name": rule.group,
+		},
+		"rule": rule.name,
+	}
+	for i := 0; i+1 < len(kvs); i += 2 {
+		origin[kvs[i].(string)] = kvs[i+1]
+	}
+	return origin
+}
+
+// backfillRules evaluates the rules over their ranges and writes the results.
+// With opts.RangeQueries, rules are evaluated with one range query per batch
+// of steps instead of one instant query per step where possible.
+// Samples are appended to head instead where it accepts them, if set, or
+// compared with the reference of cmp instead of being written, if set.
+// Samples not matching all matchers of filter are dropped. The steps whose
+// query fails are written to failures, if set.
+func (b *Backfiller) backfillRules(ctx context.Context, rules []*recordingRule, opts Options, engines *queryEngines, head *headWriter, cmp *comparer, failures *failureWriter, relabelCfgs []*relabel.Config, filter []*labels.Matcher) (res Result, err error) {
+	var (
+		mss []*tsdb.MetricSample
+		// mssBytes is the estimated memory of the buffered samples.
+		mssBytes int64
+		minTime  int64 = math.MaxInt64
+		maxTime  int64 = math.MinInt64
+		// ruleStart is the index of the first buffered sample of the rules
+		// currently evaluated.
+		ruleStart int
+	)
+	logger := b.logger
+	stopProfiles, err := startProfiles(opts.CPUProfile, opts.MemProfile)
+	if err != nil {
+		return res, err
+	}
+	// The profiles are diagnostics, failing to write them doesn't fail the backfill.
+	defer func() {
+		if err := stopProfiles(); err != nil {
+			level.Warn(logger).Log("msg", "failed to write profile", "err", err)
+		}
+	}()
+	// Exceeding the disk usage limit stops the evaluation like a timeout, and
+	// the buffered samples are still written.
+	var guard *diskGuard
+	stop := func() {}
+	if opts.MaxDiskUsage > 0 || opts.MaxDiskUsagePercent > 0 {
+		guard = &diskGuard{dir: opts.DestPath, maxBytes: opts.MaxDiskUsage, maxPercent: opts.MaxDiskUsagePercent}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		stop = cancel
+	}
+	batchSize := int64(opts.StepBatchSize)
+	if batchSize <= 0 {
+		batchSize = DefaultStepBatchSize
+	}
+
+	var csvw *csvWriter
+	if opts.OutputFormat == OutputFormatCSV && cmp == nil {
+		var out io.Writer = os.Stdout
+		if opts.OutputFile != "" {
+			f, err := os.Create(opts.OutputFile)
+			if err != nil {
+				return res, errors.Wrap(err, "create output file")
+			}
+			defer f.Close()
+			out = f
+		}
+		var err error
+		if csvw, err = newCSVWriter(out, opts.CSVColumns, opts.CSVDropOtherLabels); err != nil {
+			return res, errors.Wrap(err, "write CSV header")
+		}
+	}
+
+	var rc *receiveClient
+	if opts.Receive.URL != "" && cmp == nil {
+		var err error
+		if rc, err = newReceiveClient(opts.Receive, logger); err != nil {
+			return res, err
+		}
+	}
+
+	// seen holds the values of the samples in the current block to drop duplicates.
+	seen := map[sampleKey]float64{}
+	// series holds the series in the current block.
+	series := map[uint64]struct{}{}
+	// owners maps the series produced so far to the index of the rule producing them,
+	// to detect rules that produce the same series.
+	owners := map[uint64]int{}
+	// dupSeries holds the series already reported as produced by several rules.
+	dupSeries := map[uint64]struct{}{}
+	// lastSample holds the timestamp of the last sample of every series with
+	// opts.SampleIntervalTolerance.
+	lastSample := map[uint64]int64{}
+	tolerance := opts.SampleIntervalTolerance.Milliseconds()
+	shift := opts.TimestampShift.Milliseconds()
+
+	// The written blocks are only added to the result once their writes are
+	// waited for, which happens before returning in any case.
+	writer := newBlockWriter(opts.MaxConcurrentBlocks)
+	// The series manifest is written once the blocks being written are
+	// waited for below.
+	var manifest *seriesManifest
+	if opts.SeriesManifest != "" {
+		manifest = newSeriesManifest()
+		defer func() {
+			// Keep the error of the run, it's the more important one.
+			if werr := manifest.write(opts.SeriesManifest, opts.SeriesManifestFormat); werr != nil && err != nil {
+				level.Error(logger).Log("msg", "failed to write series manifest", "err", werr)
+			} else if werr != nil {
+				err = errors.Wrap(werr, "failed to write series manifest")
+			}
+		}()
+	}
+
+	// blockSamples are the samples of the written blocks.
+	var blockSamples []int
+	collect := func() error {
+		blocks, err := writer.wait()
+		for _, bs := range blocks {
+			res.Blocks = append(res.Blocks, bs.ULID)
+			res.BlockSeries = append(res.BlockSeries, bs.Series)
+			res.BlockStats = append(res.BlockStats, bs)
+			blockSamples = append(blockSamples, bs.Samples)
+			res.Samples += bs.Samples
+			res.ChunkBytes += bs.ChunkBytes
+			res.IndexBytes += bs.IndexBytes
+			res.BlockDuration += bs.Duration
+		}
+		return err
+	}
+	defer func() {
+		if werr := collect(); werr != nil && err == nil {
+			err = werr
+		}
+	}()
+
+	flush := func() error {
+		if csvw != nil {
+			if err := csvw.write(mss); err != nil {
+				return errors.Wrap(err, "failed to write CSV rows")
+			}
+			res.Samples += len(mss)
+			if manifest != nil {
+				for _, s := range mss {
+					manifest.add(s.Labels, s.TimestampMs)
+				}
+			}
+		} else if rc != nil {
+			err := rc.send(ctx, mss)
+			res.ReceiveConflicts = rc.conflicts
+			if err != nil {
+				return errors.Wrap(err, "failed to send samples to receive")
+			}
+			res.Samples += len(mss)
+			level.Info(logger).Log("msg", "sent samples to receive", "min_time", timestamp.Time(minTime), "max_time", timestamp.Time(maxTime), "samples", len(mss), "series", len(series))
+			if manifest != nil {
+				for _, s := range mss {
+					manifest.add(s.Labels, s.TimestampMs)
+				}
+			}
+		} else {
+			blocks := []*pendingBlock{{mss: mss, minTime: minTime, maxTime: maxTime, series: len(series), bytes: mssBytes}}
+			if opts.TenantLabel != "" {
+				blocks = splitTenants(mss, func(lset labels.Labels) string {
+					if t := lset.Get(opts.TenantLabel); t != "" {
+						return t
+					}
+					return opts.DefaultTenant
+				})
+			} else if opts.TenantFromRules {
+				blocks = splitTenants(mss, func(lset labels.Labels) string { return rules[owners[lset.Hash()]].tenant })
+			}
+			for _, pb := range blocks {
+				if opts.MaxSeriesPerBlock > 0 && pb.series > opts.MaxSeriesPerBlock {
+					return errors.Errorf("block would have %d series, more than the limit of %d", pb.series, opts.MaxSeriesPerBlock)
+				}
+				if opts.MaxSeriesPerBlock == 0 && pb.series > highCardinalityBlock {
+					level.Warn(logger).Log("msg", "creating a block with a high number of series, which is slow to query and compact", "series", pb.series)
+				}
+				// The buffer is handed over to the writer, which may write it in the background.
+				pb := pb
+				if err := writer.write(func() (BlockStats, error) {
+					if err := checkFreeSpace(opts.DestPath, len(pb.mss)); err != nil {
+						return BlockStats{}, err
+					}
+					began := time.Now()
+					// The head backing the block rejects samples too far behind the newest
+					// one appended, so the samples of several rules have to be in order.
+					sort.SliceStable(pb.mss, func(i, j int) bool { return pb.mss[i].TimestampMs < pb.mss[j].TimestampMs })
+					dir := filepath.Join(opts.DestPath, pb.tenant)
+					// Block ranges are half-open, so maxt has to be after the newest sample.
+					blockDir, err := tsdb.CreateBlock(pb.mss, filepath.Join(dir, stagingDir), pb.minTime, pb.maxTime+1, logger)
+					if err != nil {
+						return BlockStats{}, errors.Wrap(err, "failed to create block")
+					}
+					if opts.Deterministic {
+						renamed, err := renameBlock(blockDir, pb.mss)
+						if err != nil {
+							return BlockStats{}, errors.Wrapf(err, "failed to derive the ULID of block %s", blockDir)
+						}
+						blockDir = renamed
+					}
+					if err := markBlock(blockDir, opts.RuleFile); err != nil {
+						return BlockStats{}, errors.Wrapf(err, "failed to mark block %s", blockDir)
+					}
+					blockID := filepath.Base(blockDir)
+					if err := publishBlock(dir, blockID); err != nil {
+						return BlockStats{}, errors.Wrapf(err, "failed to move block %s into place", blockDir)
+					}
+					// Blocks of tenants are identified by their path in the destination.
+					bs := BlockStats{
+						ULID:     filepath.Join(pb.tenant, blockID),
+						MinTime:  timestamp.Time(pb.minTime),
+						MaxTime:  timestamp.Time(pb.maxTime),
+						Samples:  len(pb.mss),
+						Series:   pb.series,
+						Duration: time.Since(began),
+					}
+					if bs.ChunkBytes, bs.IndexBytes, err = blockFileSizes(filepath.Join(dir, blockID)); err != nil {
+						level.Warn(logger).Log("msg", "failed to get the size of block", "block", filepath.Join(dir, blockID), "err", err)
+					}
+					b.metrics.blockDuration.Observe(bs.Duration.Seconds())
+					b.metrics.lastBlockBytes.Set(float64(bs.ChunkBytes + bs.IndexBytes))
+					if manifest != nil {
+						for _, s := range pb.mss {
+							manifest.add(s.Labels, s.TimestampMs)
+						}
+					}
+					level.Info(logger).Log("msg", "create block successfully", "block", filepath.Join(dir, blockID), "ulid", blockID, "min_time", bs.MinTime, "max_time", bs.MaxTime, "samples", bs.Samples, "series", bs.Series, "estimated_bytes", pb.bytes, "chunk_bytes", bs.ChunkBytes, "index_bytes", bs.IndexBytes, "duration", bs.Duration)
+					if guard != nil {
+						if exceeded, err := guard.add(filepath.Join(dir, blockID)); err != nil {
+							level.Warn(logger).Log("msg", "failed to check disk usage", "err", err)
+						} else if exceeded {
+							stop()
+						}
+					}
+					return bs, nil
+				}); err != nil {
+					return err
+				}
+			}
+		}
+
+		minTime = math.MaxInt64
+		maxTime = math.MinInt64
+		mss = make([]*tsdb.MetricSample, 0, len(mss))
+		mssBytes = 0
+		ruleStart = 0
+		seen = map[sampleKey]float64{}
+		series = map[uint64]struct{}{}
+		b.metrics.bufferedSamples.Set(0)
+		b.metrics.bufferedBytes.Set(0)
+		return nil
+	}
+
+	// dropSamples drops the buffered samples from index from on that belong to
+	// one of the given series and returns their number.
+	dropSamples := func(from int, drop map[uint64]struct{}) int {
+		n := len(mss)
+		kept := mss[:from]
+		for _, s := range mss[from:] {
+			if _, ok := drop[s.Labels.Hash()]; !ok {
+				kept = append(kept, s)
+			}
+		}
+		mss = kept
+
+		minTime = math.MaxInt64
+		maxTime = math.MinInt64
+		mssBytes = 0
+		seen = make(map[sampleKey]float64, len(mss))
+		series = map[uint64]struct{}{}
+		for _, s := range mss {
+			h := s.Labels.Hash()
+			seen[sampleKey{h, s.TimestampMs}] = s.Value
+			series[h] = struct{}{}
+			minTime = min(minTime, s.TimestampMs)
+			maxTime = max(maxTime, s.TimestampMs)
+			mssBytes += sampleSize(s.Labels)
+		}
+		b.metrics.bufferedSamples.Set(float64(len(mss)))
+		b.metrics.bufferedBytes.Set(float64(mssBytes))
+		return n - len(mss)
+	}
+
+	// appendVector buffers the result of the rule's evaluation at t.
+	appendVector := func(ev *ruleEval, t int64, vector promql.Vector) error {
+		rule, rr := ev.rule, ev.rr
+		if rule.limit > 0 && len(vector) > rule.limit {
+			level.Warn(logger).Log("msg", "truncating result to the rule limit", "rule", rule.name, "t", timestamp.Time(t), "series", len(vector), "limit", rule.limit)
+			vector = vector[:rule.limit]
+		}
+		for _, sample := range vector {
+			if opts.SkipInvalidValues && (math.IsNaN(sample.V) || math.IsInf(sample.V, 0)) {
+				rr.InvalidValues++
+				continue
+			}
+			if opts.RoundValues {
+				sample.V = roundValue(sample.V, opts.RoundToDecimals)
+			}
+
+			lb := labels.NewBuilder(sample.Metric)
+			lb.Set(labels.MetricName, rule.name)
+
+			for _, l := range rule.lset {
+				lb.Set(l.Name, l.Value)
+			}
+			if len(rule.tmplLabels) > 0 {
+				tmplLabels, err := expandLabels(ctx, rule, sample, ev.queryFunc)
+				if err != nil {
+					level.Warn(logger).Log("msg", "failed to expand label template", "rule", rule.name, "err", err)
+					continue
+				}
+				for _, l := range tmplLabels {
+					lb.Set(l.Name, l.Value)
+				}
+			}
+			// The sample is recorded at the step, not at the query time of
+			// a rule with a query offset, plus the timestamp shift.
+			if opts.TimestampMode != TimestampModeSample {
+				sample.T = t
+			}
+			// Samples before the start or after the last evaluation of the
+			// rule, like those of the first steps of a rule with a query
+			// offset with TimestampModeSample, would extend its blocks
+			// beyond the requested range. The range is before the shift.
+			if first, last := timestamp.FromTime(rule.tr.start), rule.tr.lastEval(opts.EndExclusive); sample.T < first || sample.T > last {
+				if opts.StrictRange {
+					return errors.Errorf("rule %s in group %s produces a sample of series %s at %s, outside of its range %s to %s", rule.name, rule.group, sample.Metric, timestamp.Time(sample.T), timestamp.Time(first), timestamp.Time(last))
+				}
+				if rr.OutOfRange == 0 {
+					level.Debug(logger).Log("msg", "dropping sample outside of the range of the rule", "rule", rule.name, "group", rule.group, "series", sample.Metric, "t", timestamp.Time(sample.T), "step", timestamp.Time(t))
+				}
+				rr.OutOfRange++
+				continue
+			}
+			sample.T += shift
+			lset := lb.Labels()
+			if len(relabelCfgs) > 0 {
+				relabeled := relabel.Process(lset, relabelCfgs...)
+				if relabeled == nil {
+					rr.RelabelDropped++
+					continue
+				}
+				if relabeled.Get(labels.MetricName) == "" {
+					return errors.Errorf("relabeling removes the metric name of series %s of rule %s", lset, rule.name)
+				}
+				if !labels.Equal(relabeled, lset) {
+					rr.Relabeled++
+					lset = relabeled
+				}
+			}
+			if !matchLabels(filter, lset) {
+				rr.Filtered++
+				continue
+			}
+			if opts.TenantLabel != "" {
+				if tenant := lset.Get(opts.TenantLabel); tenant == "" && opts.DefaultTenant == "" {
+					return errors.Errorf("series %s of rule %s has no tenant label %s", lset, rule.name, opts.TenantLabel)
+				} else if tenant != "" {
+					if err := checkTenant(tenant); err != nil {
+						return errors.Wrapf(err, "series %s of rule %s", lset, rule.name)
+					}
+				}
+			}
+			h := lset.Hash()
+
+			if _, ok := ev.series[h]; opts.MaxSeriesPerRule > 0 && !ok {
+				if len(ev.series) == opts.MaxSeriesPerRule {
+					rr.SeriesLimited = true
+					level.Warn(logger).Log("msg", "stopped evaluating rule producing more series than the limit", "rule", rule.name, "group", rule.group, "limit", opts.MaxSeriesPerRule, "examples", strings.Join(ev.examples, ","))
+					if opts.OnSeriesLimit != SeriesLimitKeep {
+						dropped := dropSamples(ruleStart, ev.series)
+						rr.Samples -= dropped
+						level.Warn(logger).Log("msg", "dropped buffered samples of rule over the series limit", "rule", rule.name, "group", rule.group, "samples", dropped)
+					}
+					return nil
+				}
+				ev.series[h] = struct{}{}
+				if len(ev.examples) < seriesLimitExamples {
+					ev.examples = append(ev.examples, lset.String())
+				}
+			}
+
+			if owner, ok := owners[h]; !ok {
+				owners[h] = ev.idx
+			} else if owner != ev.idx {
+				other := rules[owner]
+				// The samples of a series are written into the directory of the tenant of its first rule.
+				if opts.TenantFromRules && other.tenant != rule.tenant {
+					return errors.Errorf("rule %s in group %s of tenant %s produces series %s, which is already produced by rule %s in group %s of tenant %s", rule.name, rule.group, rule.tenant, lset, other.name, other.group, other.tenant)
+				}
+				if !opts.AllowDuplicateSeries {
+					return errors.Errorf("rule %s in group %s produces series %s, which is already produced by rule %s in group %s", rule.name, rule.group, lset, other.name, other.group)
+				}
+				if _, ok := dupSeries[h]; !ok {
+					dupSeries[h] = struct{}{}
+					level.Warn(logger).Log("msg", "series produced by several rules", "series", lset, "rule", rule.name, "group", rule.group, "other_rule", other.name, "other_group", other.group)
+				}
+			}
+
+			key := sampleKey{h, sample.T}
+			if v, ok := seen[key]; ok {
+				if math.Float64bits(v) == math.Float64bits(sample.V) {
+					res.Duplicates++
+					continue
+				}
+				if opts.FailOnConflictingDuplicates {
+					return errors.Errorf("conflicting values %v and %v for series %s at %s", v, sample.V, lset, timestamp.Time(sample.T))
+				}
+				res.ConflictingDuplicates++
+				level.Debug(logger).Log("msg", "dropping conflicting duplicate sample", "series", lset, "t", sample.T, "value", sample.V, "kept", v)
+				continue
+			}
+			if opts.SampleIntervalTolerance > 0 {
+				last, ok := lastSample[h]
+				if d := sample.T - last; ok && d != 0 && d >= -tolerance && d <= tolerance {
+					res.NearDuplicates++
+					level.Debug(logger).Log("msg", "dropping sample close to the previous one of its series", "series", lset, "t", sample.T, "previous", last)
+					continue
+				}
+				lastSample[h] = sample.T
+			}
+			seen[key] = sample.V
+
+			if cmp != nil {
+				cmp.add(ev.idx, lset, sample.T, sample.V)
+				rr.Samples++
+				res.Samples++
+				continue
+			}
+			if head != nil {
+				ok, err := head.add(lset, sample.T, sample.V)
+				if err != nil {
+					return errors.Wrapf(err, "append to head at rule %s, timestamp %s", rule.name, timestamp.Time(t))
+				}
+				if ok {
+					if manifest != nil {
+						manifest.add(lset, sample.T)
+					}
+					rr.Samples++
+					res.Samples++
+					res.HeadSamples++
+					continue
+				}
+				if !ev.headFallback {
+					ev.headFallback = true
+					level.Warn(logger).Log("msg", "samples outside of the head's window are written into blocks", "rule", rule.name, "group", rule.group, "t", timestamp.Time(sample.T))
+				}
+			}
+
+			series[h] = struct{}{}
+
+			mss = append(mss, &tsdb.MetricSample{Labels: lset, Value: sample.V, TimestampMs: sample.T})
+			rr.Samples++
+
+			// update the samples time range
+			minTime = min(minTime, sample.T)
+			maxTime = max(maxTime, sample.T)
+
+			mssBytes += sampleSize(lset)
+			b.metrics.bufferedSamples.Set(float64(len(mss)))
+			b.metrics.bufferedBytes.Set(float64(mssBytes))
+
+			if len(mss) == opts.MaxSamplesInMem || (opts.MaxMemory > 0 && uint64(mssBytes) >= opts.MaxMemory) {
+				if err := flush(); err != nil {
+					return errors.Wrapf(err, "stopped at rule %s, timestamp %s", rule.name, timestamp.Time(t))
+				}
+			}
+		}
+		return nil
+	}
+
+	res.Rules = make([]RuleResult, 0, len(rules))
+	for _, rule := range rules {
+		res.Rules = append(res.Rules, RuleResult{Group: rule.group, Name: rule.name, Start: rule.tr.start, End: rule.tr.end, Gaps: rule.gaps, Expired: rule.expired})
+	}
+	for _, shared := range shareExpressions(rules, logger) {
+		evals := make([]*ruleEval, 0, len(shared))
+		for _, i := range shared {
+			evals = append(evals, &ruleEval{
+				idx:       i,
+				rule:      rules[i],
+				rr:        &res.Rules[i],
+				queryFunc: engines.queryFunc(rules[i]),
+				series:    map[uint64]struct{}{},
+			})
+		}
+		// truncate marks the rules still evaluated as stopped at t.
+		truncate := func(t int64) {
+			for _, ev := range evals {
+				if !ev.rr.SeriesLimited {
+					ev.rr.TruncatedAt = timestamp.Time(t)
+				}
+			}
+		}
+
+		// The rules share the expression and the range, the first one is evaluated for all.
+		rule, rr := evals[0].rule, evals[0].rr
+		steps := rule.evalSteps(opts)
+		start, end := steps.first, steps.last
+		if ctx.Err() != nil {
+			truncate(timestamp.FromTime(rule.tr.start))
+			continue
+		}
+		for _, ev := range evals {
+			level.Info(logger).Log("msg", "backfilling rule", "rule", ev.rule.name, "group", ev.rule.group, "start", rule.tr.start, "end", rule.tr.end)
+		}
+
+		queryFunc, rangeQuery := evals[0].queryFunc, engines.rangeQueryFunc(rule)
+		maxQueryDuration := opts.MaxQueryDuration
+		// exhausted is the number of consecutive steps that failed with a
+		// timeout or by exceeding the max samples limit.
+		exhausted := 0
+		// The rule is evaluated at every step minus the query offset of its
+		// group, like the live group, and its samples recorded at the step.
+		offset := rule.queryOffset.Milliseconds()
+		ruleStart = len(mss)
+		// Range queries only evaluate steps at a fixed interval.
+		useRangeQuery := opts.RangeQueries && rule.useRangeQuery() && rule.timestamps == nil
+
+		var runs []emptyRun
+		if opts.SkipEmptyRanges {
+			var err error
+			if runs, err = emptyRuns(ctx, engines.q, rule, steps); err != nil {
+				level.Warn(logger).Log("msg", "failed to find the steps without source data, evaluating all steps", "rule", rule.name, "group", rule.group, "err", err)
+				runs = nil
+			}
+		}
+
+		// A panic in the evaluation of the rule, e.g. of the engine or a label
+		// template, stops it, but not the evaluation of the other rules.
+		panicked, err := recoverPanic(func() error {
+		batches:
+			for ws := start; ws <= end; {
+				i, empty := emptyRunAt(runs, ws)
+				if empty {
+					run := runs[i]
+					level.Info(logger).Log("msg", "skipping steps without source data", "rule", rule.name, "group", rule.group, "start", timestamp.Time(run.first), "end", timestamp.Time(run.last), "steps", run.steps)
+					for _, ev := range evals {
+						ev.rr.NoDataSteps += run.steps
+					}
+					ws = steps.next(run.last)
+					continue
+				}
+				we := steps.batchEnd(ws, batchSize)
+				if i < len(runs) && we >= runs[i].first {
+					// The batch ends before the next run without data.
+					we = runs[i].prev
+				}
+
+				// vectors holds the results of the batch's steps when evaluated with a range query.
+				var vectors map[int64]promql.Vector
+				if useRangeQuery {
+					qctx := promql.NewOriginContext(ctx, queryOrigin(opts.RuleFile, rule, "evalStart", timestamp.Time(ws-offset), "evalEnd", timestamp.Time(we-offset)))
+					var err error
+					began := time.Now()
+					vectors, err = rangeQuery(qctx, rule.vector.String(), ws-offset, we-offset, rule.evalInterval(opts))
+					if err == nil && offset != 0 {
+						vectors = shiftVectors(vectors, offset)
+					}
+					b.observeQuery(rule, rr, opts.SlowQueryThreshold, time.Since(began), numSamples(vectors), "start", timestamp.Time(ws), "end", timestamp.Time(we))
+					if err != nil {
+						if ctx.Err() != nil {
+							truncate(ws)
+							break
+						}
+						// Evaluate step by step to surface the failing steps.
+						level.Debug(logger).Log("msg", "range query failed, falling back to instant queries", "rule", rule.name, "start", timestamp.Time(ws), "end", timestamp.Time(we), "err", err)
+						vectors = nil
+					}
+				}
+
+				for t := ws; t <= we; t = steps.next(t) {
+					if ctx.Err() != nil {
+						truncate(t)
+						break batches
+					}
+
+					var vector promql.Vector
+					if vectors != nil {
+						vector = vectors[t]
+					} else {
+						qctx := promql.NewOriginContext(ctx, queryOrigin(opts.RuleFile, rule, "evalTime", timestamp.Time(t-offset)))
+						cancel := func() {}
+						if maxQueryDuration > 0 {
+							// The step is canceled at the deadline of the run, if that's earlier.
+							qctx, cancel = context.WithTimeout(qctx, maxQueryDuration)
+						}
+						var err error
+						began := time.Now()
+						vector, err = queryFunc(qctx, rule.vector.String(), timestamp.Time(t-offset))
+						d := time.Since(began)
+						timedOut := qctx.Err() == context.DeadlineExceeded
+						cancel()
+						b.observeQuery(rule, rr, opts.SlowQueryThreshold, d, len(vector), "t", timestamp.Time(t))
+						if err != nil {
+							if ctx.Err() != nil {
+								truncate(t)
+								break batches
+							}
+							if timedOut {
+								rr.TimedOutSteps++
+								level.Warn(logger).Log("msg", "slow step canceled at the max query duration", "rule", rule.name, "group", rule.group, "t", timestamp.Time(t), "max_query_duration", maxQueryDuration)
+							} else {
+								rr.FailedSteps++
+								level.Warn(logger).Log("err", err)
+							}
+							for _, ev := range evals {
+								if werr := failures.add(ev.rule, t, err); werr != nil {
+									return werr
+								}
+							}
+							if !exceedsBudget(err, timedOut) {
+								exhausted = 0
+								continue
+							}
+							if exhausted++; opts.QuarantineAfter == 0 || exhausted < opts.QuarantineAfter {
+								continue
+							}
+							exhausted = 0
+							// A longer timeout doesn't help against the max samples limit.
+							_, tooManySamples := errors.Cause(err).(promql.ErrTooManySamples)
+							if opts.AutoExtendTimeout && !rr.TimeoutExtended && !tooManySamples {
+								queryFunc, rangeQuery = engines.withTimeout(rule, 2*opts.Timeout)
+								maxQueryDuration *= 2
+								level.Warn(logger).Log("msg", "doubling the timeout of the rule after consecutive failed steps", "rule", rule.name, "group", rule.group, "t", timestamp.Time(t), "steps", opts.QuarantineAfter, "timeout", 2*opts.Timeout)
+								for _, ev := range evals {
+									ev.rr.TimeoutExtended = true
+								}
+								continue
+							}
+							next := steps.next(t)
+							if next > end {
+								continue
+							}
+							level.Error(logger).Log("msg", "abandoning the rule after consecutive failed steps, continuing with the other rules", "rule", rule.name, "group", rule.group, "steps", opts.QuarantineAfter, "at", timestamp.Time(next), "err", err)
+							for _, ev := range evals {
+								ev.rr.QuarantinedAt = timestamp.Time(next)
+								qerr := errors.Errorf("rule abandoned after %d consecutive failed steps, the steps from here on weren't evaluated", opts.QuarantineAfter)
+								if werr := failures.add(ev.rule, next, qerr); werr != nil {
+									return werr
+								}
+							}
+							break batches
+						}
+						exhausted = 0
+						// Unlike range query results, instant vectors aren't sorted, e.g. the
+						// result of an aggregation. Sort them for reproducible output.
+						sort.Slice(vector, func(i, j int) bool { return labels.Compare(vector[i].Metric, vector[j].Metric) < 0 })
+					}
+
+					active := 0
+					for _, ev := range evals {
+						if ev.rr.SeriesLimited {
+							continue
+						}
+						if err := appendVector(ev, t, vector); err != nil {
+							return err
+						}
+						if !ev.rr.SeriesLimited {
+							active++
+						}
+					}
+					if active == 0 {
+						break batches
+					}
+					// Blocks of filled gaps don't span the recorded data between them.
+					cutGap := rule.gaps != nil && steps.next(t) != t+rule.evalInterval(opts).Milliseconds()
+					if len(mss) > 0 && (cutGap || (opts.MaxBlockSeries > 0 && len(series) >= opts.MaxBlockSeries)) {
+						if err := flush(); err != nil {
+							return errors.Wrapf(err, "stopped at rule %s, timestamp %s", rule.name, timestamp.Time(t))
+						}
+					}
+				}
+				ws = steps.next(we)
+			}
+			return nil
+		})
+		if err != nil {
+			return res, err
+		}
+		if panicked != nil {
+			for _, ev := range evals {
+				ev.rr.Panic = fmt.Sprint(panicked.value)
+				level.Error(logger).Log("msg", "evaluation of rule panicked, continuing with the other rules", "rule", ev.rule.name, "group", ev.rule.group, "panic", panicked.value, "stack", panicked.stack)
+			}
+		}
+		for _, ev := range evals {
+			if rr := ev.rr; rr.InvalidValues > 0 {
+				level.Warn(logger).Log("msg", "dropped invalid values", "rule", ev.rule.name, "group", ev.rule.group, "samples", rr.InvalidValues)
+				res.InvalidValues += rr.InvalidValues
+			}
+			if rr := ev.rr; rr.Relabeled > 0 || rr.RelabelDropped > 0 {
+				level.Info(logger).Log("msg", "relabeled samples", "rule", ev.rule.name, "group", ev.rule.group, "modified", rr.Relabeled, "dropped", rr.RelabelDropped)
+			}
+			if rr := ev.rr; rr.OutOfRange > 0 {
+				level.Warn(logger).Log("msg", "dropped samples outside of the range of the rule", "rule", ev.rule.name, "group", ev.rule.group, "samples", rr.OutOfRange, "start", ev.rule.tr.start, "end", ev.rule.tr.end)
+			}
+			if rr := ev.rr; rr.Filtered > 0 {
+				level.Info(logger).Log("msg", "dropped samples not matching the output filters", "rule", ev.rule.name, "group", ev.rule.group, "samples", rr.Filtered)
+			}
+		}
+		if rr.SlowQueries > 0 {
+			level.Warn(logger).Log("msg", "rule had slow queries", "rule", rule.name, "group", rule.group, "slow_queries", rr.SlowQueries, "max_duration", rr.MaxQueryDuration)
+		}
+		if rr.FailedSteps > 0 {
+			level.Warn(logger).Log("msg", "rule had failed steps, they have no samples", "rule", rule.name, "group", rule.group, "steps", rr.FailedSteps)
+		}
+		if rr.TimedOutSteps > 0 {
+			level.Warn(logger).Log("msg", "rule had steps canceled at the max query duration, they have no samples", "rule", rule.name, "group", rule.group, "steps", rr.TimedOutSteps)
+			res.TimedOutSteps += rr.TimedOutSteps
+		}
+		// Truncated rules miss the samples after they stopped.
+		if cmp != nil && ctx.Err() == nil {
+			for _, ev := range evals {
+				rc, err := cmp.compare(ctx, ev.rule, ev.idx, steps)
+				if err != nil {
+					return res, errors.Wrapf(err, "failed to compare rule %s with the reference", ev.rule.name)
+				}
+				res.Comparison = append(res.Comparison, rc)
+				level.Info(logger).Log("msg", "compared rule with the reference", "rule", ev.rule.name, "group", ev.rule.group, "matched", rc.Matched, "mismatched", rc.Mismatched, "only_backfilled", rc.OnlyBackfilled, "only_reference", rc.OnlyReference, "mismatch_rate", rc.MismatchRate(), "max_abs_diff", rc.MaxAbsDiff, "max_rel_diff", rc.MaxRelDiff)
+			}
+		}
+	}
+
+	// flush the remaining samples
+	if len(mss) > 0 {
+		if err := flush(); err != nil {
+			return res, err
+		}
+	}
+	if err := collect(); err != nil {
+		return res, err
+	}
+	if opts.TenantLabel != "" || opts.TenantFromRules {
+		res.Tenants = tenantResults(res.Blocks, blockSamples)
+		for _, tr := range res.Tenants {
+			level.Info(logger).Log("msg", "tenant summary", "tenant", tr.Tenant, "blocks", tr.Blocks, "samples", tr.Samples)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		for _, rr := range res.Rules {
+			if !rr.TruncatedAt.IsZero() {
+				level.Warn(logger).Log("msg", "rule truncated", "rule", rr.Name, "group", rr.Group, "at", rr.TruncatedAt)
+			}
+		}
+		level.Warn(logger).Log("msg", "backfill truncated", "samples", res.Samples, "head_samples", res.HeadSamples, "duplicates", res.Duplicates, "conflicting_duplicates", res.ConflictingDuplicates, "near_duplicates", res.NearDuplicates, "invalid_values", res.InvalidValues)
+		if guard != nil {
+			if written, lerr := guard.state(); lerr != nil {
+				level.Warn(logger).Log("msg", "stopped at the disk usage limit, resume the truncated rules from where they stopped", "written_bytes", written, "err", lerr)
+				return res, lerr
+			}
+		}
+		return res, err
+	}
+
+	level.Info(logger).Log("msg", "backfill finished", "samples", res.Samples, "head_samples", res.HeadSamples, "duplicates", res.Duplicates, "conflicting_duplicates", res.ConflictingDuplicates, "near_duplicates", res.NearDuplicates, "invalid_values", res.InvalidValues, "timed_out_steps", res.TimedOutSteps, "receive_conflicts", res.ReceiveConflicts, "blocks", len(res.Blocks), "block_series", fmt.Sprint(res.BlockSeries), "chunk_bytes", res.ChunkBytes, "index_bytes", res.IndexBytes, "block_duration", res.BlockDuration)
+	return res, nil
+}
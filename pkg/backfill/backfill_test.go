@@ -0,0 +1,385 @@
+package backfill
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// testStart is the timestamp the source data of the tests starts at.
+const testStart = int64(1600000000000)
+
+// testSample is a sample of a series, identified by its labels.
+type testSample struct {
+	series string
+	t      int64
+	v      float64
+}
+
+// newTestDir returns a temporary directory and a function removing it.
+func newTestDir(t testing.TB) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "backfill-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// writeFile writes content to the file name in dir and returns its path.
+func writeFile(t testing.TB, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeSource writes the samples into the head of a TSDB in dir, like a
+// server that didn't cut a block yet.
+func writeSource(t testing.TB, dir string, samples []*tsdb.MetricSample) {
+	t.Helper()
+	db, err := tsdb.Open(dir, nil, nil, tsdb.DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := db.Appender()
+	for _, s := range samples {
+		if _, err := app.Add(s.Labels, s.TimestampMs, s.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// upSamples returns samples of up{job="node",instance="a"} every interval
+// from testStart for d, with the value 1.
+func upSamples(d, interval time.Duration) []*tsdb.MetricSample {
+	lset := labels.FromStrings("__name__", "up", "job", "node", "instance", "a")
+	var samples []*tsdb.MetricSample
+	for t := testStart; t < testStart+d.Milliseconds(); t += interval.Milliseconds() {
+		samples = append(samples, &tsdb.MetricSample{Labels: lset, TimestampMs: t, Value: 1})
+	}
+	return samples
+}
+
+// testOptions returns the options of a backfill of the rule file into dest,
+// with the defaults of the flags.
+func testOptions(ruleFile, dbPath, dest string) Options {
+	return Options{
+		RuleFile:             ruleFile,
+		DBPath:               dbPath,
+		DestPath:             dest,
+		OutputFormat:         OutputFormatTSDB,
+		MaxSamples:           50000000,
+		Timeout:              2 * time.Minute,
+		TimestampMode:        TimestampModeEval,
+		EvalInterval:         30 * time.Second,
+		OnSeriesLimit:        SeriesLimitDrop,
+		MaxSamplesInMem:      10000,
+		RangeQueries:         true,
+		MaxConcurrentBlocks:  1,
+		StepBatchSize:        DefaultStepBatchSize,
+		PreflightSkip:        true,
+		DestLock:             true,
+		SeriesManifestFormat: ManifestFormatJSON,
+		AppendBatchSize:      DefaultAppendBatchSize,
+		CompactBlockDuration: 24 * time.Hour,
+	}
+}
+
+// runBackfill runs a backfill with opts and fails the test on an error.
+func runBackfill(t testing.TB, opts Options) Result {
+	t.Helper()
+	res, err := New(nil, nil).Run(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// blockIDs returns the ULIDs of the blocks in dir, in order.
+func blockIDs(t testing.TB, dir string) []string {
+	t.Helper()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, f := range files {
+		if _, err := ulid.ParseStrict(f.Name()); err == nil && f.IsDir() {
+			ids = append(ids, f.Name())
+		}
+	}
+	return ids
+}
+
+// readBlocks returns the samples of all blocks in dir, read with
+// tsdb.OpenBlock, ordered by series and timestamp.
+func readBlocks(t testing.TB, dir string) []testSample {
+	t.Helper()
+	var samples []testSample
+	for _, id := range blockIDs(t, dir) {
+		b, err := tsdb.OpenBlock(nil, filepath.Join(dir, id), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, err := tsdb.NewBlockQuerier(b, b.MinTime(), b.MaxTime())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss, _, err := q.Select(false, nil, labels.MustNewMatcher(labels.MatchRegexp, "__name__", ".+"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ss.Next() {
+			s := ss.At()
+			it := s.Iterator()
+			for it.Next() {
+				ts, v := it.At()
+				samples = append(samples, testSample{series: s.Labels().String(), t: ts, v: v})
+			}
+			if err := it.Err(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ss.Err(); err != nil {
+			t.Fatal(err)
+		}
+		q.Close()
+		b.Close()
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].series != samples[j].series {
+			return samples[i].series < samples[j].series
+		}
+		return samples[i].t < samples[j].t
+	})
+	return samples
+}
+
+// timestamps returns the timestamps of the samples.
+func timestamps(samples []testSample) []int64 {
+	ts := make([]int64, 0, len(samples))
+	for _, s := range samples {
+		ts = append(ts, s.t)
+	}
+	return ts
+}
+
+// steps returns the timestamps from first to last every interval.
+func steps(first, last int64, interval time.Duration) []int64 {
+	var ts []int64
+	for t := first; t <= last; t += interval.Milliseconds() {
+		ts = append(ts, t)
+	}
+	return ts
+}
+
+func TestQueryOffsetTimestampModes(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+	src := filepath.Join(dir, "src")
+	writeSource(t, src, upSamples(2*time.Hour, 15*time.Second))
+	ruleFile := writeFile(t, dir, "rules.yaml", `groups:
+  - name: g
+    query_offset: 5m
+    rules:
+      - record: job:up:sum
+        expr: sum by (job) (up)
+`)
+	start, end := testStart+time.Hour.Milliseconds(), testStart+90*time.Minute.Milliseconds()
+
+	for i, tc := range []struct {
+		mode        string
+		strictRange bool
+		want        []int64
+		outOfRange  int
+		err         bool
+	}{
+		// Recorded at the steps, queried five minutes before them.
+		{mode: TimestampModeEval, want: steps(start, end, 30*time.Second)},
+		// Recorded at the query time, the samples of the first five minutes
+		// of steps would be before the start.
+		{mode: TimestampModeSample, want: steps(start, end-5*time.Minute.Milliseconds(), 30*time.Second), outOfRange: 10},
+		{mode: TimestampModeSample, strictRange: true, err: true},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			opts := testOptions(ruleFile, src, filepath.Join(dir, "dest"+strconv.Itoa(i)))
+			opts.Start = time.Unix(0, start*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+			opts.End = time.Unix(0, end*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+			opts.TimestampMode = tc.mode
+			opts.StrictRange = tc.strictRange
+
+			res, err := New(nil, nil).Run(context.Background(), opts)
+			if tc.err {
+				if err == nil || !strings.Contains(err.Error(), "outside of its range") {
+					t.Fatalf("expected an error for a sample before the start with --strict-range, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := timestamps(readBlocks(t, opts.DestPath)); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("written timestamps %v, want %v", got, tc.want)
+			}
+			if len(res.Rules) != 1 || res.Rules[0].OutOfRange != tc.outOfRange {
+				t.Fatalf("rule results %+v, want %d samples out of range", res.Rules, tc.outOfRange)
+			}
+		})
+	}
+}
+
+func TestUnwritableQueryLogFile(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+	src := filepath.Join(dir, "src")
+	writeSource(t, src, upSamples(time.Hour, 15*time.Second))
+	ruleFile := writeFile(t, dir, "rules.yaml", `groups:
+  - name: g
+    rules:
+      - record: job:up:sum
+        expr: sum by (job) (up)
+`)
+	// The parent of the query log is a file, which fails even for root.
+	queryLog := filepath.Join(ruleFile, "query.log")
+
+	t.Run("required", func(t *testing.T) {
+		opts := testOptions(ruleFile, src, filepath.Join(dir, "dest-required"))
+		opts.QueryLogFile = queryLog
+		opts.QueryLogRequired = true
+		_, err := New(nil, nil).Run(context.Background(), opts)
+		if err == nil || !strings.Contains(err.Error(), "failed to create query logger") {
+			t.Fatalf("expected the run to fail creating the query logger, got %v", err)
+		}
+		if ids := blockIDs(t, opts.DestPath); len(ids) > 0 {
+			t.Fatalf("expected no blocks, got %v", ids)
+		}
+	})
+	t.Run("optional", func(t *testing.T) {
+		var buf bytes.Buffer
+		opts := testOptions(ruleFile, src, filepath.Join(dir, "dest-optional"))
+		opts.QueryLogFile = queryLog
+		if _, err := New(log.NewLogfmtLogger(&buf), nil).Run(context.Background(), opts); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), "query logging is disabled") {
+			t.Fatalf("expected a warning that query logging is disabled, got logs:\n%s", buf.String())
+		}
+		if len(readBlocks(t, opts.DestPath)) == 0 {
+			t.Fatal("expected the samples to be backfilled without the query log")
+		}
+	})
+}
+
+// TestBlockRangeIncludesNewestSample checks that the newest sample of every
+// block is queryable, which is outside of a block whose half-open range ends
+// at it.
+func TestBlockRangeIncludesNewestSample(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+	src := filepath.Join(dir, "src")
+	writeSource(t, src, upSamples(time.Hour, 15*time.Second))
+	ruleFile := writeFile(t, dir, "rules.yaml", `groups:
+  - name: g
+    rules:
+      - record: job:up:sum
+        expr: sum by (job) (up)
+`)
+	start, end := testStart+10*time.Minute.Milliseconds(), testStart+50*time.Minute.Milliseconds()
+	opts := testOptions(ruleFile, src, filepath.Join(dir, "dest"))
+	opts.Start = strconv.FormatInt(start, 10) + "ms"
+	opts.End = strconv.FormatInt(end, 10) + "ms"
+	// A block is cut every 7 samples.
+	opts.MaxSamplesInMem = 7
+	runBackfill(t, opts)
+
+	want := steps(start, end, 30*time.Second)
+	if ids := blockIDs(t, opts.DestPath); len(ids) != (len(want)+6)/7 {
+		t.Fatalf("expected %d blocks, got %d", (len(want)+6)/7, len(ids))
+	}
+	for _, id := range blockIDs(t, opts.DestPath) {
+		m, err := readBlockMeta(filepath.Join(opts.DestPath, id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (m.MaxTime-start)%(30*time.Second).Milliseconds() != 1 {
+			t.Fatalf("block %s ends at %d, want one millisecond after its newest step", id, m.MaxTime)
+		}
+	}
+	if got := timestamps(readBlocks(t, opts.DestPath)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("queried timestamps %v, want %v", got, want)
+	}
+}
+
+// TestRepeatedRunsWriteSameSeries checks that two runs with instant queries
+// write the same series in the same order, though the engine returns the
+// series of an aggregation in random order.
+func TestRepeatedRunsWriteSameSeries(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+	src := filepath.Join(dir, "src")
+	var samples []*tsdb.MetricSample
+	for i := 0; i < 30; i++ {
+		lset := labels.FromStrings("__name__", "up", "job", "job-"+strconv.Itoa(i%10), "instance", "host-"+strconv.Itoa(i))
+		for d := time.Duration(0); d < time.Hour; d += 15 * time.Second {
+			samples = append(samples, &tsdb.MetricSample{Labels: lset, TimestampMs: testStart + d.Milliseconds(), Value: 1})
+		}
+	}
+	writeSource(t, src, samples)
+	ruleFile := writeFile(t, dir, "rules.yaml", `groups:
+  - name: g
+    rules:
+      - record: job:up:sum
+        expr: sum by (job) (up)
+`)
+
+	run := func(name string) ([]byte, []testSample) {
+		opts := testOptions(ruleFile, src, filepath.Join(dir, "dest-"+name))
+		opts.Start, opts.End = "1600000600", "1600003000"
+		opts.RangeQueries = false
+		runBackfill(t, opts)
+
+		// The CSV output has the samples in the order they are written.
+		opts.OutputFormat = OutputFormatCSV
+		opts.OutputFile = filepath.Join(dir, name+".csv")
+		runBackfill(t, opts)
+		csv, err := ioutil.ReadFile(opts.OutputFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return csv, readBlocks(t, opts.DestPath)
+	}
+	firstCSV, first := run("first")
+	secondCSV, second := run("second")
+
+	if len(first) != 10*81 {
+		t.Fatalf("expected a sample of each of 10 jobs at 81 steps, got %d", len(first))
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Fatal("the series of the blocks of the two runs differ")
+	}
+	if !bytes.Equal(firstCSV, secondCSV) {
+		t.Fatal("the samples of the two runs are written in a different order")
+	}
+}
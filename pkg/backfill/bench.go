@@ -0,0 +1,98 @@
+package backfill
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+)
+
+// RuleBench holds the query latencies of a rule measured in bench mode.
+type RuleBench struct {
+	Group string
+	Name  string
+	// Queries is the number of successful queries the latencies are based on.
+	Queries int
+	// Errors is the number of failed queries.
+	Errors        int
+	P50, P95, Max time.Duration
+	// AvgSamples is the average number of samples returned by a query.
+	AvgSamples float64
+	// Steps is the number of evaluations of the full backfill.
+	Steps int64
+	// Projected is the projected time to evaluate the rule over its full range.
+	Projected time.Duration
+}
+
+// bench evaluates every rule at opts.Bench evenly spaced timestamps across
+// its range and projects the time of the full backfill from the latencies.
+func (b *Backfiller) bench(ctx context.Context, rules []*recordingRule, opts Options, engines *queryEngines) ([]RuleBench, error) {
+	res := make([]RuleBench, 0, len(rules))
+	for _, rule := range rules {
+		start, end := timestamp.FromTime(rule.tr.start), rule.tr.lastEval(opts.EndExclusive)
+		rb := RuleBench{
+			Group: rule.group,
+			Name:  rule.name,
+			Steps: rule.evalSteps(opts).count(),
+		}
+
+		queryFunc := engines.queryFunc(rule)
+		var (
+			latencies []time.Duration
+			samples   int
+		)
+		for i := 0; i < opts.Bench; i++ {
+			if err := ctx.Err(); err != nil {
+				return res, err
+			}
+			t := start
+			if opts.Bench > 1 {
+				t += int64(i) * (end - start) / int64(opts.Bench-1)
+			}
+
+			began := time.Now()
+			vector, err := queryFunc(ctx, rule.vector.String(), timestamp.Time(t))
+			if err != nil {
+				level.Warn(b.logger).Log("msg", "bench query failed", "rule", rule.name, "t", timestamp.Time(t), "err", err)
+				rb.Errors++
+				continue
+			}
+			latencies = append(latencies, time.Since(began))
+			samples += len(vector)
+		}
+		if len(latencies) == 0 {
+			res = append(res, rb)
+			continue
+		}
+
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		var total time.Duration
+		for _, l := range latencies {
+			total += l
+		}
+		rb.Queries = len(latencies)
+		rb.P50 = percentile(latencies, 0.5)
+		rb.P95 = percentile(latencies, 0.95)
+		rb.Max = latencies[len(latencies)-1]
+		rb.AvgSamples = float64(samples) / float64(len(latencies))
+		rb.Projected = total / time.Duration(len(latencies)) * time.Duration(rb.Steps)
+		res = append(res, rb)
+	}
+	if len(res) == 0 {
+		return nil, errors.New("no rules to bench")
+	}
+	return res, nil
+}
+
+// percentile returns the q-th percentile of the sorted durations.
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
@@ -0,0 +1,225 @@
+package backfill
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	tsdb_errors "github.com/prometheus/prometheus/tsdb/errors"
+	"github.com/prometheus/prometheus/tsdb/wal"
+)
+
+// blockFilter selects the blocks of a TSDB source to open: the blocks
+// overlapping [mint, maxt] and the block preceding it, for the lookback of
+// the first steps, or the blocks in ulids if it isn't nil.
+type blockFilter struct {
+	mint, maxt int64
+	ulids      map[string]bool
+}
+
+// sourceBlockFilter returns the block filter of opts, nil if all blocks of
+// the source are opened. Without an explicit filter, the range is the start
+// and end of opts unless the rules have ranges of their own. The range is
+// widened by the longest lookback of the rules.
+func sourceBlockFilter(opts Options, rules []*recordingRule) (*blockFilter, error) {
+	f := &blockFilter{mint: math.MinInt64, maxt: math.MaxInt64}
+	start, end := opts.Start, opts.End
+	switch {
+	case len(opts.SourceBlockULIDs) > 0:
+		f.ulids = map[string]bool{}
+		for _, id := range opts.SourceBlockULIDs {
+			if _, err := ulid.ParseStrict(id); err != nil {
+				return nil, errors.Wrapf(err, "invalid block ULID %q", id)
+			}
+			f.ulids[id] = true
+		}
+		return f, nil
+	case opts.SourceBlockRange != "":
+		parts := strings.Split(opts.SourceBlockRange, ",")
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid source block range %q, expected <start>,<end>", opts.SourceBlockRange)
+		}
+		start, end = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	case opts.Start == "" && opts.End == "", opts.RangeOverridesFile != "":
+		return nil, nil
+	default:
+		for _, rule := range rules {
+			if rule.start != "" || rule.end != "" {
+				return nil, nil
+			}
+		}
+	}
+
+	if start != "" {
+		t, err := parseTime(start)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse source block range start")
+		}
+		f.mint = timestamp.FromTime(t)
+		for _, rule := range rules {
+			f.mint = min(f.mint, timestamp.FromTime(t.Add(-rule.lookback()-rule.queryOffset)))
+		}
+	}
+	if end != "" {
+		t, err := parseTime(end)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse source block range end")
+		}
+		f.maxt = timestamp.FromTime(t)
+	}
+	if f.mint > f.maxt {
+		return nil, errors.Errorf("source block range %s,%s ends before it starts", start, end)
+	}
+	return f, nil
+}
+
+// filteredSource is a TSDB of which only the selected blocks are opened, and
+// its head if the range of the filter reaches it.
+type filteredSource struct {
+	*blocksSource
+	head *tsdb.Head
+}
+
+// openFilteredSource opens the blocks of the TSDB in dir selected by f, based
+// on their meta.json, and replays its WAL into a head if f is a range that
+// ends after the blocks. The blocks are only read.
+func openFilteredSource(dir string, f blockFilter, logger log.Logger) (*filteredSource, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var metas []*blockMeta
+	for _, fi := range files {
+		if _, err := ulid.ParseStrict(fi.Name()); err != nil || !fi.IsDir() {
+			continue
+		}
+		m, err := readBlockMeta(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "read meta of block %s", fi.Name())
+		}
+		metas = append(metas, m)
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].MinTime < metas[j].MinTime })
+
+	maxBlockTime := int64(math.MinInt64)
+	var (
+		selected []*blockMeta
+		// preceding is the newest block ending before the range.
+		preceding *blockMeta
+	)
+	for _, m := range metas {
+		maxBlockTime = max(maxBlockTime, m.MaxTime)
+		switch {
+		case f.ulids != nil:
+			if f.ulids[m.ULID.String()] {
+				selected = append(selected, m)
+			}
+		// Block ranges are half-open.
+		case m.MinTime <= f.maxt && m.MaxTime > f.mint:
+			selected = append(selected, m)
+		case m.MaxTime <= f.mint && (preceding == nil || m.MaxTime > preceding.MaxTime):
+			preceding = m
+		}
+	}
+	if preceding != nil {
+		selected = append(selected, preceding)
+	}
+	if f.ulids != nil && len(selected) < len(f.ulids) {
+		var missing []string
+		for id := range f.ulids {
+			found := false
+			for _, m := range selected {
+				found = found || m.ULID.String() == id
+			}
+			if !found {
+				missing = append(missing, id)
+			}
+		}
+		sort.Strings(missing)
+		return nil, errors.Errorf("blocks %s not found in %s", strings.Join(missing, ","), dir)
+	}
+
+	s := &filteredSource{blocksSource: &blocksSource{}}
+	for _, m := range selected {
+		b, err := tsdb.OpenBlock(logger, filepath.Join(dir, m.ULID.String()), nil)
+		if err != nil {
+			s.Close()
+			return nil, errors.Wrapf(err, "open block %s", m.ULID)
+		}
+		s.blocks = append(s.blocks, b)
+	}
+
+	// An explicit list of blocks leaves the head out.
+	walDir := filepath.Join(dir, "wal")
+	if _, err := os.Stat(walDir); err == nil && f.ulids == nil && f.maxt >= maxBlockTime {
+		w, err := wal.Open(logger, walDir)
+		if err != nil {
+			s.Close()
+			return nil, errors.Wrap(err, "open WAL")
+		}
+		if s.head, err = tsdb.NewHead(nil, logger, w, tsdb.DefaultBlockDuration, tsdb.DefaultStripeSize); err != nil {
+			w.Close()
+			s.Close()
+			return nil, err
+		}
+		// Like the DB, the head only holds the samples after the blocks.
+		if err := s.head.Init(maxBlockTime); err != nil {
+			s.Close()
+			return nil, errors.Wrap(err, "read WAL")
+		}
+	}
+	if len(s.blocks) == 0 && s.head == nil {
+		return nil, errors.Errorf("no blocks of %s in the source block range", dir)
+	}
+	level.Info(logger).Log("msg", "opened the selected blocks of the source", "dir", dir, "blocks", len(s.blocks), "skipped_blocks", len(metas)-len(s.blocks), "head", s.head != nil)
+	return s, nil
+}
+
+func (s *filteredSource) MinTime() int64 {
+	minTime := s.blocksSource.MinTime()
+	if s.head != nil && s.head.MaxTime() >= s.head.MinTime() {
+		minTime = min(minTime, s.head.MinTime())
+	}
+	return minTime
+}
+
+func (s *filteredSource) MaxTime() int64 {
+	maxTime := s.blocksSource.MaxTime()
+	if s.head != nil && s.head.MaxTime() >= s.head.MinTime() {
+		maxTime = max(maxTime, s.head.MaxTime())
+	}
+	return maxTime
+}
+
+func (s *filteredSource) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	q, err := s.blocksSource.Querier(ctx, mint, maxt)
+	if err != nil || s.head == nil {
+		return q, err
+	}
+	hq, err := tsdb.NewBlockQuerier(tsdb.NewRangeHead(s.head, mint, maxt), mint, maxt)
+	if err != nil {
+		q.Close()
+		return nil, errors.Wrap(err, "open querier for head")
+	}
+	return storage.NewMergeQuerier(q, []storage.Querier{q, hq}, storage.ChainedSeriesMerge), nil
+}
+
+func (s *filteredSource) Close() error {
+	var merr tsdb_errors.MultiError
+	merr.Add(s.blocksSource.Close())
+	if s.head != nil {
+		merr.Add(s.head.Close())
+	}
+	return merr.Err()
+}
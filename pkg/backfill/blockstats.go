@@ -0,0 +1,37 @@
+package backfill
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// BlockStats describes a block written by a run.
+type BlockStats struct {
+	// ULID is the ULID of the block, with Options.TenantLabel or
+	// Options.TenantFromRules prefixed with the directory of its tenant.
+	ULID string
+	// MinTime and MaxTime are the timestamps of the oldest and the newest
+	// sample of the block.
+	MinTime, MaxTime time.Time
+	Samples, Series  int
+	// ChunkBytes and IndexBytes are the on-disk sizes of the chunks and the
+	// index of the block.
+	ChunkBytes, IndexBytes int64
+	// Duration is the time it took to create the block.
+	Duration time.Duration
+}
+
+// blockFileSizes returns the sizes of the chunks and the index of the block
+// in dir.
+func blockFileSizes(dir string) (int64, int64, error) {
+	chunks, err := dirSize(filepath.Join(dir, "chunks"))
+	if err != nil {
+		return 0, 0, err
+	}
+	fi, err := os.Stat(filepath.Join(dir, "index"))
+	if err != nil {
+		return 0, 0, err
+	}
+	return chunks, fi.Size(), nil
+}
@@ -0,0 +1,80 @@
+package backfill
+
+import (
+	"sync"
+)
+
+// blockWriter writes blocks, at most limit of them at a time in the
+// background while the evaluation goes on. With a limit of 1, blocks are
+// written synchronously.
+type blockWriter struct {
+	limit int
+	sem   chan struct{}
+	wg    sync.WaitGroup
+
+	mtx sync.Mutex
+	// blocks are the stats of the blocks written since the last wait, err the
+	// first error of a write.
+	blocks []BlockStats
+	err    error
+}
+
+func newBlockWriter(limit int) *blockWriter {
+	if limit < 1 {
+		limit = 1
+	}
+	return &blockWriter{limit: limit, sem: make(chan struct{}, limit)}
+}
+
+// write runs fn, which writes a block and returns its stats, once fewer than
+// limit blocks are being written. It returns the error of fn if it runs
+// synchronously, or else of a previous write.
+func (w *blockWriter) write(fn func() (BlockStats, error)) error {
+	if w.limit == 1 {
+		stats, err := fn()
+		w.done(stats, err)
+		return err
+	}
+
+	w.sem <- struct{}{}
+	w.mtx.Lock()
+	err := w.err
+	w.mtx.Unlock()
+	if err != nil {
+		<-w.sem
+		return err
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer func() { <-w.sem }()
+		stats, err := fn()
+		w.done(stats, err)
+	}()
+	return nil
+}
+
+func (w *blockWriter) done(stats BlockStats, err error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if err != nil {
+		if w.err == nil {
+			w.err = err
+		}
+		return
+	}
+	w.blocks = append(w.blocks, stats)
+}
+
+// wait waits for the blocks being written and returns the stats of the blocks
+// written since the last wait, and the first error of any write.
+func (w *blockWriter) wait() ([]BlockStats, error) {
+	w.wg.Wait()
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	blocks := w.blocks
+	w.blocks = nil
+	return blocks, w.err
+}
@@ -0,0 +1,85 @@
+package backfill
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// checkRecordCollisions looks for series in the source that are already named
+// like a rule's record but have a different set of label names than the rule
+// produces at the end of its range. That usually means a rule was renamed and
+// backfilling it would mix two different series under one name.
+func checkRecordCollisions(ctx context.Context, q storage.Queryable, rules []*recordingRule, engines *queryEngines) ([]error, error) {
+	var collisions []error
+	for _, rule := range rules {
+		existing, ok, err := recordShape(ctx, q, rule)
+		if err != nil {
+			return nil, errors.Wrapf(err, "select series of %s", rule.name)
+		}
+		if !ok {
+			continue
+		}
+
+		vector, err := engines.queryFunc(rule)(ctx, rule.vector.String(), rule.tr.end)
+		if err != nil {
+			return nil, errors.Wrapf(err, "evaluate rule %s", rule.name)
+		}
+		if len(vector) == 0 {
+			continue
+		}
+		if produced := ruleShape(rule, vector[0].Metric); produced != existing {
+			collisions = append(collisions, errors.Errorf("series named %s already exist in the source with the labels [%s], while rule %s in group %s produces [%s]", rule.name, existing, rule.name, rule.group, produced))
+		}
+	}
+	return collisions, nil
+}
+
+// recordShape returns the label names of the first series in the source named
+// like the rule's record within its range, and whether there is one.
+func recordShape(ctx context.Context, q storage.Queryable, rule *recordingRule) (string, bool, error) {
+	querier, err := q.Querier(ctx, timestamp.FromTime(rule.tr.start), timestamp.FromTime(rule.tr.end))
+	if err != nil {
+		return "", false, err
+	}
+	defer querier.Close()
+
+	ss, _, err := querier.Select(false, nil, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, rule.name))
+	if err != nil {
+		return "", false, err
+	}
+	if !ss.Next() {
+		return "", false, ss.Err()
+	}
+	return shape(ss.At().Labels()), true, nil
+}
+
+// ruleShape returns the label names of the series the rule produces from a
+// sample with the given labels.
+func ruleShape(rule *recordingRule, lset labels.Labels) string {
+	lb := labels.NewBuilder(lset)
+	for _, l := range rule.lset {
+		lb.Set(l.Name, l.Value)
+	}
+	for _, l := range rule.tmplLabels {
+		lb.Set(l.Name, l.Value)
+	}
+	return shape(lb.Labels())
+}
+
+// shape returns the sorted label names of lset other than the metric name.
+func shape(lset labels.Labels) string {
+	names := make([]string, 0, len(lset))
+	for _, l := range lset {
+		if l.Name != labels.MetricName {
+			names = append(names, l.Name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
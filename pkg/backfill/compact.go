@@ -0,0 +1,117 @@
+package backfill
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// compactBlocks merges the given blocks in dir into blocks spanning at most
+// blockDuration and returns the resulting block set. Blocks are grouped in
+// order of their min time. The source blocks of a group are only deleted once
+// their replacement is written, so a failed compaction leaves them in place.
+func compactBlocks(ctx context.Context, dir string, blocks []string, blockDuration time.Duration, ruleFile string, logger log.Logger, reg prometheus.Registerer) ([]string, error) {
+	metas := make([]*blockMeta, 0, len(blocks))
+	for _, b := range blocks {
+		m, err := readBlockMeta(filepath.Join(dir, b))
+		if err != nil {
+			return blocks, errors.Wrapf(err, "read meta of block %s", b)
+		}
+		metas = append(metas, m)
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].MinTime < metas[j].MinTime })
+
+	// Block ranges are half-open, so the span of a group is maxt - mint.
+	var (
+		groups   [][]*blockMeta
+		maxt     int64
+		duration = blockDuration.Milliseconds()
+	)
+	for _, m := range metas {
+		if n := len(groups); n > 0 && max(maxt, m.MaxTime)-groups[n-1][0].MinTime <= duration {
+			groups[n-1] = append(groups[n-1], m)
+			maxt = max(maxt, m.MaxTime)
+			continue
+		}
+		groups = append(groups, []*blockMeta{m})
+		maxt = m.MaxTime
+	}
+
+	compactor, err := tsdb.NewLeveledCompactor(ctx, reg, logger, []int64{duration}, nil)
+	if err != nil {
+		return blocks, errors.Wrap(err, "create compactor")
+	}
+
+	var res []string
+	for i, group := range groups {
+		if len(group) == 1 {
+			res = append(res, group[0].ULID.String())
+			continue
+		}
+
+		dirs := make([]string, 0, len(group))
+		for _, m := range group {
+			dirs = append(dirs, filepath.Join(dir, m.ULID.String()))
+		}
+		uid, err := compactor.Compact(filepath.Join(dir, stagingDir), dirs, nil)
+		if err != nil {
+			// Keep the blocks of this and the remaining groups as they are.
+			return append(res, remainingIDs(groups[i:])...), errors.Wrapf(err, "compact blocks %v", dirs)
+		}
+		if uid != (ulid.ULID{}) {
+			staged := filepath.Join(dir, stagingDir, uid.String())
+			if err := markBlock(staged, ruleFile); err != nil {
+				os.RemoveAll(staged)
+				return append(res, remainingIDs(groups[i:])...), errors.Wrapf(err, "failed to mark block %s", uid)
+			}
+			if err := publishBlock(dir, uid.String()); err != nil {
+				os.RemoveAll(staged)
+				return append(res, remainingIDs(groups[i:])...), errors.Wrapf(err, "failed to move block %s into place", uid)
+			}
+			res = append(res, uid.String())
+		}
+
+		// Source blocks that can't be deleted stay in the block set, but
+		// overlap the compacted block.
+		var (
+			undeleted []string
+			lastErr   error
+		)
+		for j, d := range dirs {
+			if err := os.RemoveAll(d); err != nil {
+				undeleted = append(undeleted, group[j].ULID.String())
+				lastErr = err
+			}
+		}
+		if len(undeleted) > 0 {
+			res = append(res, undeleted...)
+			return append(res, remainingIDs(groups[i+1:])...), errors.Wrapf(lastErr, "failed to delete compacted blocks %v, which overlap block %s", undeleted, uid)
+		}
+	}
+	return res, nil
+}
+
+// remainingIDs returns the IDs of the blocks of the groups.
+func remainingIDs(groups [][]*blockMeta) []string {
+	var res []string
+	for _, g := range groups {
+		res = append(res, ids(g)...)
+	}
+	return res
+}
+
+func ids(metas []*blockMeta) []string {
+	res := make([]string, 0, len(metas))
+	for _, m := range metas {
+		res = append(res, m.ULID.String())
+	}
+	return res
+}
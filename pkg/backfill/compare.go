@@ -0,0 +1,356 @@
+package backfill
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// compareExamples is the number of the worst mismatching samples reported per rule.
+const compareExamples = 5
+
+// ErrCompareMismatch is returned in comparison mode when the samples of a
+// rule mismatch the reference data more often than Options.MaxMismatchRate.
+var ErrCompareMismatch = errors.New("backfilled samples don't match the reference data")
+
+// RuleComparison compares the samples evaluated for a rule with the samples of
+// the series it records in the reference data.
+type RuleComparison struct {
+	Group string
+	Name  string
+	// Matched and Mismatched are the evaluated samples paired with a reference
+	// sample of their series within half an eval interval, whose values are
+	// within Options.CompareTolerance of each other or not.
+	Matched, Mismatched int
+	// OnlyBackfilled is the number of evaluated samples without a reference
+	// sample to pair with, OnlyReference the number of reference samples
+	// within half an eval interval of a step without an evaluated sample.
+	OnlyBackfilled, OnlyReference int
+	// MeanAbsDiff, MaxAbsDiff, MeanRelDiff and MaxRelDiff are the absolute and
+	// relative differences of the values of the paired samples.
+	MeanAbsDiff, MaxAbsDiff float64
+	MeanRelDiff, MaxRelDiff float64
+	// Worst are the paired samples with the largest absolute differences.
+	Worst []SampleDiff
+}
+
+// MismatchRate is the share of the samples of both sides that aren't matched.
+func (c RuleComparison) MismatchRate() float64 {
+	total := c.Matched + c.Mismatched + c.OnlyBackfilled + c.OnlyReference
+	if total == 0 {
+		return 0
+	}
+	return float64(total-c.Matched) / float64(total)
+}
+
+// SampleDiff is an evaluated sample and the reference sample paired with it.
+type SampleDiff struct {
+	Series string
+	// T is the timestamp of the evaluated sample, RefT the one of the
+	// reference sample.
+	T, RefT    time.Time
+	Backfilled float64
+	Reference  float64
+}
+
+// refSeries is a series with its samples ordered by time.
+type refSeries struct {
+	lset labels.Labels
+	ts   []int64
+	vs   []float64
+}
+
+// reference is the data the evaluated samples are compared with.
+type reference interface {
+	// series returns the series matching the matchers with their samples in
+	// [mint, maxt].
+	series(ctx context.Context, mint, maxt int64, matchers []*labels.Matcher) ([]*refSeries, error)
+	Close() error
+}
+
+// openReference opens the TSDB in dir, or the Prometheus server if it is an
+// http(s) URL, as the reference. The TSDB is only read.
+func openReference(dir string, logger log.Logger) (reference, error) {
+	if strings.HasPrefix(dir, "http://") || strings.HasPrefix(dir, "https://") {
+		return &apiReference{url: strings.TrimSuffix(dir, "/")}, nil
+	}
+	s, err := openFlushedSource(dir, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &queryableReference{s}, nil
+}
+
+// queryableReference is a TSDB used as the reference.
+type queryableReference struct {
+	*flushedSource
+}
+
+func (r *queryableReference) series(ctx context.Context, mint, maxt int64, matchers []*labels.Matcher) ([]*refSeries, error) {
+	q, err := r.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+
+	ss, _, err := q.Select(false, &storage.SelectHints{Start: mint, End: maxt}, matchers...)
+	if err != nil {
+		return nil, err
+	}
+	var res []*refSeries
+	for ss.Next() {
+		s := &refSeries{lset: ss.At().Labels()}
+		it := ss.At().Iterator()
+		for it.Next() {
+			if t, v := it.At(); t >= mint && t <= maxt {
+				s.ts = append(s.ts, t)
+				s.vs = append(s.vs, v)
+			}
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, ss.Err()
+}
+
+// apiReference is a Prometheus server used as the reference, whose raw
+// samples are read with range selectors through its HTTP API.
+type apiReference struct {
+	url string
+}
+
+func (r *apiReference) series(ctx context.Context, mint, maxt int64, matchers []*labels.Matcher) ([]*refSeries, error) {
+	sel := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		sel = append(sel, m.String())
+	}
+	// The range selector covers (time-range, time], so it starts a millisecond early.
+	rng := model.Duration(time.Duration(maxt-mint+1) * time.Millisecond)
+	u, err := url.Parse(r.url + "/api/v1/query")
+	if err != nil {
+		return nil, errors.Wrap(err, "parse Prometheus URL")
+	}
+	u.RawQuery = url.Values{
+		"query": []string{"{" + strings.Join(sel, ",") + "}[" + rng.String() + "]"},
+		"time":  []string{strconv.FormatFloat(float64(maxt)/1000, 'f', -1, 64)},
+	}.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "read response")
+	}
+	var res struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			ResultType string       `json:"resultType"`
+			Result     model.Matrix `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, errors.Errorf("unexpected response with status %s: %s", resp.Status, b)
+	}
+	if res.Status != "success" {
+		return nil, errors.Errorf("query failed with status %s: %s", resp.Status, res.Error)
+	}
+	if res.Data.ResultType != model.ValMatrix.String() {
+		return nil, errors.Errorf("unexpected result type %s", res.Data.ResultType)
+	}
+
+	series := make([]*refSeries, 0, len(res.Data.Result))
+	for _, ss := range res.Data.Result {
+		lb := labels.NewBuilder(nil)
+		for n, v := range ss.Metric {
+			lb.Set(string(n), string(v))
+		}
+		s := &refSeries{lset: lb.Labels()}
+		for _, p := range ss.Values {
+			if t := int64(p.Timestamp); t >= mint && t <= maxt {
+				s.ts = append(s.ts, t)
+				s.vs = append(s.vs, float64(p.Value))
+			}
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
+
+func (r *apiReference) Close() error { return nil }
+
+// comparer holds the samples evaluated for the rules by their index and
+// series until they are compared with the reference.
+type comparer struct {
+	ref reference
+	// window is the maximum distance of paired samples in milliseconds.
+	window int64
+	// tolerance is the relative difference up to which values match.
+	tolerance float64
+	samples   map[int]map[uint64]*refSeries
+}
+
+func newComparer(ref reference, window time.Duration, tolerance float64) *comparer {
+	return &comparer{ref: ref, window: window.Milliseconds(), tolerance: tolerance, samples: map[int]map[uint64]*refSeries{}}
+}
+
+// add adds an evaluated sample of the rule with index idx. The samples of a
+// series have to be added in order.
+func (c *comparer) add(idx int, lset labels.Labels, t int64, v float64) {
+	series, ok := c.samples[idx]
+	if !ok {
+		series = map[uint64]*refSeries{}
+		c.samples[idx] = series
+	}
+	h := lset.Hash()
+	s, ok := series[h]
+	if !ok {
+		s = &refSeries{lset: lset}
+		series[h] = s
+	}
+	s.ts = append(s.ts, t)
+	s.vs = append(s.vs, v)
+}
+
+// compare compares the evaluated samples of the rule with index idx with the
+// reference on its steps, and drops them.
+func (c *comparer) compare(ctx context.Context, rule *recordingRule, idx int, steps evalSteps) (RuleComparison, error) {
+	rc := RuleComparison{Group: rule.group, Name: rule.name}
+	evaluated := c.samples[idx]
+	delete(c.samples, idx)
+	if steps.first > steps.last {
+		return rc, nil
+	}
+
+	refs, err := c.ref.series(ctx, steps.first-c.window, steps.last+c.window, rule.recordedMatchers())
+	if err != nil {
+		return rc, err
+	}
+	var sumAbs, sumRel float64
+	var diffs int
+	for _, ref := range refs {
+		h := ref.lset.Hash()
+		paired := make([]bool, len(ref.ts))
+		if ev, ok := evaluated[h]; ok {
+			delete(evaluated, h)
+			for i, t := range ev.ts {
+				j := nearestSample(ref.ts, t, c.window)
+				if j < 0 {
+					rc.OnlyBackfilled++
+					continue
+				}
+				paired[j] = true
+				a, b := ev.vs[i], ref.vs[j]
+				if math.IsNaN(a) || math.IsNaN(b) {
+					// NaN only matches NaN, and has no difference.
+					if math.IsNaN(a) && math.IsNaN(b) {
+						rc.Matched++
+					} else {
+						rc.Mismatched++
+					}
+					continue
+				}
+				abs, rel := math.Abs(a-b), 0.0
+				if abs > 0 {
+					rel = abs / math.Max(math.Abs(a), math.Abs(b))
+				}
+				if rel <= c.tolerance {
+					rc.Matched++
+				} else {
+					rc.Mismatched++
+				}
+				sumAbs += abs
+				sumRel += rel
+				diffs++
+				rc.MaxAbsDiff = math.Max(rc.MaxAbsDiff, abs)
+				rc.MaxRelDiff = math.Max(rc.MaxRelDiff, rel)
+				if rel > c.tolerance {
+					rc.Worst = append(rc.Worst, SampleDiff{Series: ref.lset.String(), T: timestamp.Time(t), RefT: timestamp.Time(ref.ts[j]), Backfilled: a, Reference: b})
+					if len(rc.Worst) > 4*compareExamples {
+						rc.Worst = worstDiffs(rc.Worst)
+					}
+				}
+			}
+		}
+		// Reference samples away from the steps, e.g. outside of filled gaps,
+		// aren't expected to be backfilled.
+		for j, t := range ref.ts {
+			if !paired[j] && steps.from(t-c.window) <= t+c.window {
+				rc.OnlyReference++
+			}
+		}
+	}
+	for _, ev := range evaluated {
+		rc.OnlyBackfilled += len(ev.ts)
+	}
+	if diffs > 0 {
+		rc.MeanAbsDiff = sumAbs / float64(diffs)
+		rc.MeanRelDiff = sumRel / float64(diffs)
+	}
+	rc.Worst = worstDiffs(rc.Worst)
+	return rc, nil
+}
+
+// nearestSample returns the index of the sample in the sorted timestamps ts
+// nearest to t, -1 if there is none within window.
+func nearestSample(ts []int64, t, window int64) int {
+	i := sort.Search(len(ts), func(i int) bool { return ts[i] >= t })
+	best := -1
+	if i < len(ts) && ts[i]-t <= window {
+		best = i
+	}
+	if i > 0 && t-ts[i-1] <= window && (best < 0 || t-ts[i-1] < ts[best]-t) {
+		best = i - 1
+	}
+	return best
+}
+
+// worstDiffs returns the compareExamples diffs with the largest absolute differences.
+func worstDiffs(diffs []SampleDiff) []SampleDiff {
+	sort.SliceStable(diffs, func(i, j int) bool {
+		return math.Abs(diffs[i].Backfilled-diffs[i].Reference) > math.Abs(diffs[j].Backfilled-diffs[j].Reference)
+	})
+	if len(diffs) > compareExamples {
+		diffs = diffs[:compareExamples]
+	}
+	return diffs
+}
+
+// checkMismatchRate returns ErrCompareMismatch listing the rules whose
+// samples mismatch the reference more often than maxRate.
+func checkMismatchRate(comparisons []RuleComparison, maxRate float64) error {
+	var failed []string
+	for _, rc := range comparisons {
+		if rc.MismatchRate() > maxRate {
+			failed = append(failed, rc.Group+"/"+rc.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return errors.Wrapf(ErrCompareMismatch, "rules %s mismatch more often than the rate of %v", strings.Join(failed, ","), maxRate)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package backfill
+
+import (
+	"path/filepath"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// tombstoneBlocks deletes the series of every rule over its range from the
+// given blocks in dir, which were created by a previous backfill, by writing
+// tombstones into them. Queries skip the deleted samples, and compaction
+// removes them. shift is the timestamp shift of the samples in milliseconds.
+func tombstoneBlocks(dir string, blocks []string, rules []*recordingRule, endExclusive bool, shift int64, logger log.Logger) error {
+	for _, id := range blocks {
+		blockDir := filepath.Join(dir, id)
+		// Block.Delete rewrites the meta.json without the backfiller marker.
+		m, err := readBlockMeta(blockDir)
+		if err != nil {
+			return err
+		}
+		b, err := tsdb.OpenBlock(logger, blockDir, nil)
+		if err != nil {
+			return errors.Wrapf(err, "open block %s", id)
+		}
+		before := b.Meta().Stats.NumTombstones
+		for _, rule := range rules {
+			mint, maxt := timestamp.FromTime(rule.tr.start)+shift, rule.tr.lastEval(endExclusive)+shift
+			// Block ranges are half-open.
+			if mint >= b.MaxTime() || maxt < b.MinTime() {
+				continue
+			}
+			if err := b.Delete(mint, maxt, rule.recordedMatchers()...); err != nil {
+				b.Close()
+				return errors.Wrapf(err, "delete series of rule %s from block %s", rule.name, id)
+			}
+		}
+		after := b.Meta().Stats.NumTombstones
+		if err := b.Close(); err != nil {
+			return errors.Wrapf(err, "close block %s", id)
+		}
+
+		backfilled := m.Backfiller
+		if m, err = readBlockMeta(blockDir); err != nil {
+			return err
+		}
+		m.Backfiller = backfilled
+		if err := writeBlockMeta(blockDir, m); err != nil {
+			return errors.Wrapf(err, "restore marker of block %s", id)
+		}
+		level.Info(logger).Log("msg", "wrote tombstones for the corrected series into block", "block", id, "tombstones", after-before)
+	}
+	return nil
+}
+
+// withoutBlocks returns the blocks that aren't in drop.
+func withoutBlocks(blocks, drop []string) []string {
+	var res []string
+	for _, b := range blocks {
+		found := false
+		for _, d := range drop {
+			found = found || b == d
+		}
+		if !found {
+			res = append(res, b)
+		}
+	}
+	return res
+}
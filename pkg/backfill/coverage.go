@@ -0,0 +1,111 @@
+package backfill
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// BlockInfo describes a block of a TSDB in its coverage. Like in the block's
+// meta.json, MaxTime is exclusive.
+type BlockInfo struct {
+	ULID       string `json:"ulid"`
+	MinTime    int64  `json:"minTime"`
+	MaxTime    int64  `json:"maxTime"`
+	NumSamples uint64 `json:"numSamples"`
+	NumSeries  uint64 `json:"numSeries"`
+	// Size is the size of the block on disk in bytes.
+	Size int64 `json:"size"`
+}
+
+// CoverageGap is a window between the blocks of a TSDB without data.
+type CoverageGap struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// Coverage is the data a TSDB contains, to check which range can be backfilled
+// from it.
+type Coverage struct {
+	// Blocks are the persisted blocks ordered by time.
+	Blocks []BlockInfo `json:"blocks"`
+	// Head is the data in the WAL, nil if there is none. Its ULID is empty
+	// and its Size is the size of the WAL.
+	Head *BlockInfo `json:"head,omitempty"`
+	// Gaps are the windows between the blocks and the head longer than the
+	// gap threshold.
+	Gaps []CoverageGap `json:"gaps"`
+	// MinTime and MaxTime are the oldest and newest timestamps in the TSDB,
+	// the range the backfill range defaults to and is clamped by.
+	MinTime int64 `json:"minTime"`
+	MaxTime int64 `json:"maxTime"`
+}
+
+// ReadCoverage reads the blocks and the WAL of the TSDB in dir without
+// writing to it, and reports the gaps between them longer than gapThreshold.
+func ReadCoverage(dir string, gapThreshold time.Duration, logger log.Logger) (*Coverage, error) {
+	s, err := openFlushedSource(dir, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	c := &Coverage{Blocks: []BlockInfo{}, Gaps: []CoverageGap{}, MinTime: s.MinTime(), MaxTime: s.MaxTime()}
+	for _, b := range s.blocks {
+		m := b.Meta()
+		info := BlockInfo{
+			ULID:       m.ULID.String(),
+			MinTime:    m.MinTime,
+			MaxTime:    m.MaxTime,
+			NumSamples: m.Stats.NumSamples,
+			NumSeries:  m.Stats.NumSeries,
+			Size:       b.Size(),
+		}
+		// The WAL is flushed into a block in a temporary directory.
+		if s.dir != "" && filepath.Dir(b.Dir()) == s.dir {
+			info.ULID = ""
+			if info.Size, err = dirSize(filepath.Join(dir, "wal")); err != nil {
+				return nil, err
+			}
+			c.Head = &info
+			continue
+		}
+		c.Blocks = append(c.Blocks, info)
+	}
+	sort.Slice(c.Blocks, func(i, j int) bool { return c.Blocks[i].MinTime < c.Blocks[j].MinTime })
+
+	ranges := c.Blocks
+	if c.Head != nil {
+		ranges = append(ranges[:len(ranges):len(ranges)], *c.Head)
+		sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].MinTime < ranges[j].MinTime })
+	}
+	// end is the end of the data before the current range, which may be
+	// overlapped by the ranges after it.
+	end := int64(math.MinInt64)
+	for i, r := range ranges {
+		if i > 0 && r.MinTime-end > gapThreshold.Milliseconds() {
+			c.Gaps = append(c.Gaps, CoverageGap{Start: end, End: r.MinTime})
+		}
+		end = max(end, r.MaxTime)
+	}
+	return c, nil
+}
+
+// dirSize returns the size of the files in dir and its subdirectories.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
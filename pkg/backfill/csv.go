@@ -0,0 +1,64 @@
+package backfill
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// csvWriter writes evaluated samples as CSV rows instead of blocks. The
+// selected label columns get a dedicated column each, the remaining labels are
+// serialized into a single labels column unless they are dropped.
+type csvWriter struct {
+	w               *csv.Writer
+	columns         []string
+	dropOtherLabels bool
+}
+
+func newCSVWriter(w io.Writer, columns []string, dropOtherLabels bool) (*csvWriter, error) {
+	c := &csvWriter{w: csv.NewWriter(w), columns: columns, dropOtherLabels: dropOtherLabels}
+
+	header := append([]string{"metric"}, columns...)
+	if !dropOtherLabels {
+		header = append(header, "labels")
+	}
+	header = append(header, "timestamp", "timestamp_ms", "value")
+	if err := c.w.Write(header); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *csvWriter) write(samples []*tsdb.MetricSample) error {
+	for _, s := range samples {
+		row := make([]string, 0, len(c.columns)+5)
+		row = append(row, s.Labels.Get(labels.MetricName))
+		for _, col := range c.columns {
+			row = append(row, s.Labels.Get(col))
+		}
+		if !c.dropOtherLabels {
+			row = append(row, c.otherLabels(s.Labels).String())
+		}
+		row = append(row,
+			timestamp.Time(s.TimestampMs).Format(time.RFC3339Nano),
+			strconv.FormatInt(s.TimestampMs, 10),
+			strconv.FormatFloat(s.Value, 'f', -1, 64),
+		)
+		if err := c.w.Write(row); err != nil {
+			return err
+		}
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// otherLabels returns the labels that don't have a dedicated column.
+func (c *csvWriter) otherLabels(lset labels.Labels) labels.Labels {
+	names := append([]string{labels.MetricName}, c.columns...)
+	return labels.NewBuilder(lset).Del(names...).Labels()
+}
@@ -0,0 +1,141 @@
+package backfill
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+)
+
+// stagingDir is the directory inside the destination that blocks are created
+// in before they are moved into place, so a Prometheus server on the
+// destination never sees a partially written block. Prometheus ignores it as
+// it isn't a valid ULID.
+const stagingDir = ".staging"
+
+// quarantineDir is the directory inside the destination that blocks without a
+// valid meta.json are moved into, which Prometheus would fail to load.
+const quarantineDir = ".quarantine"
+
+// isPrometheusDataDir reports whether dir looks like the data directory of a
+// Prometheus server, i.e. has a lock file or a WAL.
+func isPrometheusDataDir(dir string) (bool, error) {
+	for _, name := range []string{"lock", "wal"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true, nil
+		} else if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// isLocked reports whether the lock file in dir is held, which means a
+// Prometheus server is running on it.
+func isLocked(dir string) (bool, error) {
+	lockf := filepath.Join(dir, "lock")
+	if _, err := os.Stat(lockf); os.IsNotExist(err) {
+		return false, nil
+	}
+	r, _, err := fileutil.Flock(lockf)
+	if err != nil {
+		return true, nil
+	}
+	return false, r.Release()
+}
+
+// headMinTime returns the start of the head block of the data directory dir,
+// which is the end of its newest persisted block.
+func headMinTime(dir string) (int64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	found := false
+	var mint int64
+	for _, f := range files {
+		if _, err := ulid.ParseStrict(f.Name()); err != nil || !f.IsDir() {
+			continue
+		}
+		m, err := readBlockMeta(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return 0, errors.Wrapf(err, "read meta of block %s", f.Name())
+		}
+		if !found || m.MaxTime > mint {
+			mint = m.MaxTime
+		}
+		found = true
+	}
+	if !found {
+		return 0, errors.New("no persisted blocks, so the range of the head block is unknown")
+	}
+	return mint, nil
+}
+
+// publishBlock moves the block with the given ID from the staging directory
+// into dir.
+func publishBlock(dir, id string) error {
+	return fileutil.Rename(filepath.Join(dir, stagingDir, id), filepath.Join(dir, id))
+}
+
+// recoverDest removes what a crashed run left in the staging directories of
+// dir and, with tenants, of the tenant directories in it. Blocks are only moved
+// into place once complete, so blocks without a valid meta.json weren't
+// created by the backfiller. They are moved into the quarantine directory
+// instead of being removed.
+func recoverDest(dir string, tenants bool, logger log.Logger) error {
+	dirs := []string{dir}
+	if tenants {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if f.IsDir() && checkTenant(f.Name()) == nil {
+				dirs = append(dirs, filepath.Join(dir, f.Name()))
+			}
+		}
+	}
+
+	for _, d := range dirs {
+		staged, err := ioutil.ReadDir(filepath.Join(d, stagingDir))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, f := range staged {
+			path := filepath.Join(d, stagingDir, f.Name())
+			level.Warn(logger).Log("msg", "removing partially written block left by a previous run", "dir", path)
+			if err := os.RemoveAll(path); err != nil {
+				return errors.Wrapf(err, "remove %s", path)
+			}
+		}
+
+		files, err := ioutil.ReadDir(d)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if _, err := ulid.ParseStrict(f.Name()); err != nil || !f.IsDir() {
+				continue
+			}
+			_, err := readBlockMeta(filepath.Join(d, f.Name()))
+			if err == nil {
+				continue
+			}
+			level.Warn(logger).Log("msg", "moving block without a valid meta.json into quarantine, Prometheus fails to load it", "block", filepath.Join(d, f.Name()), "quarantine", filepath.Join(d, quarantineDir), "err", err)
+			if err := os.MkdirAll(filepath.Join(d, quarantineDir), 0777); err != nil {
+				return err
+			}
+			if err := fileutil.Rename(filepath.Join(d, f.Name()), filepath.Join(d, quarantineDir, f.Name())); err != nil {
+				return errors.Wrapf(err, "quarantine block %s", f.Name())
+			}
+		}
+	}
+	return nil
+}
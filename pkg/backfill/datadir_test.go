@@ -0,0 +1,54 @@
+package backfill
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid"
+)
+
+// TestRecoverStagedBlock checks that a block a crashed run left in the
+// staging directory, with its chunks but without meta.json, is removed by the
+// next run and never published.
+func TestRecoverStagedBlock(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+	src := filepath.Join(dir, "src")
+	writeSource(t, src, upSamples(time.Hour, 15*time.Second))
+	ruleFile := writeFile(t, dir, "rules.yaml", `groups:
+  - name: g
+    rules:
+      - record: job:up:sum
+        expr: sum by (job) (up)
+`)
+	dest := filepath.Join(dir, "dest")
+	staged := filepath.Join(dest, stagingDir, ulid.MustNew(ulid.Now(), nil).String())
+	if err := os.MkdirAll(filepath.Join(staged, "chunks"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(staged, "chunks"), "000001", "partial chunks")
+	writeFile(t, staged, "index", "partial index")
+
+	runBackfill(t, testOptions(ruleFile, src, dest))
+
+	if _, err := os.Stat(staged); !os.IsNotExist(err) {
+		t.Fatalf("expected the staged block to be removed, got %v", err)
+	}
+	ids := blockIDs(t, dest)
+	for _, id := range ids {
+		if id == filepath.Base(staged) {
+			t.Fatalf("the staged block %s was published", id)
+		}
+		if _, err := readBlockMeta(filepath.Join(dest, id)); err != nil {
+			t.Fatalf("published block %s: %v", id, err)
+		}
+	}
+	if len(ids) != 1 {
+		t.Fatalf("expected the block of the run only, got %v", ids)
+	}
+	if _, err := os.Stat(filepath.Join(dest, quarantineDir)); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing to be quarantined, got %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+package backfill
+
+import (
+	"context"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/tsdbutil"
+)
+
+// dedupInitialPenalty is the gap in milliseconds after which a deduplicated
+// series switches to another replica while the interval of its samples isn't
+// known yet.
+const dedupInitialPenalty = 5000
+
+// dedupSource deduplicates the series of the replicas of an HA pair in the
+// wrapped source, e.g. the merged TSDBs of both replicas or a Thanos store.
+// The replica labels are removed from the series, and series that only
+// differed by them are merged like the Thanos querier does: the samples of
+// one replica are used until it has a gap, which is filled by another.
+type dedupSource struct {
+	source
+	replicaLabels map[string]struct{}
+}
+
+func newDedupSource(src source, replicaLabels []string) *dedupSource {
+	s := &dedupSource{source: src, replicaLabels: make(map[string]struct{}, len(replicaLabels))}
+	for _, l := range replicaLabels {
+		s.replicaLabels[l] = struct{}{}
+	}
+	return s
+}
+
+func (s *dedupSource) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	q, err := s.source.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &dedupQuerier{Querier: q, replicaLabels: s.replicaLabels}, nil
+}
+
+type dedupQuerier struct {
+	storage.Querier
+	replicaLabels map[string]struct{}
+}
+
+// Select returns the deduplicated series sorted by their labels, which
+// requires reading all matching series and their samples into memory first.
+func (q *dedupQuerier) Select(_ bool, hints *storage.SelectHints, matchers ...*labels.Matcher) (storage.SeriesSet, storage.Warnings, error) {
+	ss, warns, err := q.Querier.Select(false, hints, matchers...)
+	if err != nil {
+		return nil, warns, err
+	}
+
+	var (
+		series []*dedupSeries
+		byHash = map[uint64][]*dedupSeries{}
+	)
+	for ss.Next() {
+		s := ss.At()
+		lset := q.stripReplicaLabels(s.Labels())
+		h := lset.Hash()
+		var ds *dedupSeries
+		for _, c := range byHash[h] {
+			if labels.Equal(c.lset, lset) {
+				ds = c
+				break
+			}
+		}
+		if ds == nil {
+			ds = &dedupSeries{lset: lset}
+			byHash[h] = append(byHash[h], ds)
+			series = append(series, ds)
+		}
+		samples, err := readSamples(s.Iterator())
+		if err != nil {
+			return nil, warns, errors.Wrapf(err, "read series %s", s.Labels())
+		}
+		if ds.samples == nil {
+			ds.samples = samples
+		} else {
+			ds.samples = dedupSamples(ds.samples, samples)
+		}
+	}
+	if err := ss.Err(); err != nil {
+		return nil, warns, err
+	}
+	sort.Slice(series, func(i, j int) bool { return labels.Compare(series[i].lset, series[j].lset) < 0 })
+	return &dedupSeriesSet{series: series, i: -1}, warns, nil
+}
+
+func (q *dedupQuerier) LabelValues(name string) ([]string, storage.Warnings, error) {
+	if _, ok := q.replicaLabels[name]; ok {
+		return nil, nil, nil
+	}
+	return q.Querier.LabelValues(name)
+}
+
+func (q *dedupQuerier) LabelNames() ([]string, storage.Warnings, error) {
+	names, warns, err := q.Querier.LabelNames()
+	if err != nil {
+		return nil, warns, err
+	}
+	res := names[:0:0]
+	for _, n := range names {
+		if _, ok := q.replicaLabels[n]; !ok {
+			res = append(res, n)
+		}
+	}
+	return res, warns, nil
+}
+
+func (q *dedupQuerier) stripReplicaLabels(lset labels.Labels) labels.Labels {
+	res := make(labels.Labels, 0, len(lset))
+	for _, l := range lset {
+		if _, ok := q.replicaLabels[l.Name]; !ok {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+type dedupSeriesSet struct {
+	series []*dedupSeries
+	i      int
+}
+
+func (s *dedupSeriesSet) Next() bool {
+	s.i++
+	return s.i < len(s.series)
+}
+
+func (s *dedupSeriesSet) At() storage.Series { return s.series[s.i] }
+
+func (s *dedupSeriesSet) Err() error { return nil }
+
+// dedupSeries is a series without replica labels with the deduplicated
+// samples of its replicas.
+type dedupSeries struct {
+	lset    labels.Labels
+	samples []tsdbutil.Sample
+}
+
+func (s *dedupSeries) Labels() labels.Labels { return s.lset }
+
+func (s *dedupSeries) Iterator() chunkenc.Iterator {
+	return storage.NewListSeriesIterator(s.samples)
+}
+
+func readSamples(it chunkenc.Iterator) ([]tsdbutil.Sample, error) {
+	var samples []tsdbutil.Sample
+	for it.Next() {
+		t, v := it.At()
+		samples = append(samples, storeSample{t: t, v: v})
+	}
+	return samples, it.Err()
+}
+
+// dedupSamples merges the samples of two replicas of a series like the
+// Thanos querier. Of the samples of both replicas after the last merged one,
+// it takes the earliest, but skips the samples of the replica that wasn't
+// taken for twice the interval of the last two merged samples. The merged
+// series so doesn't get samples more often than each replica, and it stays
+// with the replica it's on until that has a gap.
+func dedupSamples(a, b []tsdbutil.Sample) []tsdbutil.Sample {
+	var (
+		res        = make([]tsdbutil.Sample, 0, max(int64(len(a)), int64(len(b))))
+		i, j       int
+		lastT      = int64(math.MinInt64)
+		penA, penB int64
+	)
+	for {
+		if lastT != math.MinInt64 {
+			for i < len(a) && a[i].T() <= lastT+penA {
+				i++
+			}
+			for j < len(b) && b[j].T() <= lastT+penB {
+				j++
+			}
+		}
+		if i == len(a) && j == len(b) {
+			return res
+		}
+		useA := i < len(a) && (j == len(b) || a[i].T() <= b[j].T())
+		var next tsdbutil.Sample
+		if useA {
+			next = a[i]
+		} else {
+			next = b[j]
+		}
+		penalty := int64(dedupInitialPenalty)
+		if lastT != math.MinInt64 {
+			penalty = 2 * (next.T() - lastT)
+		}
+		if useA {
+			penA, penB = 0, penalty
+		} else {
+			penA, penB = penalty, 0
+		}
+		res = append(res, next)
+		lastT = next.T()
+	}
+}
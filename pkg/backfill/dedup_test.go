@@ -0,0 +1,76 @@
+package backfill
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// counterSamples returns the samples of a counter increasing by one per
+// second, scraped every 15s for 70m from testStart, except in [gapStart,
+// gapEnd) after testStart.
+func counterSamples(lset labels.Labels, gapStart, gapEnd time.Duration) []*tsdb.MetricSample {
+	var samples []*tsdb.MetricSample
+	for d := time.Duration(0); d < 70*time.Minute; d += 15 * time.Second {
+		if d >= gapStart && d < gapEnd {
+			continue
+		}
+		samples = append(samples, &tsdb.MetricSample{Labels: lset, TimestampMs: testStart + d.Milliseconds(), Value: 1e6 + d.Seconds()})
+	}
+	return samples
+}
+
+// TestDedupReplicasWithGaps checks that the rate of two replicas with gaps at
+// different times, deduplicated, is the rate of a replica without gaps.
+func TestDedupReplicasWithGaps(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+	ruleFile := writeFile(t, dir, "rules.yaml", `groups:
+  - name: g
+    rules:
+      - record: job:requests:rate5m
+        expr: sum by (job) (rate(requests_total[5m]))
+`)
+	replica := func(name string) labels.Labels {
+		return labels.FromStrings("__name__", "requests_total", "job", "api", "replica", name)
+	}
+	// The replicas take turns to have a gap. The samples a switch of the
+	// replicas skips are off the boundaries of the windows of the steps.
+	replicas := filepath.Join(dir, "replicas")
+	writeSource(t, replicas, append(
+		counterSamples(replica("a"), 20*time.Minute+30*time.Second, 30*time.Minute+30*time.Second),
+		counterSamples(replica("b"), 40*time.Minute+30*time.Second, 50*time.Minute+30*time.Second)...,
+	))
+	single := filepath.Join(dir, "single")
+	writeSource(t, single, counterSamples(replica("a"), 0, 0))
+
+	backfill := func(src, dest string, dedupLabels []string) []testSample {
+		opts := testOptions(ruleFile, src, filepath.Join(dir, dest))
+		opts.DedupReplicaLabels = dedupLabels
+		opts.EvalInterval = time.Minute
+		opts.Start, opts.End = "1600000600", "1600003600"
+		runBackfill(t, opts)
+		return readBlocks(t, opts.DestPath)
+	}
+	want := backfill(single, "dest-single", nil)
+	got := backfill(replicas, "dest-dedup", []string{"replica"})
+
+	if len(want) != 51 {
+		t.Fatalf("expected a sample every minute of the range for the single replica, got %d", len(want))
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d samples, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].series != want[i].series || got[i].t != want[i].t || math.Abs(got[i].v-want[i].v) > 1e-9 {
+			t.Fatalf("sample %d of the deduplicated replicas is %+v, want %+v", i, got[i], want[i])
+		}
+		if math.Abs(want[i].v-1) > 1e-9 {
+			t.Fatalf("rate of the single replica at %d is %v, want 1", want[i].t, want[i].v)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package backfill
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+)
+
+// estimatedBytesPerSample is a rough upper bound of the on-disk size of a
+// sample, including its share of the index.
+const estimatedBytesPerSample = 4
+
+// ErrDiskFull is returned when the destination doesn't have enough free
+// space left for the next block.
+var ErrDiskFull = errors.New("not enough free space in destination")
+
+// ErrDiskUsageLimit is returned when the backfill was stopped as the written
+// blocks or the filesystem of the destination exceeded the disk usage limit.
+var ErrDiskUsageLimit = errors.New("disk usage limit exceeded")
+
+// checkDest creates the destination directory if it is missing and makes sure
+// blocks can be written into it by creating and removing a probe file.
+func checkDest(dir string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return errors.Wrap(err, "create destination directory")
+	}
+
+	f, err := ioutil.TempFile(dir, ".backfiller-probe-")
+	if err != nil {
+		return errors.Wrap(err, "destination directory is not writable")
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(f.Name())
+}
+
+// checkDiskUsage refuses to start when the projected size of the backfill
+// exceeds maxUsage (if set) or the free space of the destination, or would
+// fill its filesystem beyond maxPercent (if set).
+func checkDiskUsage(dir string, samples int64, maxUsage uint64, maxPercent float64) error {
+	projected := uint64(samples) * estimatedBytesPerSample
+	if maxUsage > 0 && projected > maxUsage {
+		return errors.Errorf("projected disk usage of %d bytes exceeds the limit of %d bytes", projected, maxUsage)
+	}
+	if maxPercent > 0 {
+		used, total, err := filesystemUsage(dir)
+		if err != nil {
+			return errors.Wrap(err, "get usage of destination filesystem")
+		}
+		if total > 0 && float64(used+projected) > float64(total)*maxPercent/100 {
+			return errors.Errorf("projected disk usage of %d bytes fills the destination filesystem beyond the limit of %g%%", projected, maxPercent)
+		}
+	}
+
+	free, err := freeSpace(dir)
+	if err != nil {
+		return errors.Wrap(err, "get free space of destination")
+	}
+	if projected > free {
+		return errors.Errorf("projected disk usage of %d bytes exceeds the %d bytes free in destination", projected, free)
+	}
+	return nil
+}
+
+// checkFreeSpace makes sure a block of the given number of samples fits into
+// the free space of the destination.
+func checkFreeSpace(dir string, samples int) error {
+	free, err := freeSpace(dir)
+	if err != nil {
+		return errors.Wrap(err, "get free space of destination")
+	}
+	if needed := uint64(samples) * estimatedBytesPerSample; needed > free {
+		return errors.Wrapf(ErrDiskFull, "%d bytes needed, %d bytes free", needed, free)
+	}
+	return nil
+}
+
+// sameDir reports whether both paths resolve to the same directory.
+func sameDir(a, b string) (bool, error) {
+	fa, err := os.Stat(a)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	fb, err := os.Stat(b)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(fa, fb), nil
+}
+
+// overlappingBlocks returns the blocks in dir that overlap [mint, maxt]. With
+// onlyBackfilled, only blocks created by the backfiller are considered.
+func overlappingBlocks(dir string, mint, maxt int64, onlyBackfilled bool) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var overlapping []string
+	for _, f := range files {
+		if _, err := ulid.ParseStrict(f.Name()); err != nil || !f.IsDir() {
+			continue
+		}
+		m, err := readBlockMeta(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "read meta of block %s", f.Name())
+		}
+		// Block ranges are half-open.
+		if m.MinTime > maxt || m.MaxTime <= mint {
+			continue
+		}
+		if onlyBackfilled && (m.Backfiller == nil || m.Backfiller.Source != metaSource) {
+			continue
+		}
+		overlapping = append(overlapping, f.Name())
+	}
+	return overlapping, nil
+}
+
+// diskGuard tracks the size of the written blocks, to stop the backfill once
+// they exceed maxBytes or the filesystem of dir is fuller than maxPercent.
+type diskGuard struct {
+	dir        string
+	maxBytes   uint64
+	maxPercent float64
+
+	mtx     sync.Mutex
+	written uint64
+	err     error
+}
+
+// add accounts the block in blockDir and reports whether a limit is
+// exceeded. Blocks may be added concurrently.
+func (g *diskGuard) add(blockDir string) (bool, error) {
+	size, err := dirSize(blockDir)
+	if err != nil {
+		return false, errors.Wrapf(err, "get size of block %s", blockDir)
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.written += uint64(size)
+	if g.err != nil {
+		return true, nil
+	}
+	if g.maxBytes > 0 && g.written > g.maxBytes {
+		g.err = errors.Wrapf(ErrDiskUsageLimit, "%d bytes written, more than the limit of %d bytes", g.written, g.maxBytes)
+	} else if g.maxPercent > 0 {
+		used, total, err := filesystemUsage(g.dir)
+		if err != nil {
+			return false, errors.Wrap(err, "get usage of destination filesystem")
+		}
+		if total > 0 && float64(used) > float64(total)*g.maxPercent/100 {
+			g.err = errors.Wrapf(ErrDiskUsageLimit, "destination filesystem is %.1f%% full, more than the limit of %g%%", float64(used)/float64(total)*100, g.maxPercent)
+		}
+	}
+	return g.err != nil, nil
+}
+
+// state returns the bytes written and the error once a limit was exceeded.
+func (g *diskGuard) state() (uint64, error) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return g.written, g.err
+}
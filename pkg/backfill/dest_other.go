@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package backfill
+
+import "math"
+
+// freeSpace is not implemented on this platform, the disk space checks
+// always pass.
+func freeSpace(dir string) (uint64, error) {
+	return math.MaxUint64, nil
+}
+
+// filesystemUsage is not implemented on this platform, the total of 0 makes
+// the usage checks pass.
+func filesystemUsage(dir string) (used, total uint64, err error) {
+	return 0, 0, nil
+}
@@ -0,0 +1,67 @@
+package backfill
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOverlappingRuns(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+	src := filepath.Join(dir, "src")
+	writeSource(t, src, upSamples(2*time.Hour, 15*time.Second))
+	ruleFile := writeFile(t, dir, "rules.yaml", `groups:
+  - name: g
+    rules:
+      - record: job:up:sum
+        expr: sum by (job) (up)
+`)
+	// at returns the time s seconds after testStart.
+	at := func(s int64) string { return strconv.FormatInt(testStart+s*time.Second.Milliseconds(), 10) + "ms" }
+
+	for _, tc := range []struct {
+		name         string
+		endExclusive bool
+		// The ranges of two runs into the same destination, in seconds after
+		// testStart, evaluated every 30s.
+		first, second [2]int64
+		refused       bool
+	}{
+		{name: "rerun", first: [2]int64{600, 2400}, second: [2]int64{600, 2400}, refused: true},
+		{name: "overlapping", first: [2]int64{600, 2400}, second: [2]int64{1800, 3600}, refused: true},
+		{name: "sharing the last step", first: [2]int64{600, 2400}, second: [2]int64{2400, 3600}, refused: true},
+		{name: "disjoint", first: [2]int64{600, 2400}, second: [2]int64{3000, 3600}},
+		{name: "disjoint before", first: [2]int64{3000, 3600}, second: [2]int64{600, 2400}},
+		// The second run starts at the step after the last one of the first.
+		{name: "adjacent", first: [2]int64{600, 2400}, second: [2]int64{2430, 3600}},
+		// The first run doesn't evaluate its end, where the second starts.
+		{name: "adjacent half-open", endExclusive: true, first: [2]int64{600, 2400}, second: [2]int64{2400, 3600}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dest := filepath.Join(dir, strings.Replace(tc.name, " ", "-", -1))
+			opts := testOptions(ruleFile, src, dest)
+			opts.EndExclusive = tc.endExclusive
+			opts.Start, opts.End = at(tc.first[0]), at(tc.first[1])
+			runBackfill(t, opts)
+
+			opts.Start, opts.End = at(tc.second[0]), at(tc.second[1])
+			_, err := New(nil, nil).Run(context.Background(), opts)
+			if tc.refused {
+				if err == nil || !strings.Contains(err.Error(), "overlap the backfill range") {
+					t.Fatalf("expected the second run to be refused, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(blockIDs(t, dest)), 2; got != want {
+				t.Fatalf("expected %d blocks, got %d", want, got)
+			}
+		})
+	}
+}
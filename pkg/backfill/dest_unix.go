@@ -0,0 +1,26 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package backfill
+
+import "syscall"
+
+// freeSpace returns the number of bytes available to unprivileged users on
+// the filesystem of dir.
+func freeSpace(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
+
+// filesystemUsage returns the used and total bytes of the filesystem of dir.
+func filesystemUsage(dir string) (used, total uint64, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, 0, err
+	}
+	total = uint64(stat.Blocks) * uint64(stat.Bsize)
+	return total - uint64(stat.Bfree)*uint64(stat.Bsize), total, nil
+}
@@ -0,0 +1,93 @@
+package backfill
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+)
+
+// contentHash returns the SHA-256 of the samples of a block, independent of
+// the order they were appended in: they are hashed ordered by series and
+// timestamp, like the block stores them.
+func contentHash(mss []*tsdb.MetricSample) []byte {
+	sorted := make([]*tsdb.MetricSample, len(mss))
+	copy(sorted, mss)
+	sort.Slice(sorted, func(i, j int) bool {
+		if c := labels.Compare(sorted[i].Labels, sorted[j].Labels); c != 0 {
+			return c < 0
+		}
+		return sorted[i].TimestampMs < sorted[j].TimestampMs
+	})
+
+	h := sha256.New()
+	buf := make([]byte, 16)
+	for _, s := range sorted {
+		for _, l := range s.Labels {
+			h.Write([]byte(l.Name))
+			h.Write([]byte{0xff})
+			h.Write([]byte(l.Value))
+			h.Write([]byte{0xff})
+		}
+		binary.BigEndian.PutUint64(buf, uint64(s.TimestampMs))
+		binary.BigEndian.PutUint64(buf[8:], math.Float64bits(s.Value))
+		h.Write(buf)
+	}
+	return h.Sum(nil)
+}
+
+// contentULID derives the ULID of a block from its min time and content hash,
+// so identical blocks get the same ULID.
+func contentULID(minTime int64, hash []byte) (ulid.ULID, error) {
+	var id ulid.ULID
+	if err := id.SetTime(uint64(max(minTime, 0))); err != nil {
+		return id, err
+	}
+	copy(id[6:], hash)
+	return id, nil
+}
+
+// renameBlock gives the block in dir, in the staging directory, the ULID
+// derived from the hash of its samples, which is recorded in its meta.json.
+// It returns the new directory of the block. It fails if the parent of the
+// staging directory has a block of that ULID, i.e. of the same samples.
+func renameBlock(dir string, mss []*tsdb.MetricSample) (string, error) {
+	m, err := readBlockMeta(dir)
+	if err != nil {
+		return "", err
+	}
+	hash := contentHash(mss)
+	id, err := contentULID(m.MinTime, hash)
+	if err != nil {
+		return "", err
+	}
+	if m.Backfiller == nil {
+		m.Backfiller = &backfillerMeta{}
+	}
+	m.Backfiller.ContentHash = hex.EncodeToString(hash)
+	m.ULID = id
+	m.Compaction.Sources = []ulid.ULID{id}
+	if err := writeBlockMeta(dir, m); err != nil {
+		return "", err
+	}
+
+	staging := filepath.Dir(dir)
+	if _, err := os.Stat(filepath.Join(filepath.Dir(staging), id.String())); err == nil {
+		os.RemoveAll(dir)
+		return "", errors.Errorf("block %s with the same samples exists already", id)
+	}
+	newDir := filepath.Join(staging, id.String())
+	if err := fileutil.Rename(dir, newDir); err != nil {
+		return "", err
+	}
+	return newDir, nil
+}
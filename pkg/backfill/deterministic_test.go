@@ -0,0 +1,115 @@
+package backfill
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// TestReproducibleRuns checks that two runs of the same backfill write the
+// same samples, and with Options.Deterministic byte-identical blocks with the
+// same ULIDs, with both range and instant queries.
+func TestReproducibleRuns(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+	src := filepath.Join(dir, "src")
+	var samples []*tsdb.MetricSample
+	for i := 0; i < 20; i++ {
+		lset := labels.FromStrings("__name__", "requests_total", "job", "api", "instance", "host-"+strconv.Itoa(i%7), "path", "/"+strconv.Itoa(i))
+		for d := time.Duration(0); d < time.Hour; d += 15 * time.Second {
+			samples = append(samples, &tsdb.MetricSample{Labels: lset, TimestampMs: testStart + d.Milliseconds(), Value: float64(i) * d.Seconds()})
+		}
+	}
+	writeSource(t, src, samples)
+	// The rule labels are given out of order, one of them a template.
+	ruleFile := writeFile(t, dir, "rules.yaml", `groups:
+  - name: g
+    rules:
+      - record: path:requests:rate1m
+        expr: rate(requests_total[1m])
+        labels:
+          zone: b
+          team: core
+          env: prod
+      - record: instance:requests:rate1m
+        expr: sum by (instance, job) (rate(requests_total[1m]))
+        labels:
+          source: '{{ $labels.instance }}'
+          env: prod
+`)
+
+	for _, rangeQueries := range []bool{true, false} {
+		t.Run("range queries "+strconv.FormatBool(rangeQueries), func(t *testing.T) {
+			run := func(dest string, deterministic bool) (string, []testSample) {
+				opts := testOptions(ruleFile, src, filepath.Join(dir, dest))
+				opts.Start, opts.End = "1600000600", "1600003000"
+				opts.RangeQueries = rangeQueries
+				opts.Deterministic = deterministic
+				// Several blocks, each with a part of the series of a step.
+				opts.MaxSamplesInMem = 500
+				runBackfill(t, opts)
+				return opts.DestPath, readBlocks(t, opts.DestPath)
+			}
+			name := strconv.FormatBool(rangeQueries)
+			first, want := run("first-"+name, true)
+			second, got := run("second-"+name, true)
+			_, random := run("random-"+name, false)
+
+			if len(want) == 0 {
+				t.Fatal("expected samples")
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatal("the samples of the second run differ")
+			}
+			if !reflect.DeepEqual(random, want) {
+				t.Fatal("the samples of a run without deterministic ULIDs differ")
+			}
+			ids := blockIDs(t, first)
+			if len(ids) < 2 {
+				t.Fatalf("expected several blocks, got %v", ids)
+			}
+			if got := blockIDs(t, second); !reflect.DeepEqual(got, ids) {
+				t.Fatalf("ULIDs %v of the second run, want %v", got, ids)
+			}
+			for _, id := range ids {
+				for _, f := range []string{"index", "meta.json", filepath.Join("chunks", "000001")} {
+					a, err := ioutil.ReadFile(filepath.Join(first, id, f))
+					if err != nil {
+						t.Fatal(err)
+					}
+					b, err := ioutil.ReadFile(filepath.Join(second, id, f))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(a, b) {
+						t.Fatalf("%s of block %s differs between the runs", f, id)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestContentHashIgnoresOrder(t *testing.T) {
+	a, b := labels.FromStrings("__name__", "a"), labels.FromStrings("__name__", "b")
+	mss := []*tsdb.MetricSample{
+		{Labels: a, TimestampMs: 1, Value: 1},
+		{Labels: a, TimestampMs: 2, Value: 2},
+		{Labels: b, TimestampMs: 1, Value: 3},
+	}
+	shuffled := []*tsdb.MetricSample{mss[2], mss[1], mss[0]}
+	if !bytes.Equal(contentHash(mss), contentHash(shuffled)) {
+		t.Fatal("the hash depends on the order of the samples")
+	}
+	changed := []*tsdb.MetricSample{mss[0], mss[1], {Labels: b, TimestampMs: 1, Value: 4}}
+	if bytes.Equal(contentHash(mss), contentHash(changed)) {
+		t.Fatal("the hash doesn't depend on the values of the samples")
+	}
+}
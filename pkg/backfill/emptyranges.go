@@ -0,0 +1,129 @@
+package backfill
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// emptyRangeChunk is the range of steps checked for source data at once with
+// Options.SkipEmptyRanges.
+const emptyRangeChunk = time.Hour
+
+// emptyRun is a run of steps from first to last at which a rule can't produce
+// samples, as the source has no data for its selectors. prev is the step
+// before first, if any.
+type emptyRun struct {
+	prev, first, last, steps int64
+}
+
+// emptyRuns returns the runs of the steps of the rule, in chunks of
+// emptyRangeChunk, at which none of its selectors has samples in the range
+// its expression reads, including the lookback before each step. Rules that
+// may produce samples without source data, like absent(), have none.
+func emptyRuns(ctx context.Context, q storage.Queryable, rule *recordingRule, steps evalSteps) ([]emptyRun, error) {
+	if !rule.needsSourceData() {
+		return nil, nil
+	}
+	sets := rule.selectors()
+	offset := rule.queryOffset.Milliseconds()
+	lookback := rule.lookback().Milliseconds()
+
+	var (
+		runs      []emptyRun
+		prevEmpty bool
+		prev      = steps.first - 1
+	)
+	for cs := steps.first; cs <= steps.last; {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		ce, n := cs, int64(1)
+		for t := steps.next(cs); t <= steps.last && t < cs+emptyRangeChunk.Milliseconds(); t = steps.next(t) {
+			ce, n = t, n+1
+		}
+		has, err := hasSamples(ctx, q, sets, cs-offset-lookback, ce-offset)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case has:
+		case prevEmpty:
+			runs[len(runs)-1].last = ce
+			runs[len(runs)-1].steps += n
+		default:
+			runs = append(runs, emptyRun{prev: prev, first: cs, last: ce, steps: n})
+		}
+		prevEmpty = !has
+		prev, cs = ce, steps.next(ce)
+	}
+	return runs, nil
+}
+
+// hasSamples reports whether a series matching any of the sets of matchers
+// has a sample in [mint, maxt].
+func hasSamples(ctx context.Context, q storage.Queryable, sets [][]*labels.Matcher, mint, maxt int64) (bool, error) {
+	querier, err := q.Querier(ctx, mint, maxt)
+	if err != nil {
+		return false, err
+	}
+	defer querier.Close()
+
+	for _, matchers := range sets {
+		ss, _, err := querier.Select(false, &storage.SelectHints{Start: mint, End: maxt}, matchers...)
+		if err != nil {
+			return false, err
+		}
+		for ss.Next() {
+			it := ss.At().Iterator()
+			if it.Seek(mint) {
+				if t, _ := it.At(); t <= maxt {
+					return true, nil
+				}
+			}
+			if err := it.Err(); err != nil {
+				return false, err
+			}
+		}
+		if err := ss.Err(); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// noDataFuncs are the functions that return samples without source data.
+var noDataFuncs = map[string]bool{
+	"absent":           true,
+	"absent_over_time": true,
+	"vector":           true,
+}
+
+// needsSourceData reports whether the rule only produces samples when its
+// selectors have data. Rules with selectors may still produce samples
+// without data if they return a scalar, or use absent(), vector() or a
+// function that defaults to the evaluation time, like hour().
+func (r *recordingRule) needsSourceData() bool {
+	if len(r.selectors()) == 0 || r.vector.Type() == parser.ValueTypeScalar {
+		return false
+	}
+	needs := true
+	parser.Inspect(r.vector, func(node parser.Node, _ []parser.Node) error {
+		if c, ok := node.(*parser.Call); ok && (noDataFuncs[c.Func.Name] || len(c.Args) == 0) {
+			needs = false
+		}
+		return nil
+	})
+	return needs
+}
+
+// emptyRunAt returns the run of runs containing step t, and the index of the
+// first run after t otherwise.
+func emptyRunAt(runs []emptyRun, t int64) (int, bool) {
+	i := sort.Search(len(runs), func(i int) bool { return runs[i].last >= t })
+	return i, i < len(runs) && runs[i].first <= t
+}
@@ -0,0 +1,117 @@
+package backfill
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+)
+
+// RuleEstimate is the projected output of a rule in estimate mode,
+// extrapolated from its evaluations at a few sampled steps. It's an
+// approximation: rules whose number of series changes over the range have a
+// large StddevSeries, and their projection is less reliable.
+type RuleEstimate struct {
+	Group string
+	Name  string
+	// Queries is the number of successful evaluations the estimate is based
+	// on, Errors the number of failed ones.
+	Queries, Errors int
+	// Steps is the number of evaluations of the full backfill.
+	Steps int64
+	// AvgSeries is the average number of series of the sampled evaluations,
+	// StddevSeries their standard deviation.
+	AvgSeries, StddevSeries float64
+	// AvgLatency is the average latency of the sampled evaluations.
+	AvgLatency time.Duration
+	// Samples, Bytes and Duration are the projected number of samples,
+	// on-disk size and evaluation time of the full range.
+	Samples  int64
+	Bytes    int64
+	Duration time.Duration
+}
+
+// estimate evaluates every rule at opts.Estimate steps evenly spaced across
+// its range and projects the samples, size and evaluation time of the full
+// backfill from their results.
+func (b *Backfiller) estimate(ctx context.Context, rules []*recordingRule, opts Options, engines *queryEngines) ([]RuleEstimate, error) {
+	res := make([]RuleEstimate, 0, len(rules))
+	for _, rule := range rules {
+		steps := rule.evalSteps(opts)
+		re := RuleEstimate{
+			Group: rule.group,
+			Name:  rule.name,
+			Steps: steps.count(),
+		}
+		if re.Steps <= 0 {
+			res = append(res, re)
+			continue
+		}
+
+		queryFunc := engines.queryFunc(rule)
+		var (
+			series  []float64
+			latency time.Duration
+			prev    = int64(-1)
+		)
+		for i := 0; i < opts.Estimate; i++ {
+			if err := ctx.Err(); err != nil {
+				return res, err
+			}
+			// Sample the steps that are actually evaluated, each once.
+			var k int64
+			if opts.Estimate > 1 {
+				k = int64(i) * (re.Steps - 1) / int64(opts.Estimate-1)
+			}
+			if k == prev {
+				continue
+			}
+			prev = k
+			t := steps.at(k)
+
+			began := time.Now()
+			vector, err := queryFunc(ctx, rule.vector.String(), timestamp.Time(t-rule.queryOffset.Milliseconds()))
+			if err != nil {
+				level.Warn(b.logger).Log("msg", "estimate query failed", "rule", rule.name, "t", timestamp.Time(t), "err", err)
+				re.Errors++
+				continue
+			}
+			latency += time.Since(began)
+			series = append(series, float64(len(vector)))
+		}
+		if len(series) == 0 {
+			res = append(res, re)
+			continue
+		}
+
+		re.Queries = len(series)
+		re.AvgSeries, re.StddevSeries = meanStddev(series)
+		re.AvgLatency = latency / time.Duration(re.Queries)
+		re.Samples = int64(math.Round(re.AvgSeries * float64(re.Steps)))
+		re.Bytes = re.Samples * estimatedBytesPerSample
+		re.Duration = re.AvgLatency * time.Duration(re.Steps)
+		level.Debug(b.logger).Log("msg", "estimated rule", "rule", rule.name, "group", rule.group, "queries", re.Queries, "avg_series", re.AvgSeries, "stddev_series", re.StddevSeries, "samples", re.Samples)
+		res = append(res, re)
+	}
+	if len(res) == 0 {
+		return nil, errors.New("no rules to estimate")
+	}
+	return res, nil
+}
+
+// meanStddev returns the mean and the population standard deviation of xs.
+func meanStddev(xs []float64) (float64, float64) {
+	var sum float64
+	for _, x := range xs {
+		sum += x
+	}
+	mean := sum / float64(len(xs))
+	var sq float64
+	for _, x := range xs {
+		sq += (x - mean) * (x - mean)
+	}
+	return mean, math.Sqrt(sq / float64(len(xs)))
+}
@@ -0,0 +1,153 @@
+package backfill
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+)
+
+// Failure is an evaluation step of a rule whose query failed, as written to
+// Options.FailuresFile.
+type Failure struct {
+	Group string `json:"group"`
+	Rule  string `json:"rule"`
+	// Timestamp is the step in milliseconds, Time the same for readers.
+	Timestamp int64     `json:"timestamp"`
+	Time      time.Time `json:"time"`
+	Error     string    `json:"error"`
+}
+
+// failureWriter appends failures as JSON lines to a file.
+type failureWriter struct {
+	f *os.File
+	w *bufio.Writer
+	n int
+}
+
+// createFailureWriter creates or truncates the failures file at path. The
+// methods of a nil failureWriter do nothing.
+func createFailureWriter(path string) (*failureWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &failureWriter{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// add writes a failure of the rule at step t.
+func (w *failureWriter) add(rule *recordingRule, t int64, evalErr error) error {
+	if w == nil {
+		return nil
+	}
+	return w.write(Failure{Group: rule.group, Rule: rule.name, Timestamp: t, Time: timestamp.Time(t), Error: evalErr.Error()})
+}
+
+func (w *failureWriter) write(f Failure) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if _, err := w.w.Write(append(b, '\n')); err != nil {
+		return errors.Wrap(err, "write failure")
+	}
+	w.n++
+	return nil
+}
+
+func (w *failureWriter) Close() error {
+	if w == nil {
+		return nil
+	}
+	if err := w.w.Flush(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// loadFailures reads the failures in the JSON lines file written with
+// Options.FailuresFile. Empty lines are skipped.
+func loadFailures(path string) ([]Failure, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var failures []Failure
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for n := 1; sc.Scan(); n++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var fl Failure
+		if err := json.Unmarshal(sc.Bytes(), &fl); err != nil {
+			return nil, errors.Wrapf(err, "line %d", n)
+		}
+		failures = append(failures, fl)
+	}
+	return failures, sc.Err()
+}
+
+// retryFailures restricts the evaluation of every rule to the steps at which
+// it failed, and drops the rules without failures. It returns the failures
+// that can't be retried, of rules that aren't in the rule file anymore or
+// outside of the range of their rule, which are kept in the failures file.
+func retryFailures(failures []Failure, rules []*recordingRule, endExclusive bool) ([]*recordingRule, []Failure) {
+	type key struct{ group, rule string }
+	steps := map[key][]int64{}
+	for _, f := range failures {
+		k := key{f.Group, f.Rule}
+		steps[k] = append(steps[k], f.Timestamp)
+	}
+
+	var (
+		retried = rules[:0:0]
+		kept    []Failure
+		found   = map[key]bool{}
+	)
+	for _, rule := range rules {
+		k := key{rule.group, rule.name}
+		ts, ok := steps[k]
+		if !ok {
+			continue
+		}
+		found[k] = true
+		sort.Slice(ts, func(i, j int) bool { return ts[i] < ts[j] })
+		uniq := ts[:0]
+		for i, t := range ts {
+			if i == 0 || t != ts[i-1] {
+				uniq = append(uniq, t)
+			}
+		}
+		rule.timestamps = timestampsIn(uniq, timestamp.FromTime(rule.tr.start), rule.tr.lastEval(endExclusive))
+		if len(rule.timestamps) > 0 {
+			retried = append(retried, rule)
+		}
+	}
+	for _, f := range failures {
+		k := key{f.Group, f.Rule}
+		if !found[k] {
+			kept = append(kept, f)
+			continue
+		}
+		for _, rule := range rules {
+			if rule.group == f.Group && rule.name == f.Rule && !containsTimestamp(rule.timestamps, f.Timestamp) {
+				kept = append(kept, f)
+			}
+		}
+	}
+	return retried, kept
+}
+
+// containsTimestamp reports whether the sorted ts contain t.
+func containsTimestamp(ts []int64, t int64) bool {
+	i := sort.Search(len(ts), func(i int) bool { return ts[i] >= t })
+	return i < len(ts) && ts[i] == t
+}
@@ -0,0 +1,74 @@
+package backfill
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Features of the PromQL engine newer Prometheus servers enable with
+// --enable-feature.
+const (
+	FeatureAtModifier     = "promql-at-modifier"
+	FeatureNegativeOffset = "promql-negative-offset"
+)
+
+// unsupportedSyntax is the syntax of the features, which the PromQL engine of
+// the Prometheus version the backfiller is built with fails to parse.
+var unsupportedSyntax = []struct {
+	feature, name string
+	re            *regexp.Regexp
+}{
+	{FeatureAtModifier, "the @ modifier", regexp.MustCompile(`@\s*([0-9.+-]|start\s*\(|end\s*\()`)},
+	{FeatureNegativeOffset, "a negative offset", regexp.MustCompile(`\boffset\s*-`)},
+}
+
+// checkFeatures checks the features to enable, given like the server's
+// --enable-feature as comma-separated lists. The engine predates them, the @
+// modifier and negative offsets came with Prometheus 2.25 and 2.26, so none
+// can be enabled.
+func checkFeatures(features []string) error {
+	for _, list := range features {
+		for _, f := range strings.Split(list, ",") {
+			switch f = strings.TrimSpace(f); f {
+			case "":
+			case FeatureAtModifier, FeatureNegativeOffset:
+				return errors.Errorf("feature %s isn't supported by the PromQL engine of this Prometheus version", f)
+			default:
+				return errors.Errorf("unknown feature %q", f)
+			}
+		}
+	}
+	return nil
+}
+
+// unsupportedFeatures returns an error for every rule in the rule file with
+// the content b that uses the syntax of a feature the engine doesn't support,
+// to explain why the rule file fails to parse.
+func unsupportedFeatures(b []byte) []error {
+	var rgs struct {
+		Groups []struct {
+			Name  string `yaml:"name"`
+			Rules []struct {
+				Record string `yaml:"record"`
+				Expr   string `yaml:"expr"`
+			} `yaml:"rules"`
+		} `yaml:"groups"`
+	}
+	if err := yaml.Unmarshal(b, &rgs); err != nil {
+		return nil
+	}
+	var errs []error
+	for _, rg := range rgs.Groups {
+		for i, rule := range rg.Rules {
+			for _, s := range unsupportedSyntax {
+				if s.re.MatchString(rule.Expr) {
+					errs = append(errs, errors.Errorf("group %q, rule %d, %q: expression uses %s (%s), which the PromQL engine of this Prometheus version doesn't support", rg.Name, i, rule.Record, s.name, s.feature))
+				}
+			}
+		}
+	}
+	return errs
+}
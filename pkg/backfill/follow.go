@@ -0,0 +1,212 @@
+package backfill
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+)
+
+// DefaultFollowFlushInterval is the default interval at which the new source
+// data is backfilled in follow mode, which is the range of its blocks.
+const DefaultFollowFlushInterval = time.Hour
+
+// follow backfills the range of opts and then keeps backfilling the source
+// data that appears after it, every opts.FollowFlushInterval, until
+// opts.FollowUntil or until ctx is canceled. The result sums up all runs, with
+// the rule results of the last one.
+func (b *Backfiller) follow(ctx context.Context, opts Options) (Result, error) {
+	switch {
+	case opts.PrometheusConfigFile != "" && opts.EvalInterval <= 0 && !opts.AutoEvalInterval:
+		// The next step of every run is derived from a single interval.
+		return Result{}, errors.New("following the source can't evaluate the rules at the intervals of --prometheus-config, set --eval-interval")
+	case opts.AutoEvalInterval, opts.EvalInterval <= 0:
+		return Result{}, errors.New("following the source requires a fixed eval interval")
+	case opts.RangeOverridesFile != "", opts.TimestampsFile != "", opts.TimestampReference != "", opts.FillGapsFrom != "":
+		return Result{}, errors.New("following the source can't be combined with range overrides, explicit evaluation timestamps or filling gaps")
+	case opts.TimestampShift != 0:
+		return Result{}, errors.New("following the source can't be combined with a timestamp shift")
+	case opts.TimestampMode == TimestampModeSample:
+		// Every run would drop the samples of the steps within the query
+		// offset of its start, and a restart would continue one offset
+		// before the last step.
+		return Result{}, errors.New("following the source can't be combined with --timestamp-mode=sample")
+	case opts.FailuresFile != "", opts.RetryFromFailures != "":
+		return Result{}, errors.New("following the source can't be combined with a failures file or retrying failures")
+	case opts.Bench > 0, opts.Estimate > 0, opts.CompareAgainst != "", opts.OutputFormat == OutputFormatCSV, opts.Receive.URL != "":
+		return Result{}, errors.New("following the source requires writing blocks")
+	}
+	var until time.Time
+	if opts.FollowUntil != "" {
+		var err error
+		if until, err = parseTime(opts.FollowUntil); err != nil {
+			return Result{}, errors.Wrap(err, "failed to parse follow until time")
+		}
+		// The initial range ends at the until time at the latest.
+		if opts.End == "" {
+			opts.End = opts.FollowUntil
+		} else if end, err := parseTime(opts.End); err == nil && end.After(until) {
+			opts.End = opts.FollowUntil
+		}
+	}
+	poll := opts.FollowPoll
+	if poll <= 0 {
+		poll = opts.EvalInterval
+	}
+	flushInterval := opts.FollowFlushInterval
+	if flushInterval <= 0 {
+		flushInterval = DefaultFollowFlushInterval
+	}
+	opts.Follow = false
+	// The lock is held across all runs.
+	if opts.DestLock {
+		lock, err := lockDest(opts.DestPath)
+		if err != nil {
+			return Result{}, err
+		}
+		defer lock.Release()
+		opts.DestLock = false
+	}
+
+	// A restarted follow run continues after the blocks written by the
+	// previous one instead of backfilling their range again.
+	if opts.TenantLabel == "" && !opts.TenantFromRules && !opts.AppendToHead {
+		maxt, ok, err := backfilledMaxTime(opts.DestPath, ruleFileName(opts))
+		if err != nil {
+			return Result{}, errors.Wrap(err, "failed to find the backfilled blocks")
+		}
+		if ok {
+			// Block ranges are half-open, the next step follows the last
+			// sample of the blocks.
+			next := maxt - 1 + opts.EvalInterval.Milliseconds()
+			start, err := parseTime(opts.Start)
+			if opts.Start == "" || err == nil && timestamp.FromTime(start) < next {
+				level.Info(b.logger).Log("msg", "continuing after the backfilled blocks", "start", timestamp.Time(next))
+				opts.Start = strconv.FormatInt(next, 10) + "ms"
+			}
+		}
+	}
+
+	var total Result
+	res, err := b.Run(ctx, opts)
+	total.add(res)
+	if err != nil && ctx.Err() != nil {
+		level.Info(b.logger).Log("msg", "stopped before following the source data")
+		return total, nil
+	}
+	var next int64
+	if start, perr := parseTime(opts.Start); errors.Cause(err) == errEmptyRange && perr == nil {
+		// The source has no data after the start yet.
+		level.Info(b.logger).Log("msg", "no source data to backfill yet", "start", start)
+		next = timestamp.FromTime(start)
+	} else if err != nil {
+		return total, err
+	} else {
+		var ok bool
+		if next, ok = nextStep(res, opts); !ok {
+			return total, errors.New("no rule was evaluated, so there is no range to follow")
+		}
+	}
+	level.Info(b.logger).Log("msg", "following the source data", "next", timestamp.Time(next), "poll", poll, "flush_interval", flushInterval)
+
+	lastFlush := time.Now()
+	for until.IsZero() || next <= timestamp.FromTime(until) {
+		select {
+		case <-ctx.Done():
+			level.Info(b.logger).Log("msg", "stopped following the source data", "next", timestamp.Time(next))
+			return total, nil
+		case <-time.After(poll):
+		}
+		if time.Since(lastFlush) < flushInterval {
+			continue
+		}
+
+		iter := opts
+		iter.Start = strconv.FormatInt(next, 10) + "ms"
+		iter.End = ""
+		if !until.IsZero() {
+			iter.End = opts.FollowUntil
+		}
+		res, err := b.Run(ctx, iter)
+		if errors.Cause(err) == errEmptyRange {
+			level.Debug(b.logger).Log("msg", "no new source data to backfill", "next", timestamp.Time(next))
+			continue
+		}
+		total.add(res)
+		if err != nil && ctx.Err() != nil {
+			// The buffered samples were written, the truncated rules continue
+			// from where they stopped.
+			level.Info(b.logger).Log("msg", "stopped following the source data", "next", timestamp.Time(truncatedAt(res, next)))
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+		if n, ok := nextStep(res, iter); ok {
+			next = n
+		}
+		lastFlush = time.Now()
+		level.Info(b.logger).Log("msg", "caught up with the source data", "next", timestamp.Time(next), "blocks", len(res.Blocks), "samples", res.Samples)
+	}
+	level.Info(b.logger).Log("msg", "reached the end of following the source data", "until", until)
+	return total, nil
+}
+
+// nextStep returns the step after the last step evaluated in res by any
+// rule, and false if no rule was evaluated.
+func nextStep(res Result, opts Options) (int64, bool) {
+	interval := opts.EvalInterval.Milliseconds()
+	var (
+		next  int64
+		found bool
+	)
+	for _, rr := range res.Rules {
+		if rr.Skipped || rr.Start.After(rr.End) {
+			continue
+		}
+		first, last := timestamp.FromTime(rr.Start), (&timeRange{rr.Start, rr.End}).lastEval(opts.EndExclusive)
+		if last < first {
+			continue
+		}
+		if n := first + (last-first)/interval*interval + interval; !found || n > next {
+			next, found = n, true
+		}
+	}
+	return next, found
+}
+
+// truncatedAt returns the earliest timestamp a rule of res stopped at, next
+// if none was truncated.
+func truncatedAt(res Result, next int64) int64 {
+	for _, rr := range res.Rules {
+		if !rr.TruncatedAt.IsZero() {
+			next = min(next, timestamp.FromTime(rr.TruncatedAt))
+		}
+	}
+	return next
+}
+
+// add adds the blocks and samples of o to the result and replaces its rule
+// results.
+func (r *Result) add(o Result) {
+	r.Blocks = append(r.Blocks, o.Blocks...)
+	r.BlockSeries = append(r.BlockSeries, o.BlockSeries...)
+	r.BlockStats = append(r.BlockStats, o.BlockStats...)
+	r.ChunkBytes += o.ChunkBytes
+	r.IndexBytes += o.IndexBytes
+	r.BlockDuration += o.BlockDuration
+	r.Samples += o.Samples
+	r.HeadSamples += o.HeadSamples
+	r.Duplicates += o.Duplicates
+	r.ConflictingDuplicates += o.ConflictingDuplicates
+	r.NearDuplicates += o.NearDuplicates
+	r.InvalidValues += o.InvalidValues
+	r.TimedOutSteps += o.TimedOutSteps
+	r.SourceCacheHits += o.SourceCacheHits
+	r.SourceCacheMisses += o.SourceCacheMisses
+	r.ReceiveConflicts += o.ReceiveConflicts
+	r.Rules = o.Rules
+}
@@ -0,0 +1,60 @@
+package backfill
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFollowRejectedOptions(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+	ruleFile := writeFile(t, dir, "rules.yaml", `groups:
+  - name: g
+    interval: 1m
+    rules:
+      - record: job:up:sum
+        expr: sum by (job) (up)
+`)
+	promConfig := writeFile(t, dir, "prometheus.yml", "rule_files: [rules.yaml]\n")
+
+	for _, tc := range []struct {
+		name   string
+		modify func(*Options)
+		err    string
+	}{
+		{
+			name:   "intervals of the Prometheus config",
+			modify: func(o *Options) { o.PrometheusConfigFile, o.EvalInterval = promConfig, 0 },
+			err:    "set --eval-interval",
+		},
+		{
+			name:   "automatic eval interval",
+			modify: func(o *Options) { o.AutoEvalInterval = true },
+			err:    "requires a fixed eval interval",
+		},
+		{
+			name:   "sample timestamps",
+			modify: func(o *Options) { o.TimestampMode = TimestampModeSample },
+			err:    "--timestamp-mode=sample",
+		},
+		{
+			name:   "receive",
+			modify: func(o *Options) { o.Receive.URL = "http://localhost:19291/api/v1/receive" },
+			err:    "requires writing blocks",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := testOptions(ruleFile, filepath.Join(dir, "src"), filepath.Join(dir, "dest"))
+			opts.Follow = true
+			opts.FollowPoll = time.Millisecond
+			tc.modify(&opts)
+			_, err := New(nil, nil).Run(context.Background(), opts)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected an error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
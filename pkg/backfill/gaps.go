@@ -0,0 +1,131 @@
+package backfill
+
+import (
+	"context"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// FillGapsSource as Options.FillGapsFrom looks for the gaps of the recorded
+// series in the source data.
+const FillGapsSource = "source"
+
+// Gap is a window in which a recorded series has no samples, with the first
+// and last evaluation timestamp that fills it.
+type Gap struct {
+	Start, End time.Time
+}
+
+// fillGaps restricts the evaluation of every rule to the gaps of the series it
+// records in the data of opts.FillGapsFrom, on the steps of its range.
+func (b *Backfiller) fillGaps(ctx context.Context, opts Options, src source, rules []*recordingRule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	mint, maxt := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, rule := range rules {
+		mint = min(mint, timestamp.FromTime(rule.tr.start))
+		maxt = max(maxt, rule.tr.lastEval(opts.EndExclusive))
+	}
+
+	var q storage.Querier
+	if opts.FillGapsFrom == FillGapsSource {
+		var err error
+		if q, err = src.Querier(ctx, mint, maxt); err != nil {
+			return err
+		}
+	} else {
+		var (
+			closer io.Closer
+			err    error
+		)
+		if q, closer, err = openReadOnly(ctx, opts.FillGapsFrom, mint, maxt, b.logger); err != nil {
+			return err
+		}
+		if q == nil {
+			// Without data, the whole range of every rule is a gap.
+			q = storage.NoopQuerier()
+		} else {
+			defer closer.Close()
+		}
+	}
+	defer q.Close()
+
+	for _, rule := range rules {
+		steps := rule.evalSteps(opts)
+		gaps, err := findGaps(q, rule, steps.first, steps.last, rule.evalInterval(opts).Milliseconds())
+		if err != nil {
+			return errors.Wrapf(err, "find gaps of rule %s", rule.name)
+		}
+
+		// Evaluate the steps in the gaps only.
+		ts := []int64{}
+		rule.gaps = []Gap{}
+		for _, g := range gaps {
+			n := len(ts)
+			for t := steps.from(g[0]); t <= g[1]; t = steps.next(t) {
+				ts = append(ts, t)
+			}
+			if len(ts) == n {
+				continue
+			}
+			rule.gaps = append(rule.gaps, Gap{Start: timestamp.Time(ts[n]), End: timestamp.Time(ts[len(ts)-1])})
+			level.Info(b.logger).Log("msg", "filling gap", "rule", rule.name, "group", rule.group, "start", timestamp.Time(ts[n]), "end", timestamp.Time(ts[len(ts)-1]), "steps", len(ts)-n)
+		}
+		if len(rule.gaps) == 0 {
+			level.Info(b.logger).Log("msg", "no gaps in the recorded series, skipping rule", "rule", rule.name, "group", rule.group)
+		}
+		rule.timestamps = ts
+	}
+	return nil
+}
+
+// findGaps returns the windows in [first, last] in which the series recorded
+// by rule in q have no samples for more than two intervals, keeping a
+// tolerance of one interval to the samples around them.
+func findGaps(q storage.Querier, rule *recordingRule, first, last, interval int64) ([][2]int64, error) {
+	if first > last {
+		return nil, nil
+	}
+	ss, _, err := q.Select(false, &storage.SelectHints{Start: first, End: last}, rule.recordedMatchers()...)
+	if err != nil {
+		return nil, err
+	}
+	var ts []int64
+	for ss.Next() {
+		it := ss.At().Iterator()
+		for it.Next() {
+			if t, _ := it.At(); t >= first && t <= last {
+				ts = append(ts, t)
+			}
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if err := ss.Err(); err != nil {
+		return nil, err
+	}
+	if len(ts) == 0 {
+		return [][2]int64{{first, last}}, nil
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i] < ts[j] })
+
+	var gaps [][2]int64
+	// Bound the range by samples an interval outside of it to find gaps at its ends.
+	prev := first - interval
+	for _, t := range append(ts, last+interval) {
+		if t-prev > 2*interval {
+			gaps = append(gaps, [2]int64{prev + interval, t - interval})
+		}
+		prev = t
+	}
+	return gaps, nil
+}
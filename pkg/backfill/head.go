@@ -0,0 +1,107 @@
+package backfill
+
+import (
+	"math"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// DefaultAppendBatchSize is the default number of samples appended to the
+// head before they are committed.
+const DefaultAppendBatchSize = 10000
+
+// headWriter appends samples to the head of the destination TSDB, which is
+// opened for writing, instead of writing them into blocks.
+type headWriter struct {
+	db  *tsdb.DB
+	app storage.Appender
+	// minValidTime is the oldest timestamp the head accepts, MaxInt64 if the
+	// head is empty.
+	minValidTime int64
+	// batchSize is the number of samples committed at a time, pending the
+	// number of samples appended since the last commit and committed the
+	// number of samples committed so far.
+	batchSize          int
+	pending, committed int
+}
+
+func openHeadWriter(dir string, batchSize int, logger log.Logger) (*headWriter, error) {
+	opts := tsdb.DefaultOptions()
+	// Neither drop blocks nor refuse the overlapping ones of previous backfills.
+	opts.RetentionDuration = 0
+	opts.AllowOverlappingBlocks = true
+
+	db, err := tsdb.Open(dir, logger, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	// The blocks of the run are tracked by their ULIDs, the DB must not compact them away.
+	db.DisableCompactions()
+
+	// Like the head itself, accept samples no older than half a block range
+	// before its newest sample.
+	minValidTime := int64(math.MaxInt64)
+	if h := db.Head(); h.MaxTime() != math.MinInt64 {
+		minValidTime = max(h.MinTime(), h.MaxTime()-opts.MinBlockDuration/2)
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultAppendBatchSize
+	}
+	return &headWriter{db: db, app: db.Appender(), minValidTime: minValidTime, batchSize: batchSize}, nil
+}
+
+// add appends a sample to the head and reports whether it was accepted. Samples
+// outside of the head's window, older than the newest sample of their series
+// in the head or conflicting with a sample in it aren't.
+func (w *headWriter) add(lset labels.Labels, t int64, v float64) (bool, error) {
+	if t < w.minValidTime {
+		return false, nil
+	}
+	_, err := w.app.Add(lset, t, v)
+	switch errors.Cause(err) {
+	case nil:
+	case storage.ErrOutOfBounds, storage.ErrOutOfOrderSample, storage.ErrDuplicateSampleForTimestamp:
+		return false, nil
+	default:
+		return false, err
+	}
+
+	w.pending++
+	if w.pending >= w.batchSize {
+		return true, w.commit()
+	}
+	return true, nil
+}
+
+// commit commits the pending samples and opens a new appender. Once a commit
+// failed, the pending samples are lost and nothing can be appended anymore.
+func (w *headWriter) commit() error {
+	if w.app == nil {
+		return errors.New("appending to the head failed before")
+	}
+	if err := w.app.Commit(); err != nil {
+		w.app = nil
+		return errors.Wrapf(err, "failed to commit %d samples to the head, the %d samples committed before are durable", w.pending, w.committed)
+	}
+	w.app = w.db.Appender()
+	w.committed += w.pending
+	w.pending = 0
+	return nil
+}
+
+// Close commits the pending samples, unless a commit failed before, and
+// closes the TSDB.
+func (w *headWriter) Close() error {
+	var err error
+	if w.app != nil {
+		err = w.commit()
+	}
+	if cerr := w.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package backfill
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/prometheus/prometheus/storage"
+)
+
+const (
+	// The scrape interval detection only reads the last probeWindow of the
+	// backfill range, at most probeSeries series per selector and
+	// probeSamples samples per series, to keep startup fast on large sources.
+	probeWindow  = time.Hour
+	probeSeries  = 10
+	probeSamples = 100
+)
+
+// sensibleIntervals are the steps a detected scrape interval is rounded to.
+var sensibleIntervals = []time.Duration{
+	time.Second, 5 * time.Second, 10 * time.Second, 15 * time.Second, 20 * time.Second, 30 * time.Second,
+	time.Minute, 2 * time.Minute, 5 * time.Minute, 10 * time.Minute, 15 * time.Minute, 30 * time.Minute,
+	time.Hour,
+}
+
+// detectScrapeInterval estimates the typical scrape interval of the series the
+// rules select from the median distance of consecutive samples before maxt.
+// It returns 0 if there are not enough samples to tell.
+func detectScrapeInterval(ctx context.Context, q storage.Queryable, rules []*recordingRule, maxt int64) (time.Duration, error) {
+	querier, err := q.Querier(ctx, maxt-probeWindow.Milliseconds(), maxt)
+	if err != nil {
+		return 0, err
+	}
+	defer querier.Close()
+
+	var deltas []int64
+	for _, rule := range rules {
+		for _, matchers := range rule.selectors() {
+			ss, _, err := querier.Select(false, nil, matchers...)
+			if err != nil {
+				return 0, err
+			}
+			for n := 0; n < probeSeries && ss.Next(); n++ {
+				it := ss.At().Iterator()
+				var prev int64
+				for i := 0; i < probeSamples && it.Next(); i++ {
+					t, _ := it.At()
+					if i > 0 {
+						deltas = append(deltas, t-prev)
+					}
+					prev = t
+				}
+				if err := it.Err(); err != nil {
+					return 0, err
+				}
+			}
+			if err := ss.Err(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if len(deltas) == 0 {
+		return 0, nil
+	}
+
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i] < deltas[j] })
+	return time.Duration(deltas[len(deltas)/2]) * time.Millisecond, nil
+}
+
+// roundInterval rounds d to the closest sensible interval.
+func roundInterval(d time.Duration) time.Duration {
+	best := sensibleIntervals[0]
+	for _, i := range sensibleIntervals {
+		if abs(i-d) < abs(best-d) {
+			best = i
+		}
+	}
+	return best
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,51 @@
+package backfill
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+)
+
+// destLockFile is the file in the destination that a run holds an advisory
+// lock on while it writes into it. Prometheus ignores it as it isn't a valid
+// ULID, and it isn't the lock file of a Prometheus server.
+const destLockFile = ".backfiller.lock"
+
+// lockHolder identifies the run holding the lock of a destination.
+type lockHolder struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+}
+
+// lockDest takes the lock of the destination dir, which the operating system
+// releases when the process exits. It fails if another run holds it, naming
+// that run.
+func lockDest(dir string) (fileutil.Releaser, error) {
+	path := filepath.Join(dir, destLockFile)
+	r, _, err := fileutil.Flock(path)
+	if err != nil {
+		var h lockHolder
+		if b, rerr := ioutil.ReadFile(path); rerr == nil && json.Unmarshal(b, &h) == nil && h.PID != 0 {
+			return nil, errors.Errorf("destination %s is locked by another backfill, pid %d on host %s, running since %s; use --no-dest-lock if locking is unreliable on its filesystem", dir, h.PID, h.Host, h.Started.Format(time.RFC3339))
+		}
+		return nil, errors.Wrapf(err, "lock destination %s", dir)
+	}
+
+	// The holder is only informative, the lock itself is the flock.
+	host, _ := os.Hostname()
+	b, err := json.Marshal(lockHolder{PID: os.Getpid(), Host: host, Started: time.Now().UTC()})
+	if err == nil {
+		err = ioutil.WriteFile(path, append(b, '\n'), 0666)
+	}
+	if err != nil {
+		r.Release()
+		return nil, errors.Wrapf(err, "write lock file of %s", dir)
+	}
+	return r, nil
+}
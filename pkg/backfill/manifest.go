@@ -0,0 +1,99 @@
+package backfill
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+)
+
+// Formats of the series manifest.
+const (
+	ManifestFormatJSON = "json"
+	ManifestFormatCSV  = "csv"
+)
+
+// manifestSeries is a written series with its number of samples and the
+// timestamps of its oldest and newest sample.
+type manifestSeries struct {
+	Labels  labels.Labels `json:"labels"`
+	Samples int           `json:"samples"`
+	MinTime int64         `json:"minTime"`
+	MaxTime int64         `json:"maxTime"`
+}
+
+// seriesManifest collects the series written by a run across all blocks.
+// Blocks may be written concurrently.
+type seriesManifest struct {
+	mtx    sync.Mutex
+	series map[uint64]*manifestSeries
+}
+
+func newSeriesManifest() *seriesManifest {
+	return &seriesManifest{series: map[uint64]*manifestSeries{}}
+}
+
+// add records a written sample of the series at t.
+func (m *seriesManifest) add(lset labels.Labels, t int64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	h := lset.Hash()
+	s, ok := m.series[h]
+	if !ok {
+		m.series[h] = &manifestSeries{Labels: lset, Samples: 1, MinTime: t, MaxTime: t}
+		return
+	}
+	s.Samples++
+	s.MinTime = min(s.MinTime, t)
+	s.MaxTime = max(s.MaxTime, t)
+}
+
+// write writes the series ordered by their labels to path in the format.
+func (m *seriesManifest) write(path, format string) error {
+	m.mtx.Lock()
+	series := make([]*manifestSeries, 0, len(m.series))
+	for _, s := range m.series {
+		series = append(series, s)
+	}
+	m.mtx.Unlock()
+	sort.Slice(series, func(i, j int) bool { return labels.Compare(series[i].Labels, series[j].Labels) < 0 })
+
+	switch format {
+	case "", ManifestFormatJSON:
+		out, err := json.MarshalIndent(series, "", "\t")
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(path, append(out, '\n'), 0666)
+	case ManifestFormatCSV:
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		w := csv.NewWriter(f)
+		w.Write([]string{"series", "samples", "min_time", "max_time"})
+		for _, s := range series {
+			w.Write([]string{
+				s.Labels.String(),
+				strconv.Itoa(s.Samples),
+				timestamp.Time(s.MinTime).Format(time.RFC3339Nano),
+				timestamp.Time(s.MaxTime).Format(time.RFC3339Nano),
+			})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+	return errors.Errorf("unknown series manifest format %q", format)
+}
@@ -0,0 +1,186 @@
+package backfill
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+)
+
+const (
+	metaFilename = "meta.json"
+	// metaSource marks the blocks created by the backfiller.
+	metaSource = "backfiller"
+)
+
+// Version is the version of the backfiller recorded in the blocks it creates.
+var Version = "v0.0.1"
+
+// blockMeta is the meta.json of a block, extended with the backfiller marker.
+// Prometheus ignores the extra field.
+type blockMeta struct {
+	tsdb.BlockMeta
+	Backfiller *backfillerMeta `json:"backfiller,omitempty"`
+}
+
+// backfillerMeta identifies the blocks created by the backfiller.
+type backfillerMeta struct {
+	Source   string `json:"source"`
+	Version  string `json:"version"`
+	RuleFile string `json:"ruleFile"`
+	// ContentHash is the SHA-256 of the samples of the block, with
+	// Options.Deterministic.
+	ContentHash string `json:"contentHash,omitempty"`
+}
+
+func readBlockMeta(dir string) (*blockMeta, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, metaFilename))
+	if err != nil {
+		return nil, err
+	}
+	var m blockMeta
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, errors.Wrapf(err, "parse %s", filepath.Join(dir, metaFilename))
+	}
+	return &m, nil
+}
+
+// writeBlockMeta atomically replaces the meta.json of the block.
+func writeBlockMeta(dir string, m *blockMeta) error {
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, metaFilename)
+	tmp := path + ".tmp"
+	defer os.RemoveAll(tmp)
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return fileutil.Replace(tmp, path)
+}
+
+// markBlock records in the meta.json of the block that it was created by the backfiller.
+func markBlock(dir, ruleFile string) error {
+	m, err := readBlockMeta(dir)
+	if err != nil {
+		return err
+	}
+	if m.Backfiller == nil {
+		m.Backfiller = &backfillerMeta{}
+	}
+	m.Backfiller.Source = metaSource
+	m.Backfiller.Version = Version
+	m.Backfiller.RuleFile = ruleFile
+	return writeBlockMeta(dir, m)
+}
+
+// isBackfilledBlock reports whether the block was created by the backfiller.
+func isBackfilledBlock(dir string) (bool, error) {
+	m, err := readBlockMeta(dir)
+	if err != nil {
+		return false, err
+	}
+	return m.Backfiller != nil && m.Backfiller.Source == metaSource, nil
+}
+
+// backfilledMaxTime returns the end of the newest block in dir created by
+// the backfiller from ruleFile, and false if there is none.
+func backfilledMaxTime(dir, ruleFile string) (int64, bool, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	var (
+		maxt  int64
+		found bool
+	)
+	for _, f := range files {
+		if _, err := ulid.ParseStrict(f.Name()); err != nil || !f.IsDir() {
+			continue
+		}
+		m, err := readBlockMeta(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return 0, false, errors.Wrapf(err, "read meta of block %s", f.Name())
+		}
+		if m.Backfiller == nil || m.Backfiller.Source != metaSource || m.Backfiller.RuleFile != ruleFile {
+			continue
+		}
+		if !found || m.MaxTime > maxt {
+			maxt, found = m.MaxTime, true
+		}
+	}
+	return maxt, found, nil
+}
+
+// createdBlock describes a block in the created blocks file.
+type createdBlock struct {
+	ULID       string `json:"ulid"`
+	MinTime    int64  `json:"minTime"`
+	MaxTime    int64  `json:"maxTime"`
+	NumSamples uint64 `json:"numSamples"`
+	NumSeries  uint64 `json:"numSeries"`
+	ChunkBytes int64  `json:"chunkBytes"`
+	IndexBytes int64  `json:"indexBytes"`
+	// WriteDurationSeconds is unknown for compacted blocks.
+	WriteDurationSeconds float64 `json:"writeDurationSeconds,omitempty"`
+}
+
+// writeCreatedBlocks writes the ULIDs, time ranges and sizes of the given
+// blocks in dir as a JSON array to path, with the write durations of stats.
+func writeCreatedBlocks(path, dir string, blocks []string, stats []BlockStats) error {
+	durations := make(map[string]time.Duration, len(stats))
+	for _, bs := range stats {
+		durations[bs.ULID] = bs.Duration
+	}
+	created := make([]createdBlock, 0, len(blocks))
+	for _, b := range blocks {
+		m, err := readBlockMeta(filepath.Join(dir, b))
+		if err != nil {
+			return errors.Wrapf(err, "read meta of block %s", b)
+		}
+		chunks, index, err := blockFileSizes(filepath.Join(dir, b))
+		if err != nil {
+			return errors.Wrapf(err, "get size of block %s", b)
+		}
+		created = append(created, createdBlock{
+			ULID:                 b,
+			MinTime:              m.MinTime,
+			MaxTime:              m.MaxTime,
+			NumSamples:           m.Stats.NumSamples,
+			NumSeries:            m.Stats.NumSeries,
+			ChunkBytes:           chunks,
+			IndexBytes:           index,
+			WriteDurationSeconds: durations[b].Seconds(),
+		})
+	}
+	out, err := json.MarshalIndent(created, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(out, '\n'), 0666)
+}
@@ -0,0 +1,59 @@
+package backfill
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type metrics struct {
+	bufferedSamples prometheus.Gauge
+	bufferedBytes   prometheus.Gauge
+	queryDuration   *prometheus.HistogramVec
+	blockDuration   prometheus.Histogram
+	lastBlockBytes  prometheus.Gauge
+
+	sourceCacheHits, sourceCacheMisses prometheus.Counter
+	sourceCacheBytes                   prometheus.Gauge
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		bufferedSamples: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "backfiller_buffered_samples",
+			Help: "Number of evaluated samples buffered for the next block.",
+		}),
+		bufferedBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "backfiller_buffered_bytes",
+			Help: "Estimated memory used by the evaluated samples buffered for the next block.",
+		}),
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "backfiller_rule_query_duration_seconds",
+			Help:    "Duration of the queries evaluating a rule.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"group", "rule"}),
+		blockDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "backfiller_block_creation_duration_seconds",
+			Help:    "Duration of writing a block.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+		}),
+		lastBlockBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "backfiller_last_block_bytes",
+			Help: "On-disk size of the chunks and the index of the last written block.",
+		}),
+		sourceCacheHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "backfiller_source_cache_hits_total",
+			Help: "Number of windows of the series of a selector served from the source cache.",
+		}),
+		sourceCacheMisses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "backfiller_source_cache_misses_total",
+			Help: "Number of windows of the series of a selector read from the source.",
+		}),
+		sourceCacheBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "backfiller_source_cache_bytes",
+			Help: "Estimated memory of the samples in the source cache.",
+		}),
+	}
+	if reg != nil {
+		reg.MustRegister(m.bufferedSamples, m.bufferedBytes, m.queryDuration, m.blockDuration, m.lastBlockBytes, m.sourceCacheHits, m.sourceCacheMisses, m.sourceCacheBytes)
+	}
+	return m
+}
@@ -0,0 +1,147 @@
+package backfill
+
+import (
+	"context"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// coverageWindow is the length of the aligned windows in which the recorded
+// series of a rule need a sample for the destination to cover its range with
+// Options.OnlyMissing, which is the range of the blocks Prometheus writes.
+const coverageWindow = 2 * time.Hour
+
+// skipCovered returns the rules whose recorded series already exist in the
+// destination throughout their range, which aren't evaluated with
+// Options.OnlyMissing, and the remaining rules.
+func (b *Backfiller) skipCovered(ctx context.Context, opts Options, rules []*recordingRule) (covered, missing []*recordingRule, err error) {
+	if len(rules) == 0 {
+		return nil, rules, nil
+	}
+	mint, maxt := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, rule := range rules {
+		mint = min(mint, timestamp.FromTime(rule.tr.start))
+		maxt = max(maxt, rule.tr.lastEval(opts.EndExclusive))
+	}
+	q, closer, err := openReadOnly(ctx, opts.DestPath, mint, maxt, b.logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	if q == nil {
+		level.Info(b.logger).Log("msg", "no data in the destination, backfilling all rules", "dir", opts.DestPath)
+		return nil, rules, nil
+	}
+	defer closer.Close()
+	defer q.Close()
+
+	for _, rule := range rules {
+		steps := rule.evalSteps(opts)
+		uncovered, err := uncoveredWindows(q, rule, steps, coverageWindow.Milliseconds())
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "check recorded series of rule %s", rule.name)
+		}
+		if uncovered > 0 {
+			level.Debug(b.logger).Log("msg", "recorded series are missing in the destination", "rule", rule.name, "group", rule.group, "windows", uncovered)
+			missing = append(missing, rule)
+			continue
+		}
+		level.Info(b.logger).Log("msg", "skipping rule, the destination has its recorded series throughout its range", "rule", rule.name, "group", rule.group, "start", rule.tr.start, "end", rule.tr.end)
+		covered = append(covered, rule)
+	}
+	return covered, missing, nil
+}
+
+// uncoveredWindows returns the number of the aligned windows of the given
+// length with steps of the rule in which the series it records in q have no
+// sample.
+func uncoveredWindows(q storage.Querier, rule *recordingRule, steps evalSteps, window int64) (int, error) {
+	if steps.first > steps.last {
+		return 0, nil
+	}
+	ss, _, err := q.Select(false, &storage.SelectHints{Start: steps.first, End: steps.last}, rule.recordedMatchers()...)
+	if err != nil {
+		return 0, err
+	}
+	sampled := map[int64]struct{}{}
+	for ss.Next() {
+		it := ss.At().Iterator()
+		for it.Next() {
+			if t, _ := it.At(); t >= steps.first && t <= steps.last {
+				sampled[alignDown(t, window)] = struct{}{}
+			}
+		}
+		if err := it.Err(); err != nil {
+			return 0, err
+		}
+	}
+	if err := ss.Err(); err != nil {
+		return 0, err
+	}
+
+	uncovered := 0
+	for ws := alignDown(steps.first, window); ws <= steps.last; ws += window {
+		// Windows without steps, e.g. between explicit timestamps, can't be missing.
+		if steps.from(ws) >= ws+window {
+			continue
+		}
+		if _, ok := sampled[ws]; !ok {
+			uncovered++
+		}
+	}
+	return uncovered, nil
+}
+
+// alignDown returns the start of the aligned window of the given length t is in.
+func alignDown(t, window int64) int64 {
+	if t < 0 {
+		return (t+1)/window*window - window
+	}
+	return t / window * window
+}
+
+// openReadOnly returns a querier of [mint, maxt] of the TSDB in dir, which
+// is only read, with the closer of the TSDB. The querier is nil if the TSDB
+// has neither blocks nor a WAL.
+func openReadOnly(ctx context.Context, dir string, mint, maxt int64, logger log.Logger) (storage.Querier, io.Closer, error) {
+	if _, err := os.Stat(filepath.Join(dir, "wal")); os.IsNotExist(err) {
+		blocks, err := overlappingBlocks(dir, math.MinInt64, math.MaxInt64, false)
+		if os.IsNotExist(err) || err == nil && len(blocks) == 0 {
+			return nil, nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		s, err := openBlocksSource(logger, dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		q, err := s.Querier(ctx, mint, maxt)
+		if err != nil {
+			s.Close()
+			return nil, nil, err
+		}
+		return q, s, nil
+	}
+	// The TSDB may be the data directory of a running server, read it
+	// including the WAL without writing to it.
+	db, err := tsdb.OpenDBReadOnly(dir, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	q, err := db.Querier(ctx, mint, maxt)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return q, db, nil
+}
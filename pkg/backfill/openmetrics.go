@@ -0,0 +1,94 @@
+package backfill
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// openMetricsSource is an in-memory queryable built from an OpenMetrics
+// or Prometheus text exposition dump with explicit sample timestamps.
+type openMetricsSource struct {
+	head *tsdb.Head
+}
+
+func newOpenMetricsSource(filename string, logger log.Logger) (*openMetricsSource, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// OpenMetrics exposition must be terminated by "# EOF", fall back
+	// to the Prometheus text format otherwise.
+	contentType := "text/plain"
+	if bytes.HasSuffix(bytes.TrimSpace(b), []byte("# EOF")) {
+		contentType = "application/openmetrics-text"
+	}
+
+	var samples []*tsdb.MetricSample
+	p := textparse.New(b, contentType)
+	for {
+		entry, err := p.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, filename)
+		}
+		if entry != textparse.EntrySeries {
+			continue
+		}
+
+		var lset labels.Labels
+		series := p.Metric(&lset)
+		_, ts, v := p.Series()
+		if ts == nil {
+			return nil, errors.Errorf("%s: sample %s has no timestamp", filename, series)
+		}
+		samples = append(samples, &tsdb.MetricSample{Labels: lset, Value: v, TimestampMs: *ts})
+	}
+	if len(samples) == 0 {
+		return nil, errors.Errorf("%s: no samples found", filename)
+	}
+
+	// The head only accepts in-order appends.
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].TimestampMs < samples[j].TimestampMs
+	})
+
+	chunkRange := samples[len(samples)-1].TimestampMs - samples[0].TimestampMs
+	if chunkRange == 0 {
+		chunkRange = tsdb.DefaultBlockDuration
+	}
+	head, err := tsdb.CreateHead(samples, chunkRange, logger)
+	if err != nil {
+		return nil, errors.Wrap(err, filename)
+	}
+
+	return &openMetricsSource{head: head}, nil
+}
+
+func (s *openMetricsSource) Querier(_ context.Context, mint, maxt int64) (storage.Querier, error) {
+	return tsdb.NewBlockQuerier(tsdb.NewRangeHead(s.head, mint, maxt), mint, maxt)
+}
+
+func (s *openMetricsSource) MinTime() int64 {
+	return s.head.MinTime()
+}
+
+func (s *openMetricsSource) MaxTime() int64 {
+	return s.head.MaxTime()
+}
+
+func (s *openMetricsSource) Close() error {
+	return s.head.Close()
+}
@@ -0,0 +1,113 @@
+package backfill
+
+import (
+	"io/ioutil"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"gopkg.in/yaml.v2"
+)
+
+// rangeOverride overrides the backfill range, the max samples limit and the
+// tenant of a rule group or a single rule. An empty start or end falls back to
+// the global range, a zero max samples to the global limit.
+type rangeOverride struct {
+	Start      string `yaml:"start,omitempty"`
+	End        string `yaml:"end,omitempty"`
+	MaxSamples int    `yaml:"max_samples,omitempty"`
+	Tenant     string `yaml:"tenant,omitempty"`
+}
+
+// rangeOverrides maps group names and record names to their own backfill ranges
+// and max samples limits. A rule override takes precedence over the override
+// of its group.
+type rangeOverrides struct {
+	Groups map[string]rangeOverride `yaml:"groups,omitempty"`
+	Rules  map[string]rangeOverride `yaml:"rules,omitempty"`
+}
+
+func loadRangeOverrides(filename string) (*rangeOverrides, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &rangeOverrides{}
+	if err := yaml.UnmarshalStrict(b, o); err != nil {
+		return nil, errors.Wrap(err, filename)
+	}
+	for kind, m := range map[string]map[string]rangeOverride{"group": o.Groups, "rule": o.Rules} {
+		for name, override := range m {
+			if override.MaxSamples < 0 {
+				return nil, errors.Errorf("%s: negative max_samples for %s %s", filename, kind, name)
+			}
+		}
+	}
+	return o, nil
+}
+
+// lookup returns the override of the rule, or else of its group.
+func (o *rangeOverrides) lookup(rule *recordingRule) (rangeOverride, bool) {
+	if override, ok := o.Rules[rule.name]; ok {
+		return override, true
+	}
+	override, ok := o.Groups[rule.group]
+	return override, ok
+}
+
+// maxSamples returns the max samples limit of the rule's queries, 0 for the
+// global limit.
+func (o *rangeOverrides) maxSamples(rule *recordingRule) int {
+	override, _ := o.lookup(rule)
+	return override.MaxSamples
+}
+
+// tenant returns the tenant of the rule, or else of its group, empty if
+// neither has one. Unlike the other settings, the tenant of a group applies to
+// its rules with an override without a tenant, too.
+func (o *rangeOverrides) tenant(rule *recordingRule) string {
+	if t := o.Rules[rule.name].Tenant; t != "" {
+		return t
+	}
+	return o.Groups[rule.group].Tenant
+}
+
+// timeRange returns the effective range of the rule. Overridden bounds outside of
+// the [minTime, maxTime] range of the source data are clamped with a warning.
+func (o *rangeOverrides) timeRange(rule *recordingRule, global *timeRange, minTime, maxTime int64, logger log.Logger) (*timeRange, error) {
+	override, ok := o.lookup(rule)
+	if !ok {
+		return global, nil
+	}
+
+	tr := &timeRange{global.start, global.end}
+	if override.Start != "" {
+		stime, err := parseTime(override.Start)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse start time override of rule %s", rule.name)
+		}
+		if timestamp.FromTime(stime) < minTime {
+			level.Warn(logger).Log("msg", "start time override is before the source data, clamping", "rule", rule.name, "start", stime, "min", timestamp.Time(minTime))
+			stime = timestamp.Time(minTime)
+		}
+		tr.start = stime
+	}
+	if override.End != "" {
+		etime, err := parseTime(override.End)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse end time override of rule %s", rule.name)
+		}
+		if timestamp.FromTime(etime) > maxTime {
+			level.Warn(logger).Log("msg", "end time override is after the source data, clamping", "rule", rule.name, "end", etime, "max", timestamp.Time(maxTime))
+			etime = timestamp.Time(maxTime)
+		}
+		tr.end = etime
+	}
+
+	if tr.start.After(tr.end) {
+		return nil, errors.Errorf("start time should be before end time for rule %s", rule.name)
+	}
+	return tr, nil
+}
@@ -0,0 +1,95 @@
+package backfill
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// overwrittenDir is the directory inside the destination that overwritten
+// blocks are moved to. Prometheus ignores it as it isn't a valid ULID.
+const overwrittenDir = ".overwritten"
+
+// moveOverlappingBlocks moves the blocks in dir that overlap [mint, maxt] aside,
+// so the freshly backfilled blocks are authoritative. Only blocks created by
+// the backfiller whose series all carry one of the given metric names are
+// moved, other blocks are kept with a warning.
+func moveOverlappingBlocks(dir string, mint, maxt int64, names map[string]struct{}, logger log.Logger) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var moved []string
+	for _, f := range files {
+		if _, err := ulid.ParseStrict(f.Name()); err != nil || !f.IsDir() {
+			continue
+		}
+		blockDir := filepath.Join(dir, f.Name())
+
+		ok, err := isOverwritable(blockDir, mint, maxt, names, logger)
+		if err != nil {
+			return moved, errors.Wrapf(err, "check block %s", blockDir)
+		}
+		if !ok {
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Join(dir, overwrittenDir), 0777); err != nil {
+			return moved, err
+		}
+		if err := os.Rename(blockDir, filepath.Join(dir, overwrittenDir, f.Name())); err != nil {
+			return moved, errors.Wrapf(err, "move block %s aside", blockDir)
+		}
+		level.Info(logger).Log("msg", "moved overlapping block aside", "block", f.Name(), "to", filepath.Join(dir, overwrittenDir))
+		moved = append(moved, f.Name())
+	}
+	return moved, nil
+}
+
+func isOverwritable(blockDir string, mint, maxt int64, names map[string]struct{}, logger log.Logger) (bool, error) {
+	b, err := tsdb.OpenBlock(logger, blockDir, nil)
+	if err != nil {
+		return false, err
+	}
+	defer b.Close()
+
+	// Block ranges are half-open.
+	if b.MinTime() > maxt || b.MaxTime() <= mint {
+		return false, nil
+	}
+
+	backfilled, err := isBackfilledBlock(blockDir)
+	if err != nil {
+		return false, err
+	}
+	if !backfilled {
+		level.Warn(logger).Log("msg", "not overwriting overlapping block not created by the backfiller", "block", filepath.Base(blockDir))
+		return false, nil
+	}
+
+	ir, err := b.Index()
+	if err != nil {
+		return false, err
+	}
+	defer ir.Close()
+
+	values, err := ir.LabelValues(labels.MetricName)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range values {
+		if _, ok := names[v]; !ok {
+			level.Warn(logger).Log("msg", "not overwriting overlapping block with unrelated series", "block", filepath.Base(blockDir), "metric", v)
+			return false, nil
+		}
+	}
+	return true, nil
+}
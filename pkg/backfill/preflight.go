@@ -0,0 +1,63 @@
+package backfill
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// lookbackDelta is the lookback delta of the query engine, which isn't exported.
+const lookbackDelta = 5 * time.Minute
+
+// hasSourceData reports whether any selector of the rule matches series in
+// the source within the rule's range, widened by how far back the expression
+// looks. Rules without selectors, like vector(1), always have data.
+func hasSourceData(ctx context.Context, q storage.Queryable, rule *recordingRule) (bool, error) {
+	sets := rule.selectors()
+	if len(sets) == 0 {
+		return true, nil
+	}
+
+	mint := rule.tr.start.Add(-rule.lookback())
+	querier, err := q.Querier(ctx, timestamp.FromTime(mint), timestamp.FromTime(rule.tr.end))
+	if err != nil {
+		return false, err
+	}
+	defer querier.Close()
+
+	for _, matchers := range sets {
+		ss, _, err := querier.Select(false, nil, matchers...)
+		if err != nil {
+			return false, err
+		}
+		if ss.Next() {
+			return true, nil
+		}
+		if err := ss.Err(); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// lookback returns an upper bound of how far before an evaluation timestamp
+// the rule's expression reads data: the sum of all offsets and ranges plus
+// the lookback delta.
+func (r *recordingRule) lookback() time.Duration {
+	d := lookbackDelta
+	parser.Inspect(r.vector, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			d += n.Offset
+		case *parser.MatrixSelector:
+			d += n.Range
+		case *parser.SubqueryExpr:
+			d += n.Range + n.Offset
+		}
+		return nil
+	})
+	return d
+}
@@ -0,0 +1,53 @@
+package backfill
+
+import (
+	"os"
+	"runtime"
+	"runtime/pprof"
+
+	"github.com/pkg/errors"
+	tsdb_errors "github.com/prometheus/prometheus/tsdb/errors"
+)
+
+// startProfiles starts a CPU profile written to cpuFile if set and returns a
+// function that stops it and writes a heap profile to memFile if set.
+func startProfiles(cpuFile, memFile string) (func() error, error) {
+	var cpu *os.File
+	if cpuFile != "" {
+		f, err := os.Create(cpuFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "create CPU profile")
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, errors.Wrap(err, "start CPU profile")
+		}
+		cpu = f
+	}
+
+	return func() error {
+		var merr tsdb_errors.MultiError
+		if cpu != nil {
+			pprof.StopCPUProfile()
+			merr.Add(errors.Wrap(cpu.Close(), "write CPU profile"))
+		}
+		if memFile != "" {
+			merr.Add(errors.Wrap(writeHeapProfile(memFile), "write heap profile"))
+		}
+		return merr.Err()
+	}, nil
+}
+
+func writeHeapProfile(file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	// Collect garbage to get up-to-date statistics of the live heap.
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
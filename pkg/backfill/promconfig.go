@@ -0,0 +1,84 @@
+package backfill
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/config"
+)
+
+// applyPrometheusConfig resolves the eval intervals of the rules like the
+// Prometheus server configured by opts.PrometheusConfigFile: the interval of
+// their group, or else the global evaluation_interval, which becomes
+// opts.EvalInterval. A set opts.EvalInterval overrides both, and so does
+// opts.AutoEvalInterval.
+func (b *Backfiller) applyPrometheusConfig(opts *Options, rules []*recordingRule, localRuleFile bool) error {
+	if opts.PrometheusConfigFile == "" || opts.EvalInterval > 0 || opts.AutoEvalInterval {
+		if opts.PrometheusConfigFile != "" {
+			level.Info(b.logger).Log("msg", "the eval interval is set, ignoring the intervals of the Prometheus config", "config", opts.PrometheusConfigFile)
+		}
+		// Without the config, the intervals of the groups are ignored.
+		for _, rule := range rules {
+			rule.interval = 0
+		}
+		return nil
+	}
+
+	cfg, err := config.LoadFile(opts.PrometheusConfigFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load Prometheus config")
+	}
+	opts.EvalInterval = time.Duration(cfg.GlobalConfig.EvaluationInterval)
+
+	if localRuleFile && !matchesRuleFiles(cfg.RuleFiles, opts.RuleFile) {
+		level.Warn(b.logger).Log("msg", "the rule file isn't one of the rule_files of the Prometheus config", "rule_file", opts.RuleFile, "config", opts.PrometheusConfigFile)
+	}
+	// The rules of a group are next to each other.
+	groups := 0
+	for i, rule := range rules {
+		if rule.interval > 0 && (i == 0 || rules[i-1].group != rule.group) {
+			groups++
+		}
+	}
+	level.Info(b.logger).Log("msg", "using the eval intervals of the Prometheus config", "eval_interval", opts.EvalInterval, "groups_with_interval", groups)
+	return nil
+}
+
+// matchesRuleFiles returns whether file matches one of the rule_files
+// patterns, which config.LoadFile resolved relative to the config file.
+func matchesRuleFiles(patterns []string, file string) bool {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return false
+	}
+	for _, p := range patterns {
+		if p, err := filepath.Abs(p); err == nil {
+			if ok, _ := filepath.Match(p, abs); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// evalInterval returns the interval the rule is evaluated at.
+func (r *recordingRule) evalInterval(opts Options) time.Duration {
+	if r.interval > 0 {
+		return r.interval
+	}
+	return opts.EvalInterval
+}
+
+// minEvalInterval returns the shortest eval interval of the rules,
+// opts.EvalInterval without rules.
+func minEvalInterval(rules []*recordingRule, opts Options) time.Duration {
+	interval := opts.EvalInterval
+	for i, rule := range rules {
+		if i == 0 || rule.evalInterval(opts) < interval {
+			interval = rule.evalInterval(opts)
+		}
+	}
+	return interval
+}
@@ -0,0 +1,198 @@
+package backfill
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	prom_rules "github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// activeQuerySlots is the number of queries the active query tracker holds.
+// Rules are evaluated one query at a time, queries beyond it would wait.
+const activeQuerySlots = 20
+
+// DefaultStepBatchSize is the default number of evaluation steps processed as
+// a batch, which is also the number of steps covered by a single range query.
+const DefaultStepBatchSize = 1000
+
+// queryEngines evaluates the rules with one query engine per max samples
+// limit and timeout, as they are settings of the engine. Only the engine of
+// the global limit and timeout registers metrics. The engines share the active query tracker.
+type queryEngines struct {
+	q           storage.Queryable
+	maxSamples  int
+	timeout     time.Duration
+	logger      log.Logger
+	queryLogger promql.QueryLogger
+	tracker     *promql.ActiveQueryTracker
+	engines     map[engineKey]*promql.Engine
+}
+
+// engineKey identifies the engine of a max samples limit and timeout.
+type engineKey struct {
+	maxSamples int
+	timeout    time.Duration
+}
+
+func newQueryEngines(q storage.Queryable, maxSamples int, timeout time.Duration, logger log.Logger, reg prometheus.Registerer, tracker *promql.ActiveQueryTracker) *queryEngines {
+	e := newQueryEngine(maxSamples, timeout, logger, reg, tracker)
+	e.SetQueryLogger(nil)
+	return &queryEngines{
+		q:          q,
+		maxSamples: maxSamples,
+		timeout:    timeout,
+		logger:     logger,
+		tracker:    tracker,
+		engines:    map[engineKey]*promql.Engine{{maxSamples, timeout}: e},
+	}
+}
+
+// setQueryLogger sets the query logger of all engines.
+func (e *queryEngines) setQueryLogger(l promql.QueryLogger) {
+	e.queryLogger = l
+	for _, engine := range e.engines {
+		engine.SetQueryLogger(l)
+	}
+}
+
+// engine returns the engine of the rule's max samples limit and timeout, the
+// global timeout if timeout is 0.
+func (e *queryEngines) engine(rule *recordingRule, timeout time.Duration) *promql.Engine {
+	key := engineKey{maxSamples: e.maxSamples, timeout: e.timeout}
+	if rule.maxSamples > 0 {
+		key.maxSamples = rule.maxSamples
+	}
+	if timeout > 0 {
+		key.timeout = timeout
+	}
+	engine, ok := e.engines[key]
+	if !ok {
+		engine = newQueryEngine(key.maxSamples, key.timeout, e.logger, nil, e.tracker)
+		engine.SetQueryLogger(e.queryLogger)
+		e.engines[key] = engine
+	}
+	return engine
+}
+
+// queryFunc returns the instant query function of the rule.
+func (e *queryEngines) queryFunc(rule *recordingRule) prom_rules.QueryFunc {
+	return prom_rules.EngineQueryFunc(e.engine(rule, 0), e.q)
+}
+
+// rangeQueryFunc returns the range query function of the rule.
+func (e *queryEngines) rangeQueryFunc(rule *recordingRule) rangeQueryFunc {
+	return engineRangeQueryFunc(e.engine(rule, 0), e.q)
+}
+
+// withTimeout returns the instant and range query functions of the rule with
+// the given query timeout instead of the global one.
+func (e *queryEngines) withTimeout(rule *recordingRule, timeout time.Duration) (prom_rules.QueryFunc, rangeQueryFunc) {
+	engine := e.engine(rule, timeout)
+	return prom_rules.EngineQueryFunc(engine, e.q), engineRangeQueryFunc(engine, e.q)
+}
+
+// rangeQueryFunc evaluates an expression at every step in [start, end] with a
+// single range query and returns the result of each step by its timestamp.
+type rangeQueryFunc func(ctx context.Context, qs string, start, end int64, interval time.Duration) (map[int64]promql.Vector, error)
+
+func engineRangeQueryFunc(engine *promql.Engine, q storage.Queryable) rangeQueryFunc {
+	return func(ctx context.Context, qs string, start, end int64, interval time.Duration) (map[int64]promql.Vector, error) {
+		q, err := engine.NewRangeQuery(q, qs, timestamp.Time(start), timestamp.Time(end), interval)
+		if err != nil {
+			return nil, err
+		}
+		defer q.Close()
+
+		res := q.Exec(ctx)
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		matrix, ok := res.Value.(promql.Matrix)
+		if !ok {
+			return nil, errors.Errorf("range query result is %s, not a matrix", res.Value.Type())
+		}
+
+		vectors := make(map[int64]promql.Vector)
+		for _, series := range matrix {
+			for _, p := range series.Points {
+				vectors[p.T] = append(vectors[p.T], promql.Sample{Point: p, Metric: series.Metric})
+			}
+		}
+		return vectors, nil
+	}
+}
+
+// shiftVectors returns the range query result vectors with their timestamps
+// moved by offset milliseconds.
+func shiftVectors(vectors map[int64]promql.Vector, offset int64) map[int64]promql.Vector {
+	shifted := make(map[int64]promql.Vector, len(vectors))
+	for t, v := range vectors {
+		shifted[t+offset] = v
+	}
+	return shifted
+}
+
+// numSamples returns the number of samples of a range query result.
+func numSamples(vectors map[int64]promql.Vector) int {
+	n := 0
+	for _, v := range vectors {
+		n += len(v)
+	}
+	return n
+}
+
+// observeQuery records the duration of a query of the rule and logs it if it
+// took longer than threshold. kvs describe the evaluated time range.
+func (b *Backfiller) observeQuery(rule *recordingRule, rr *RuleResult, threshold, d time.Duration, samples int, kvs ...interface{}) {
+	b.metrics.queryDuration.WithLabelValues(rule.group, rule.name).Observe(d.Seconds())
+	if d > rr.MaxQueryDuration {
+		rr.MaxQueryDuration = d
+	}
+	if threshold <= 0 || d <= threshold {
+		return
+	}
+	rr.SlowQueries++
+	kvs = append([]interface{}{"msg", "slow query", "rule", rule.name, "group", rule.group}, kvs...)
+	level.Warn(b.logger).Log(append(kvs, "duration", d, "samples", samples)...)
+}
+
+// useRangeQuery reports whether the rule can be evaluated with range queries.
+// Subqueries are left to instant queries, as they can behave differently in a
+// range context.
+func (r *recordingRule) useRangeQuery() bool {
+	ok := true
+	parser.Inspect(r.vector, func(node parser.Node, _ []parser.Node) error {
+		if _, sq := node.(*parser.SubqueryExpr); sq {
+			ok = false
+		}
+		return nil
+	})
+	return ok
+}
+
+// newActiveQueryTracker returns an active query tracker in dir, which logs
+// the queries left in its file by a previous run.
+func newActiveQueryTracker(dir string, logger log.Logger) (*promql.ActiveQueryTracker, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	// The tracker panics if it can't create its file.
+	f, err := os.OpenFile(filepath.Join(dir, "queries.active"), os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return promql.NewActiveQueryTracker(dir, activeQuerySlots, logger), nil
+}
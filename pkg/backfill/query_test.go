@@ -0,0 +1,58 @@
+package backfill
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	prom_rules "github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// BenchmarkRangeVsInstant compares evaluating a rule over an hour of steps
+// with one range query to evaluating it with an instant query per step.
+func BenchmarkRangeVsInstant(b *testing.B) {
+	var samples []*tsdb.MetricSample
+	for d := time.Duration(0); d < 2*time.Hour; d += 15 * time.Second {
+		for i := 0; i < 100; i++ {
+			lset := labels.FromStrings("__name__", "requests_total", "job", "api", "instance", "host-"+strconv.Itoa(i%10), "path", "/"+strconv.Itoa(i))
+			samples = append(samples, &tsdb.MetricSample{Labels: lset, TimestampMs: testStart + d.Milliseconds(), Value: float64(i) * d.Seconds()})
+		}
+	}
+	head, err := tsdb.CreateHead(samples, (2 * time.Hour).Milliseconds(), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer head.Close()
+	src := &openMetricsSource{head: head}
+	engine := newQueryEngine(50000000, 2*time.Minute, nil, nil, nil)
+
+	const (
+		qs       = "sum by (instance) (rate(requests_total[5m]))"
+		interval = 30 * time.Second
+	)
+	start, end := testStart+time.Hour.Milliseconds(), testStart+2*time.Hour.Milliseconds()-1
+	ctx := context.Background()
+
+	b.Run("range", func(b *testing.B) {
+		query := engineRangeQueryFunc(engine, src)
+		for i := 0; i < b.N; i++ {
+			if _, err := query(ctx, qs, start, end, interval); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("instant", func(b *testing.B) {
+		query := prom_rules.EngineQueryFunc(engine, src)
+		for i := 0; i < b.N; i++ {
+			for t := start; t <= end; t += interval.Milliseconds() {
+				if _, err := query(ctx, qs, timestamp.Time(t)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
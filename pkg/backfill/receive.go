@@ -0,0 +1,309 @@
+package backfill
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+const (
+	// DefaultReceiveTenantHeader is the header Thanos Receive reads the
+	// tenant of the samples from by default.
+	DefaultReceiveTenantHeader = "THANOS-TENANT"
+	// DefaultReceiveTimeout is the default timeout of a request to receive.
+	DefaultReceiveTimeout = 30 * time.Second
+	// DefaultReceiveBatchSize is the default maximum number of samples of a
+	// request to receive.
+	DefaultReceiveBatchSize = 5000
+	// DefaultReceiveMaxRetries is the default number of retries of a failed
+	// request to receive.
+	DefaultReceiveMaxRetries = 5
+
+	// ReceiveCompressionSnappy compresses the requests with snappy, as the
+	// remote write protocol requires.
+	ReceiveCompressionSnappy = "snappy"
+	// ReceiveCompressionNone sends the requests uncompressed, for endpoints
+	// that don't support snappy or for debugging.
+	ReceiveCompressionNone = "none"
+)
+
+// maxReceiveBackoff caps the doubling backoff between retries.
+const maxReceiveBackoff = 30 * time.Second
+
+// ReceiveOptions configures sending the samples to a Thanos Receive, or
+// another remote write endpoint, instead of writing blocks.
+type ReceiveOptions struct {
+	// URL is the http or https URL of the remote write endpoint, e.g.
+	// http://receive:19291/api/v1/receive.
+	URL string
+	// Tenant is sent in TenantHeader, DefaultReceiveTenantHeader if empty,
+	// if set.
+	Tenant, TenantHeader string
+	// The CA file is used to verify the server instead of the system roots if
+	// set, the certificate and key files are sent as the client certificate
+	// if set.
+	CAFile, CertFile, KeyFile string
+	ServerName                string
+	InsecureSkipVerify        bool
+	// The token in BearerTokenFile is sent as a bearer token if set.
+	BearerTokenFile string
+	// Timeout is the timeout of a request, DefaultReceiveTimeout if 0.
+	Timeout time.Duration
+	// BatchSize is the maximum number of samples of a request,
+	// DefaultReceiveBatchSize if 0.
+	BatchSize int
+	// MaxRetries is the number of retries of requests failing with a network
+	// error, 429 Too Many Requests or a 5xx status, with a doubling backoff.
+	MaxRetries int
+	// Compression is ReceiveCompressionSnappy, the default if empty, or
+	// ReceiveCompressionNone.
+	Compression string
+	// ReplicationAware counts requests rejected with 409 Conflict as
+	// ingested, as receive rejects samples it already has, e.g. on a re-run
+	// or the retry of a request that reached some of the replicas.
+	ReplicationAware bool
+}
+
+// receiveSeries is a series of a request, with its samples in order.
+type receiveSeries struct {
+	lset    labels.Labels
+	samples []*tsdb.MetricSample
+}
+
+// receiveClient sends samples to a remote write endpoint.
+type receiveClient struct {
+	opts   ReceiveOptions
+	client *http.Client
+	token  string
+	logger log.Logger
+	// conflicts is the number of requests rejected with 409 Conflict that
+	// were counted as ingested.
+	conflicts int
+}
+
+func newReceiveClient(opts ReceiveOptions, logger log.Logger) (*receiveClient, error) {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse receive URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.Errorf("unsupported scheme %q of receive URL", u.Scheme)
+	}
+	switch opts.Compression {
+	case "":
+		opts.Compression = ReceiveCompressionSnappy
+	case ReceiveCompressionSnappy, ReceiveCompressionNone:
+	default:
+		return nil, errors.Errorf("unknown compression %q", opts.Compression)
+	}
+	if opts.TenantHeader == "" {
+		opts.TenantHeader = DefaultReceiveTenantHeader
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultReceiveTimeout
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultReceiveBatchSize
+	}
+	c := &receiveClient{opts: opts, logger: logger, client: &http.Client{}}
+	if opts.CAFile != "" || opts.CertFile != "" || opts.KeyFile != "" || opts.ServerName != "" || opts.InsecureSkipVerify {
+		cfg, err := clientTLSConfig(opts.CAFile, opts.CertFile, opts.KeyFile, opts.ServerName, opts.InsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		c.client.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: cfg}
+	}
+	if opts.BearerTokenFile != "" {
+		if c.token, err = readSecret(opts.BearerTokenFile); err != nil {
+			return nil, errors.Wrap(err, "read bearer token file")
+		}
+	}
+	return c, nil
+}
+
+// send sends the samples in requests of up to the batch size. The samples
+// of a series stay in one request unless they are more than the batch size.
+func (c *receiveClient) send(ctx context.Context, mss []*tsdb.MetricSample) error {
+	var (
+		all   []*receiveSeries
+		index = map[uint64]*receiveSeries{}
+	)
+	for _, s := range mss {
+		h := s.Labels.Hash()
+		rs, ok := index[h]
+		if !ok {
+			rs = &receiveSeries{lset: s.Labels}
+			index[h] = rs
+			all = append(all, rs)
+		}
+		rs.samples = append(rs.samples, s)
+	}
+
+	var (
+		batch   []*receiveSeries
+		samples int
+	)
+	for _, rs := range all {
+		sort.SliceStable(rs.samples, func(i, j int) bool { return rs.samples[i].TimestampMs < rs.samples[j].TimestampMs })
+		for len(rs.samples) > 0 {
+			n := min(int64(len(rs.samples)), int64(c.opts.BatchSize-samples))
+			batch = append(batch, &receiveSeries{lset: rs.lset, samples: rs.samples[:n]})
+			rs.samples = rs.samples[n:]
+			if samples += int(n); samples == c.opts.BatchSize {
+				if err := c.sendBatch(ctx, batch); err != nil {
+					return err
+				}
+				batch, samples = nil, 0
+			}
+		}
+	}
+	if len(batch) > 0 {
+		return c.sendBatch(ctx, batch)
+	}
+	return nil
+}
+
+// sendBatch sends a request, retrying it on network errors, 429 Too Many
+// Requests and 5xx statuses. Rejected samples aren't retried.
+func (c *receiveClient) sendBatch(ctx context.Context, batch []*receiveSeries) error {
+	backoff := 100 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		status, body, err := c.post(ctx, batch)
+		switch {
+		case err == nil && status/100 == 2:
+			return nil
+		case err == nil && status == http.StatusConflict:
+			if c.opts.ReplicationAware {
+				c.conflicts++
+				level.Debug(c.logger).Log("msg", "receive already has samples of the request, counting it as ingested", "series", len(batch), "response", body)
+				return nil
+			}
+			return c.conflict(ctx, batch, body)
+		case err == nil && status != http.StatusTooManyRequests && status/100 != 5:
+			return errors.Errorf("receive rejected the samples with status %d: %s", status, body)
+		case err == nil:
+			err = errors.Errorf("status %d: %s", status, body)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt >= c.opts.MaxRetries {
+			return errors.Wrapf(err, "send samples to receive, giving up after %d retries", attempt)
+		}
+		level.Warn(c.logger).Log("msg", "failed to send samples to receive, retrying", "attempt", attempt+1, "backoff", backoff, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = time.Duration(min(int64(2*backoff), int64(maxReceiveBackoff)))
+	}
+}
+
+// conflict returns the error of a request rejected with 409 Conflict, which
+// receive replies for samples that are out of order, out of bounds or have
+// a different value than the one it has at their timestamp. It doesn't name
+// the series, so it's narrowed down by resending halves of the request.
+// Samples receive has already are accepted again if their values are equal,
+// so the resent samples don't conflict themselves.
+func (c *receiveClient) conflict(ctx context.Context, batch []*receiveSeries, body string) error {
+	for len(batch) > 1 {
+		half := batch[:len(batch)/2]
+		status, b, err := c.post(ctx, half)
+		if err != nil {
+			break
+		}
+		switch {
+		case status == http.StatusConflict:
+			batch, body = half, b
+		case status/100 == 2:
+			batch = batch[len(batch)/2:]
+		default:
+			return errors.Errorf("receive rejected samples of %d series as conflicting, and failed to narrow them down with status %d: %s", len(batch), status, b)
+		}
+	}
+	if len(batch) > 1 {
+		return errors.Errorf("receive rejected samples of %d series as conflicting: %s", len(batch), body)
+	}
+	// The samples are appended in order, so the oldest one is among the
+	// rejected ones.
+	s := batch[0].samples[0]
+	return errors.Errorf("receive rejected the samples of series %s from %s on as out of order, out of bounds or conflicting with its samples (%s), start the backfill after its newest sample in receive, or use --output.replication-aware if it has them from a previous run", batch[0].lset, timestamp.Time(s.TimestampMs).UTC().Format(time.RFC3339Nano), body)
+}
+
+// post sends a request and returns its status and the start of the body of
+// its response.
+func (c *receiveClient) post(ctx context.Context, batch []*receiveSeries) (int, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+
+	body, err := proto.Marshal(writeRequest(batch))
+	if err != nil {
+		return 0, "", errors.Wrap(err, "marshal write request")
+	}
+	if c.opts.Compression == ReceiveCompressionSnappy {
+		body = snappy.Encode(nil, body)
+	}
+	req, err := http.NewRequest(http.MethodPost, c.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	if c.opts.Compression == ReceiveCompressionSnappy {
+		req.Header.Set("Content-Encoding", "snappy")
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "backfiller")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if c.opts.Tenant != "" {
+		req.Header.Set(c.opts.TenantHeader, c.opts.Tenant)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return 0, "", errors.Wrap(err, "read response")
+	}
+	return resp.StatusCode, strings.TrimSpace(string(b)), nil
+}
+
+// writeRequest returns the remote write request of the series.
+func writeRequest(batch []*receiveSeries) *prompb.WriteRequest {
+	req := &prompb.WriteRequest{Timeseries: make([]prompb.TimeSeries, 0, len(batch))}
+	for _, rs := range batch {
+		ts := prompb.TimeSeries{
+			Labels:  make([]prompb.Label, 0, len(rs.lset)),
+			Samples: make([]prompb.Sample, 0, len(rs.samples)),
+		}
+		for _, l := range rs.lset {
+			ts.Labels = append(ts.Labels, prompb.Label{Name: l.Name, Value: l.Value})
+		}
+		for _, s := range rs.samples {
+			ts.Samples = append(ts.Samples, prompb.Sample{Value: s.Value, Timestamp: s.TimestampMs})
+		}
+		req.Timeseries = append(req.Timeseries, ts)
+	}
+	return req
+}
@@ -0,0 +1,296 @@
+package backfill
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// receiveRequest is a request received by a test receive server.
+type receiveRequest struct {
+	header http.Header
+	req    prompb.WriteRequest
+}
+
+// testReceive is a receive server replying to every request with the status
+// returned by reply, which gets the number of the request.
+type testReceive struct {
+	*httptest.Server
+	mtx      sync.Mutex
+	requests []receiveRequest
+}
+
+func newTestReceive(t *testing.T, reply func(n int, req prompb.WriteRequest) int) *testReceive {
+	r := &testReceive{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, hr *http.Request) {
+		body, err := ioutil.ReadAll(hr.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if hr.Header.Get("Content-Encoding") == "snappy" {
+			if body, err = snappy.Decode(nil, body); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		var req prompb.WriteRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			t.Error(err)
+			return
+		}
+		r.mtx.Lock()
+		r.requests = append(r.requests, receiveRequest{header: hr.Header, req: req})
+		n := len(r.requests)
+		r.mtx.Unlock()
+		w.WriteHeader(reply(n, req))
+	}))
+	return r
+}
+
+// testSamples returns n samples every second from 1s of each series.
+func testSamples(n int, series ...labels.Labels) []*tsdb.MetricSample {
+	var mss []*tsdb.MetricSample
+	for _, lset := range series {
+		for i := 1; i <= n; i++ {
+			mss = append(mss, &tsdb.MetricSample{Labels: lset, TimestampMs: int64(i) * 1000, Value: float64(i)})
+		}
+	}
+	return mss
+}
+
+func TestReceiveHeaders(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+	srv := newTestReceive(t, func(int, prompb.WriteRequest) int { return http.StatusNoContent })
+	defer srv.Close()
+
+	c, err := newReceiveClient(ReceiveOptions{
+		URL:             srv.URL,
+		Tenant:          "team-a",
+		BearerTokenFile: writeFile(t, dir, "token", "secret\n"),
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.send(context.Background(), testSamples(2, labels.FromStrings("__name__", "up", "job", "a"))); err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.requests) != 1 {
+		t.Fatalf("expected one request, got %d", len(srv.requests))
+	}
+	h := srv.requests[0].header
+	for name, want := range map[string]string{
+		DefaultReceiveTenantHeader:          "team-a",
+		"Authorization":                     "Bearer secret",
+		"Content-Type":                      "application/x-protobuf",
+		"Content-Encoding":                  "snappy",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	} {
+		if got := h.Get(name); got != want {
+			t.Errorf("header %s is %q, want %q", name, got, want)
+		}
+	}
+	ts := srv.requests[0].req.Timeseries
+	if len(ts) != 1 || len(ts[0].Samples) != 2 || ts[0].Samples[1].Timestamp != 2000 || ts[0].Samples[1].Value != 2 {
+		t.Fatalf("unexpected series %+v", ts)
+	}
+}
+
+func TestReceiveBatches(t *testing.T) {
+	srv := newTestReceive(t, func(int, prompb.WriteRequest) int { return http.StatusNoContent })
+	defer srv.Close()
+
+	c, err := newReceiveClient(ReceiveOptions{URL: srv.URL, BatchSize: 3}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := labels.FromStrings("__name__", "a"), labels.FromStrings("__name__", "b")
+	if err := c.send(context.Background(), testSamples(4, a, b)); err != nil {
+		t.Fatal(err)
+	}
+	// The samples of a series are split at the batch size, in order.
+	got := map[string][]int64{}
+	for _, r := range srv.requests {
+		n := 0
+		for _, ts := range r.req.Timeseries {
+			name := ts.Labels[0].Value
+			for _, s := range ts.Samples {
+				got[name] = append(got[name], s.Timestamp)
+				n++
+			}
+		}
+		if n > 3 {
+			t.Fatalf("request with %d samples, more than the batch size", n)
+		}
+	}
+	if len(srv.requests) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(srv.requests))
+	}
+	for _, name := range []string{"a", "b"} {
+		if want := []int64{1000, 2000, 3000, 4000}; !reflect.DeepEqual(got[name], want) {
+			t.Fatalf("timestamps of %s are %v, want %v", name, got[name], want)
+		}
+	}
+}
+
+func TestReceiveRetries(t *testing.T) {
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			// Fails the first three requests.
+			srv := newTestReceive(t, func(n int, _ prompb.WriteRequest) int {
+				if n <= 3 {
+					return status
+				}
+				return http.StatusNoContent
+			})
+			defer srv.Close()
+			mss := testSamples(1, labels.FromStrings("__name__", "up"))
+
+			c, err := newReceiveClient(ReceiveOptions{URL: srv.URL, MaxRetries: 3}, log.NewNopLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.send(context.Background(), mss); err != nil {
+				t.Fatalf("expected the third retry to succeed, got %v", err)
+			}
+			if len(srv.requests) != 4 {
+				t.Fatalf("expected 4 requests, got %d", len(srv.requests))
+			}
+
+			srv.requests = nil
+			c, err = newReceiveClient(ReceiveOptions{URL: srv.URL, MaxRetries: 2}, log.NewNopLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.send(context.Background(), mss); err == nil || !strings.Contains(err.Error(), "giving up after 2 retries") {
+				t.Fatalf("expected the request to be given up after 2 retries, got %v", err)
+			}
+			if len(srv.requests) != 3 {
+				t.Fatalf("expected 3 requests, got %d", len(srv.requests))
+			}
+		})
+	}
+}
+
+func TestReceiveConflicts(t *testing.T) {
+	// Rejects every request with a sample of the series with job="bad".
+	srv := newTestReceive(t, func(_ int, req prompb.WriteRequest) int {
+		for _, ts := range req.Timeseries {
+			for _, l := range ts.Labels {
+				if l.Name == "job" && l.Value == "bad" {
+					return http.StatusConflict
+				}
+			}
+		}
+		return http.StatusNoContent
+	})
+	defer srv.Close()
+	var series []labels.Labels
+	for _, job := range []string{"a", "b", "bad", "c", "d"} {
+		series = append(series, labels.FromStrings("__name__", "up", "job", job))
+	}
+	mss := testSamples(3, series...)
+
+	t.Run("replication aware", func(t *testing.T) {
+		c, err := newReceiveClient(ReceiveOptions{URL: srv.URL, ReplicationAware: true}, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.send(context.Background(), mss); err != nil {
+			t.Fatal(err)
+		}
+		if c.conflicts != 1 {
+			t.Fatalf("expected one conflicting request, got %d", c.conflicts)
+		}
+	})
+	t.Run("failing", func(t *testing.T) {
+		c, err := newReceiveClient(ReceiveOptions{URL: srv.URL}, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.send(context.Background(), mss)
+		if err == nil {
+			t.Fatal("expected the conflict to fail the backfill")
+		}
+		// The oldest sample of the rejected series.
+		for _, want := range []string{`{__name__="up", job="bad"}`, "from 1970-01-01T00:00:01Z on"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Fatalf("expected the error to contain %q, got %v", want, err)
+			}
+		}
+	})
+}
+
+func TestReceiveCompression(t *testing.T) {
+	for _, tc := range []struct {
+		compression string
+		encoding    string
+	}{
+		{compression: "", encoding: "snappy"},
+		{compression: ReceiveCompressionSnappy, encoding: "snappy"},
+		{compression: ReceiveCompressionNone},
+	} {
+		t.Run(tc.compression, func(t *testing.T) {
+			var (
+				encoding string
+				req      prompb.WriteRequest
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, hr *http.Request) {
+				encoding = hr.Header.Get("Content-Encoding")
+				body, err := ioutil.ReadAll(hr.Body)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if encoding == "snappy" {
+					if body, err = snappy.Decode(nil, body); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				if err := proto.Unmarshal(body, &req); err != nil {
+					t.Error(err)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer srv.Close()
+
+			c, err := newReceiveClient(ReceiveOptions{URL: srv.URL, Compression: tc.compression}, log.NewNopLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			lset := labels.FromStrings("__name__", "up", "job", "a")
+			if err := c.send(context.Background(), testSamples(2, lset)); err != nil {
+				t.Fatal(err)
+			}
+			if encoding != tc.encoding {
+				t.Fatalf("Content-Encoding is %q, want %q", encoding, tc.encoding)
+			}
+			want := prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+				Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 2, Timestamp: 2000}},
+			}}}
+			if !reflect.DeepEqual(req, want) {
+				t.Fatalf("received %+v, want %+v", req, want)
+			}
+		})
+	}
+
+	if _, err := newReceiveClient(ReceiveOptions{URL: "http://localhost", Compression: "gzip"}, log.NewNopLogger()); err == nil {
+		t.Fatal("expected an unknown compression to be rejected")
+	}
+}
@@ -0,0 +1,28 @@
+package backfill
+
+import (
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"gopkg.in/yaml.v2"
+)
+
+// loadRelabelConfigs reads the YAML list of relabel configs in filename, in
+// the format of the metric_relabel_configs of a scrape config.
+func loadRelabelConfigs(filename string) ([]*relabel.Config, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var cfgs []*relabel.Config
+	if err := yaml.UnmarshalStrict(b, &cfgs); err != nil {
+		return nil, errors.Wrap(err, filename)
+	}
+	for i, cfg := range cfgs {
+		if cfg == nil {
+			return nil, errors.Errorf("%s: empty relabel config %d", filename, i)
+		}
+	}
+	return cfgs, nil
+}
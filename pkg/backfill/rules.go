@@ -0,0 +1,319 @@
+package backfill
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/rulefmt"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+	"gopkg.in/yaml.v2"
+)
+
+type recordingRule struct {
+	name   string
+	group  string
+	vector parser.Expr
+	lset   labels.Labels
+	// tmplLabels are the labels whose values are templates expanded per sample.
+	tmplLabels labels.Labels
+	// limit is the maximum number of series a single evaluation may produce, 0 means no limit.
+	limit int
+	// maxSamples is the max samples limit of the rule's queries, 0 means the global limit.
+	maxSamples int
+	// queryOffset is the query_offset of the rule group, the rule is
+	// evaluated at every step minus the offset.
+	queryOffset time.Duration
+	// interval is the interval of the rule group, which is used instead of
+	// Options.EvalInterval with Options.PrometheusConfigFile.
+	interval time.Duration
+	// start and end are the backfill range annotated on the rule group, if any.
+	start, end string
+	// tenant is the tenant of the rule with Options.TenantFromRules.
+	tenant string
+	// tr is the effective backfill range of the rule.
+	tr *timeRange
+	// timestamps are the explicit evaluation timestamps in tr, nil to
+	// evaluate every eval interval.
+	timestamps []int64
+	// gaps are the gaps of the recorded series the timestamps fill, with
+	// Options.FillGapsFrom.
+	gaps []Gap
+	// expired is the part of the requested range older than
+	// Options.SkipOlderThan or Options.DestRetention, which is skipped.
+	expired time.Duration
+}
+
+const (
+	// annotationStart and annotationEnd are the rule group annotations
+	// holding the default backfill range of the group.
+	annotationStart = "backfill.start"
+	annotationEnd   = "backfill.end"
+	// annotationTenant is the rule group annotation holding the tenant of
+	// its rules.
+	annotationTenant = "backfill.tenant"
+)
+
+// ruleFileExtensions holds the fields of a rule file this version of rulefmt
+// doesn't know about. A rule's limit takes precedence over the limit of its group.
+type ruleFileExtensions struct {
+	Groups []struct {
+		Limit       int               `yaml:"limit"`
+		QueryOffset model.Duration    `yaml:"query_offset"`
+		Annotations map[string]string `yaml:"annotations"`
+		Rules       []struct {
+			Limit int `yaml:"limit"`
+		} `yaml:"rules"`
+	} `yaml:"groups"`
+}
+
+// parseRules parses the recording rules of the rule file named filename with
+// the content b.
+func parseRules(b []byte, filename string, logger log.Logger) ([]*recordingRule, []error) {
+	rgs, errs := rulefmt.Parse(b)
+	if errs != nil {
+		// Explain the parse errors of syntax the engine predates first.
+		errs = append(unsupportedFeatures(b), errs...)
+		for i := range errs {
+			errs[i] = errors.Wrap(errs[i], filename)
+		}
+		return nil, errs
+	}
+	var ext ruleFileExtensions
+	if err := yaml.Unmarshal(b, &ext); err != nil {
+		return nil, []error{errors.Wrap(err, filename)}
+	}
+
+	var rules []*recordingRule
+	for i, rg := range rgs.Groups {
+		start, end := ext.annotation(i, annotationStart), ext.annotation(i, annotationEnd)
+		for _, a := range []string{start, end} {
+			if a == "" {
+				continue
+			}
+			if _, err := parseTime(a); err != nil {
+				return nil, []error{errors.Wrapf(err, "%s: group %s", filename, rg.Name)}
+			}
+		}
+
+		for j, rule := range rg.Rules {
+			// We only consider recording rules.
+			if rule.Record.Value != "" {
+				expr, err := parser.ParseExpr(rule.Expr.Value)
+				if err != nil {
+					level.Error(logger).Log("msg", "failed to parse expr", "expr", rule.Expr, "err", err)
+					return nil, []error{errors.Wrap(err, filename)}
+				}
+				static, tmpl := make(map[string]string), make(map[string]string)
+				for k, v := range rule.Labels {
+					if isTemplate(v) {
+						tmpl[k] = v
+					} else {
+						static[k] = v
+					}
+				}
+				if err := checkLabelTemplates(rule.Record.Value, labels.FromMap(tmpl)); err != nil {
+					level.Error(logger).Log("msg", "failed to parse label template", "rule", rule.Record.Value, "err", err)
+					return nil, []error{errors.Wrap(err, filename)}
+				}
+				rules = append(rules, &recordingRule{
+					name:        rule.Record.Value,
+					group:       rg.Name,
+					vector:      expr,
+					lset:        labels.FromMap(static),
+					tmplLabels:  labels.FromMap(tmpl),
+					limit:       ext.limit(i, j),
+					queryOffset: ext.queryOffset(i),
+					interval:    time.Duration(rg.Interval),
+					start:       start,
+					end:         end,
+					tenant:      ext.annotation(i, annotationTenant),
+				})
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// checkExpressions evaluates the expression of every rule against empty data
+// to find the rules that parse but fail to evaluate regardless of the data,
+// e.g. because they don't return an instant vector or a scalar.
+func checkExpressions(ctx context.Context, rules []*recordingRule, engine *promql.Engine) []error {
+	empty := storage.QueryableFunc(func(context.Context, int64, int64) (storage.Querier, error) {
+		return storage.NoopQuerier(), nil
+	})
+
+	var errs []error
+	for _, rule := range rules {
+		if t := rule.vector.Type(); t != parser.ValueTypeVector && t != parser.ValueTypeScalar {
+			errs = append(errs, errors.Errorf("rule %s in group %s returns a %s instead of an instant vector or a scalar", rule.name, rule.group, parser.DocumentedType(t)))
+			continue
+		}
+		q, err := engine.NewInstantQuery(empty, rule.vector.String(), time.Unix(0, 0))
+		if err == nil {
+			err = q.Exec(ctx).Err
+			q.Close()
+		}
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "rule %s in group %s", rule.name, rule.group))
+		}
+	}
+	return errs
+}
+
+// filterGroups returns the rules of the included groups, or of all groups if
+// none are included, minus the rules of the excluded groups. Every named group
+// has to contain recording rules.
+func filterGroups(rules []*recordingRule, include, exclude []string) ([]*recordingRule, error) {
+	groups := make(map[string]struct{}, len(rules))
+	for _, r := range rules {
+		groups[r.group] = struct{}{}
+	}
+	toSet := func(names []string) (map[string]struct{}, error) {
+		set := make(map[string]struct{}, len(names))
+		for _, n := range names {
+			if _, ok := groups[n]; !ok {
+				return nil, errors.Errorf("no recording rules in group %q", n)
+			}
+			set[n] = struct{}{}
+		}
+		return set, nil
+	}
+	inc, err := toSet(include)
+	if err != nil {
+		return nil, err
+	}
+	exc, err := toSet(exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*recordingRule
+	for _, r := range rules {
+		if _, ok := inc[r.group]; len(inc) > 0 && !ok {
+			continue
+		}
+		if _, ok := exc[r.group]; ok {
+			continue
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// excludeRules returns the rules minus those matching any of the selectors,
+// like `job:up:sum` or `job:up:sum{env="prod"}`, which match the record name
+// as the metric name and the static labels of the rules. Every selector has to
+// match a rule.
+func excludeRules(rules []*recordingRule, selectors []string, logger log.Logger) ([]*recordingRule, error) {
+	if len(selectors) == 0 {
+		return rules, nil
+	}
+	sets := make([][]*labels.Matcher, 0, len(selectors))
+	for _, sel := range selectors {
+		ms, err := parser.ParseMetricSelector(sel)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid rule exclusion %q", sel)
+		}
+		sets = append(sets, ms)
+	}
+
+	matched := make([]bool, len(sets))
+	var res []*recordingRule
+	for _, r := range rules {
+		lset := labels.NewBuilder(r.lset).Set(labels.MetricName, r.name).Labels()
+		excluded := false
+		for i, ms := range sets {
+			if matchLabels(ms, lset) {
+				matched[i], excluded = true, true
+			}
+		}
+		if excluded {
+			level.Info(logger).Log("msg", "excluding rule", "rule", r.name, "group", r.group, "labels", r.lset)
+			continue
+		}
+		res = append(res, r)
+	}
+	for i, sel := range selectors {
+		if !matched[i] {
+			return nil, errors.Errorf("no recording rule matches %q", sel)
+		}
+	}
+	return res, nil
+}
+
+func (e *ruleFileExtensions) limit(group, rule int) int {
+	if group >= len(e.Groups) {
+		return 0
+	}
+	g := e.Groups[group]
+	if rule < len(g.Rules) && g.Rules[rule].Limit > 0 {
+		return g.Rules[rule].Limit
+	}
+	return g.Limit
+}
+
+func (e *ruleFileExtensions) queryOffset(group int) time.Duration {
+	if group >= len(e.Groups) {
+		return 0
+	}
+	return time.Duration(e.Groups[group].QueryOffset)
+}
+
+func (e *ruleFileExtensions) annotation(group int, name string) string {
+	if group >= len(e.Groups) {
+		return ""
+	}
+	return e.Groups[group].Annotations[name]
+}
+
+// selectors returns the label matchers of every vector selector in the rule's expression.
+func (r *recordingRule) selectors() [][]*labels.Matcher {
+	var sets [][]*labels.Matcher
+	parser.Inspect(r.vector, func(node parser.Node, _ []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok {
+			sets = append(sets, vs.LabelMatchers)
+		}
+		return nil
+	})
+	return sets
+}
+
+// recordedMatchers returns the matchers of the series the rule records.
+func (r *recordingRule) recordedMatchers() []*labels.Matcher {
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, r.name)}
+	for _, l := range r.lset {
+		matchers = append(matchers, labels.MustNewMatcher(labels.MatchEqual, l.Name, l.Value))
+	}
+	return matchers
+}
+
+// parseOutputFilters parses label matchers like `namespace=~"prod-.*"`.
+func parseOutputFilters(filters []string) ([]*labels.Matcher, error) {
+	var matchers []*labels.Matcher
+	for _, f := range filters {
+		ms, err := parser.ParseMetricSelector("{" + f + "}")
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid output filter %q", f)
+		}
+		matchers = append(matchers, ms...)
+	}
+	return matchers, nil
+}
+
+// matchLabels reports whether lset matches all matchers.
+func matchLabels(matchers []*labels.Matcher, lset labels.Labels) bool {
+	for _, m := range matchers {
+		if !m.Matches(lset.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
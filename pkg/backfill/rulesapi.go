@@ -0,0 +1,113 @@
+package backfill
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// apiRuleGroups is the response of the rules API of a Prometheus server.
+type apiRuleGroups struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		Groups []struct {
+			Name     string  `json:"name"`
+			File     string  `json:"file"`
+			Interval float64 `json:"interval"`
+			Limit    int     `json:"limit"`
+			Rules    []struct {
+				Type   string            `json:"type"`
+				Name   string            `json:"name"`
+				Query  string            `json:"query"`
+				Labels map[string]string `json:"labels"`
+			} `json:"rules"`
+		} `json:"groups"`
+	} `json:"data"`
+}
+
+// apiRuleFile is a rule file with the recording rules of the rules API.
+type apiRuleFile struct {
+	Groups []apiRuleFileGroup `yaml:"groups"`
+}
+
+type apiRuleFileGroup struct {
+	Name     string            `yaml:"name"`
+	Interval model.Duration    `yaml:"interval,omitempty"`
+	Limit    int               `yaml:"limit,omitempty"`
+	Rules    []apiRuleFileRule `yaml:"rules"`
+}
+
+type apiRuleFileRule struct {
+	Record string            `yaml:"record"`
+	Expr   string            `yaml:"expr"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// readAPIRules fetches the recording rules the Prometheus server at base
+// evaluates from its rules API and returns them as a rule file, with the URL
+// of the API without credentials.
+func readAPIRules(ctx context.Context, base string, opts RuleURLOptions) ([]byte, string, error) {
+	u, err := url.Parse(strings.TrimSuffix(base, "/") + "/api/v1/rules")
+	if err != nil {
+		return nil, "", errors.Wrap(err, "parse Prometheus URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, "", errors.Errorf("unsupported scheme %q of Prometheus URL", u.Scheme)
+	}
+	u.RawQuery = url.Values{"type": []string{"record"}}.Encode()
+	b, err := fetchRules(ctx, u, opts)
+	u.User = nil
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "fetch rules from %s", u)
+	}
+	b, err = apiRulesToRuleFile(b)
+	return b, u.String(), errors.Wrapf(err, "rules from %s", u)
+}
+
+// apiRulesToRuleFile converts a response of the rules API into a rule file
+// with its recording rules. Groups without recording rules are left out.
+func apiRulesToRuleFile(b []byte) ([]byte, error) {
+	var res apiRuleGroups
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, errors.Wrap(err, "parse response")
+	}
+	if res.Status != "success" {
+		return nil, errors.Errorf("request failed: %s", res.Error)
+	}
+
+	var rf apiRuleFile
+	files := map[string]string{}
+	for _, g := range res.Data.Groups {
+		rg := apiRuleFileGroup{
+			Name:     g.Name,
+			Interval: model.Duration(time.Duration(g.Interval * float64(time.Second))),
+			Limit:    g.Limit,
+		}
+		for _, r := range g.Rules {
+			if r.Type != "recording" {
+				continue
+			}
+			rg.Rules = append(rg.Rules, apiRuleFileRule{Record: r.Name, Expr: r.Query, Labels: r.Labels})
+		}
+		if len(rg.Rules) == 0 {
+			continue
+		}
+		// Groups are selected by name, which is only unique per file on the server.
+		if f, ok := files[g.Name]; ok {
+			return nil, errors.Errorf("group %s is defined in both %s and %s", g.Name, f, g.File)
+		}
+		files[g.Name] = g.File
+		rf.Groups = append(rf.Groups, rg)
+	}
+	if len(rf.Groups) == 0 {
+		return nil, errors.New("the server has no recording rules")
+	}
+	return yaml.Marshal(rf)
+}
@@ -0,0 +1,166 @@
+package backfill
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultRuleURLTimeout is the default timeout of fetching the rule file from a URL.
+const DefaultRuleURLTimeout = 30 * time.Second
+
+// RuleURLOptions configures fetching the rule file over HTTP instead of
+// reading it from disk, or the rules from the rules API of a Prometheus server.
+type RuleURLOptions struct {
+	// URL is the http or https URL the rule file is fetched from. It's
+	// empty with Options.RulesFromURL.
+	URL string
+	// Username and the password in PasswordFile are sent with basic auth if
+	// the username is set. The token in BearerTokenFile is sent as a bearer
+	// token if set.
+	Username, PasswordFile string
+	BearerTokenFile        string
+	// Timeout is the timeout of the request, DefaultRuleURLTimeout if 0.
+	Timeout time.Duration
+}
+
+// readRules returns the content of the rule file of opts and its name, which
+// is the URL without credentials for a fetched rule file.
+func readRules(ctx context.Context, opts Options) ([]byte, string, error) {
+	if opts.RulesFromURL != "" {
+		if opts.RuleFile != "" || opts.RuleURL.URL != "" {
+			return nil, "", errors.New("rules from a Prometheus server can't be combined with a rule file or a rule URL")
+		}
+		return readAPIRules(ctx, opts.RulesFromURL, opts.RuleURL)
+	}
+	if opts.RuleURL.URL == "" {
+		b, err := ioutil.ReadFile(opts.RuleFile)
+		return b, opts.RuleFile, err
+	}
+	if opts.RuleFile != "" {
+		return nil, "", errors.New("both a rule file and a rule URL are given")
+	}
+	u, err := url.Parse(opts.RuleURL.URL)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "parse rule URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, "", errors.Errorf("unsupported scheme %q of rule URL", u.Scheme)
+	}
+	b, err := fetchRules(ctx, u, opts.RuleURL)
+	u.User = nil
+	return b, u.String(), errors.Wrapf(err, "fetch rules from %s", u)
+}
+
+// ruleFileName returns the name readRules returns for the rule file of opts,
+// without reading it.
+func ruleFileName(opts Options) string {
+	raw := opts.RuleURL.URL
+	if opts.RulesFromURL != "" {
+		raw = strings.TrimSuffix(opts.RulesFromURL, "/") + "/api/v1/rules?type=record"
+	}
+	if raw == "" {
+		return opts.RuleFile
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	u.User = nil
+	return u.String()
+}
+
+func fetchRules(ctx context.Context, u *url.URL, opts RuleURLOptions) ([]byte, error) {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultRuleURLTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Username != "" {
+		var password string
+		if opts.PasswordFile != "" {
+			if password, err = readSecret(opts.PasswordFile); err != nil {
+				return nil, errors.Wrap(err, "read password file")
+			}
+		}
+		req.SetBasicAuth(opts.Username, password)
+	}
+	if opts.BearerTokenFile != "" {
+		token, err := readSecret(opts.BearerTokenFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read bearer token file")
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "read response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !isRulesContentType(ct) {
+		return nil, errors.Errorf("unexpected content type %q", ct)
+	}
+	return b, nil
+}
+
+// isRulesContentType reports whether a response of the content type can be a
+// rule file. Servers label YAML in many ways, so only types that clearly
+// aren't, like an HTML login page, are rejected.
+func isRulesContentType(ct string) bool {
+	if ct == "" {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mt == "text/html":
+		return false
+	case strings.HasPrefix(mt, "text/"), strings.Contains(mt, "yaml"), strings.Contains(mt, "json"), mt == "application/octet-stream":
+		return true
+	}
+	return false
+}
+
+// checkRulesSHA256 checks that the SHA-256 hash of the rule file b is the hex
+// encoded want.
+func checkRulesSHA256(b []byte, want string) error {
+	sum := sha256.Sum256(b)
+	if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, want) {
+		return errors.Errorf("SHA-256 hash of the rule file is %s, expected %s", got, want)
+	}
+	return nil
+}
+
+// readSecret reads a password or token from a file, without the trailing newline.
+func readSecret(file string) (string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
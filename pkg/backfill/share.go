@@ -0,0 +1,91 @@
+package backfill
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	prom_rules "github.com/prometheus/prometheus/rules"
+)
+
+// ruleEval is the evaluation state of a rule whose expression may be shared
+// with other rules.
+type ruleEval struct {
+	// idx is the index of the rule in the rules being backfilled.
+	idx       int
+	rule      *recordingRule
+	rr        *RuleResult
+	queryFunc prom_rules.QueryFunc
+	// headFallback is set once a sample of the rule wasn't accepted by the head.
+	headFallback bool
+	// series holds the series produced by the rule, examples the first of
+	// them to log if the rule exceeds the series limit.
+	series   map[uint64]struct{}
+	examples []string
+}
+
+// shareKey identifies the evaluations of a rule: rules with the same
+// expression, range, eval interval, explicit evaluation timestamps, query
+// offset and query limits get the same results.
+type shareKey struct {
+	expr        string
+	start, end  time.Time
+	interval    time.Duration
+	explicit    bool
+	timestamps  uint64
+	queryOffset time.Duration
+	maxSamples  int
+}
+
+// shareExpressions groups the indices of the rules that are evaluated
+// identically, in the order of their first rule. The expression of each group
+// is evaluated once and its results used for all of its rules.
+func shareExpressions(rules []*recordingRule, logger log.Logger) [][]int {
+	var (
+		shared [][]int
+		groups = map[shareKey]int{}
+	)
+	for i, rule := range rules {
+		key := shareKey{
+			expr:        rule.vector.String(),
+			start:       rule.tr.start,
+			end:         rule.tr.end,
+			interval:    rule.interval,
+			explicit:    rule.timestamps != nil,
+			timestamps:  hashTimestamps(rule.timestamps),
+			queryOffset: rule.queryOffset,
+			maxSamples:  rule.maxSamples,
+		}
+		if g, ok := groups[key]; ok {
+			shared[g] = append(shared[g], i)
+			continue
+		}
+		groups[key] = len(shared)
+		shared = append(shared, []int{i})
+	}
+	for _, idx := range shared {
+		if len(idx) < 2 {
+			continue
+		}
+		names := make([]string, 0, len(idx))
+		for _, i := range idx {
+			names = append(names, rules[i].group+"/"+rules[i].name)
+		}
+		level.Info(logger).Log("msg", "expression shared by several rules, evaluating it once", "expr", rules[idx[0]].vector.String(), "rules", len(idx), "names", strings.Join(names, ","))
+	}
+	return shared
+}
+
+// hashTimestamps returns a hash of the explicit evaluation timestamps ts.
+func hashTimestamps(ts []int64) uint64 {
+	h := fnv.New64a()
+	var b [8]byte
+	for _, t := range ts {
+		binary.LittleEndian.PutUint64(b[:], uint64(t))
+		h.Write(b[:])
+	}
+	return h.Sum64()
+}
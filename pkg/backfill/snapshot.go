@@ -0,0 +1,181 @@
+package backfill
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	tsdb_errors "github.com/prometheus/prometheus/tsdb/errors"
+)
+
+// SnapshotOptions configures a snapshot of the TSDB of a running Prometheus
+// server as the source, for a consistent view of live data without stopping
+// the server.
+type SnapshotOptions struct {
+	// Take takes a snapshot with the admin API of the server at PrometheusURL,
+	// which has to run with --web.enable-admin-api. The server creates it in
+	// the snapshots directory of its data directory, which has to be readable
+	// at Dir, e.g. by running on the same host or mounting the directory.
+	Take          bool
+	PrometheusURL string
+	Dir           string
+	// SkipHead leaves the in-memory data of the server out of a taken snapshot.
+	SkipHead bool
+	// Cleanup deletes a taken snapshot after the backfill.
+	Cleanup bool
+	// Path is a snapshot taken before, used instead of taking one.
+	Path string
+}
+
+// takeSnapshot takes a snapshot with the admin API of the Prometheus server at
+// u and returns its name.
+func takeSnapshot(ctx context.Context, u string, skipHead bool) (string, error) {
+	su, err := url.Parse(strings.TrimSuffix(u, "/") + "/api/v1/admin/tsdb/snapshot")
+	if err != nil {
+		return "", errors.Wrap(err, "parse Prometheus URL")
+	}
+	su.RawQuery = url.Values{"skip_head": []string{strconv.FormatBool(skipHead)}}.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, su.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "read response")
+	}
+	var res struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			Name string `json:"name"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return "", errors.Errorf("unexpected response with status %s: %s", resp.Status, b)
+	}
+	if res.Status != "success" {
+		return "", errors.Errorf("snapshot failed with status %s: %s", resp.Status, res.Error)
+	}
+	return res.Data.Name, nil
+}
+
+// openSnapshot returns the snapshot of opts as a source and the directory of
+// a taken snapshot.
+func openSnapshot(ctx context.Context, opts SnapshotOptions, logger log.Logger) (*blocksSource, string, error) {
+	if !opts.Take {
+		s, err := openBlocksSource(logger, opts.Path)
+		return s, "", err
+	}
+	if opts.PrometheusURL == "" || opts.Dir == "" {
+		return nil, "", errors.New("taking a snapshot requires the Prometheus URL and the directory the server's snapshots are readable at, i.e. the snapshots directory in its data directory, mounted if the server runs on another host")
+	}
+	name, err := takeSnapshot(ctx, opts.PrometheusURL, opts.SkipHead)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "take snapshot of %s", opts.PrometheusURL)
+	}
+	dir := filepath.Join(opts.Dir, name)
+	s, err := openBlocksSource(logger, dir)
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, dir, errors.Errorf("snapshot %s isn't in %s, it has to be the snapshots directory in the data directory of the server, mounted if the server runs on another host", name, opts.Dir)
+	}
+	return s, dir, err
+}
+
+// blocksSource is a directory of blocks, e.g. a TSDB snapshot, used as the
+// source data. The blocks are only read, nothing is written into the directory.
+type blocksSource struct {
+	blocks []*tsdb.Block
+}
+
+// openBlocksSource opens the blocks in the dirs.
+func openBlocksSource(logger log.Logger, dirs ...string) (*blocksSource, error) {
+	s := &blocksSource{}
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		for _, f := range files {
+			if _, err := ulid.ParseStrict(f.Name()); err != nil || !f.IsDir() {
+				continue
+			}
+			b, err := tsdb.OpenBlock(logger, filepath.Join(dir, f.Name()), nil)
+			if err != nil {
+				s.Close()
+				return nil, errors.Wrapf(err, "open block %s", f.Name())
+			}
+			s.blocks = append(s.blocks, b)
+		}
+	}
+	if len(s.blocks) == 0 {
+		return nil, errors.Errorf("no blocks in %s", strings.Join(dirs, ", "))
+	}
+	return s, nil
+}
+
+func (s *blocksSource) MinTime() int64 {
+	minTime := int64(math.MaxInt64)
+	for _, b := range s.blocks {
+		minTime = min(minTime, b.MinTime())
+	}
+	return minTime
+}
+
+// MaxTime is the newest timestamp in the blocks, whose ranges are half-open.
+func (s *blocksSource) MaxTime() int64 {
+	maxTime := int64(math.MinInt64)
+	for _, b := range s.blocks {
+		maxTime = max(maxTime, b.MaxTime()-1)
+	}
+	return maxTime
+}
+
+func (s *blocksSource) Querier(_ context.Context, mint, maxt int64) (storage.Querier, error) {
+	var queriers []storage.Querier
+	for _, b := range s.blocks {
+		if !b.OverlapsClosedInterval(mint, maxt) {
+			continue
+		}
+		q, err := tsdb.NewBlockQuerier(b, mint, maxt)
+		if err != nil {
+			for _, q := range queriers {
+				q.Close()
+			}
+			return nil, errors.Wrapf(err, "open querier for block %s", b.Meta().ULID)
+		}
+		queriers = append(queriers, q)
+	}
+	if len(queriers) == 0 {
+		return storage.NoopQuerier(), nil
+	}
+	// Like the fanout storage, the primary querier is part of the queriers.
+	return storage.NewMergeQuerier(queriers[0], queriers, storage.ChainedSeriesMerge), nil
+}
+
+func (s *blocksSource) Close() error {
+	var merr tsdb_errors.MultiError
+	for _, b := range s.blocks {
+		merr.Add(b.Close())
+	}
+	return merr.Err()
+}
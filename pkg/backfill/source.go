@@ -0,0 +1,155 @@
+package backfill
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	tsdb_errors "github.com/prometheus/prometheus/tsdb/errors"
+	"github.com/prometheus/prometheus/tsdb/wal"
+)
+
+// source is the data the recording rules are evaluated against.
+type source interface {
+	storage.Queryable
+	MinTime() int64
+	MaxTime() int64
+	Close() error
+}
+
+// tsdbSource is a TSDB directory used as the source data.
+type tsdbSource struct {
+	*tsdb.DB
+}
+
+func openTSDBSource(dir string, logger log.Logger, reg prometheus.Registerer) (*tsdbSource, error) {
+	opts := &tsdb.Options{
+		WALSegmentSize: wal.DefaultSegmentSize,
+		NoLockfile:     true,
+	}
+
+	db, err := tsdb.Open(dir, logger, reg, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &tsdbSource{db}, nil
+}
+
+func (s *tsdbSource) MinTime() int64 {
+	minTime := s.Head().MinTime()
+	for _, block := range s.Blocks() {
+		minTime = min(minTime, block.MinTime())
+	}
+	return minTime
+}
+
+func (s *tsdbSource) MaxTime() int64 {
+	return s.Head().MaxTime()
+}
+
+// openFlushedSource writes the data in the WAL of the TSDB in dir, e.g. of a
+// server that crashed before cutting a block or of an agent, into a block in
+// a temporary directory and returns a source of it and the blocks of the TSDB.
+// The TSDB is only read.
+func openFlushedSource(dir string, logger log.Logger) (*flushedSource, error) {
+	if _, err := os.Stat(filepath.Join(dir, "wal")); os.IsNotExist(err) {
+		s, err := openBlocksSource(logger, dir)
+		if err != nil {
+			return nil, err
+		}
+		return &flushedSource{blocksSource: s}, nil
+	}
+	tmp, err := ioutil.TempDir("", "backfiller-wal-")
+	if err != nil {
+		return nil, err
+	}
+	db, err := tsdb.OpenDBReadOnly(dir, logger)
+	if err == nil {
+		err = db.FlushWAL(tmp)
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, errors.Wrap(err, "flush WAL")
+	}
+
+	s, err := openBlocksSource(logger, dir, tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	level.Info(logger).Log("msg", "flushed WAL into a temporary block", "dir", tmp)
+	return &flushedSource{blocksSource: s, dir: tmp}, nil
+}
+
+// flushedSource is a TSDB whose WAL has been flushed into a block in dir,
+// which is removed on close. dir is empty if the TSDB has no WAL.
+type flushedSource struct {
+	*blocksSource
+	dir string
+}
+
+func (s *flushedSource) Close() error {
+	var merr tsdb_errors.MultiError
+	merr.Add(s.blocksSource.Close())
+	if s.dir != "" {
+		merr.Add(os.RemoveAll(s.dir))
+	}
+	return merr.Err()
+}
+
+// mergedSource is the union of several sources, e.g. the TSDBs of two
+// replicas. Samples present in more than one source are deduplicated.
+type mergedSource struct {
+	sources []source
+}
+
+func (s *mergedSource) MinTime() int64 {
+	minTime := int64(math.MaxInt64)
+	for _, src := range s.sources {
+		minTime = min(minTime, src.MinTime())
+	}
+	return minTime
+}
+
+func (s *mergedSource) MaxTime() int64 {
+	maxTime := int64(math.MinInt64)
+	for _, src := range s.sources {
+		maxTime = max(maxTime, src.MaxTime())
+	}
+	return maxTime
+}
+
+func (s *mergedSource) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	queriers := make([]storage.Querier, 0, len(s.sources))
+	for _, src := range s.sources {
+		q, err := src.Querier(ctx, mint, maxt)
+		if err != nil {
+			for _, q := range queriers {
+				q.Close()
+			}
+			return nil, err
+		}
+		queriers = append(queriers, q)
+	}
+	// Like the fanout storage, the primary querier is part of the queriers.
+	return storage.NewMergeQuerier(queriers[0], queriers, storage.ChainedSeriesMerge), nil
+}
+
+func (s *mergedSource) Close() error {
+	var merr tsdb_errors.MultiError
+	for _, src := range s.sources {
+		merr.Add(src.Close())
+	}
+	return merr.Err()
+}
@@ -0,0 +1,222 @@
+package backfill
+
+import (
+	"container/list"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/tsdbutil"
+)
+
+// sourceCacheWindow is the time range the samples of a selector are read and
+// cached for. A select is served from the aligned windows it overlaps, so the
+// selects of the steps within a window, of any rule with the same selector,
+// read the source once.
+const sourceCacheWindow = time.Hour
+
+// maxCacheWindows is the number of windows of a select beyond which it's
+// read from the source without the cache.
+const maxCacheWindows = 24 * 7
+
+// cachedSampleBytes is the estimated memory of a cached sample.
+const cachedSampleBytes = 40
+
+// cacheKey identifies the series of a selector in a window.
+type cacheKey struct {
+	matchers string
+	window   int64
+}
+
+type cacheEntry struct {
+	key    cacheKey
+	series []*dedupSeries
+	bytes  int64
+}
+
+// sourceCache caches the samples of the series of selectors in aligned time
+// windows, evicting the least recently used windows beyond maxBytes. The
+// source doesn't change during a run, so entries are never invalidated.
+type sourceCache struct {
+	mtx      sync.Mutex
+	maxBytes int64
+	bytes    int64
+	lru      *list.List
+	entries  map[cacheKey]*list.Element
+
+	hits, misses int
+	metrics      *metrics
+}
+
+func newSourceCache(maxBytes int64, m *metrics) *sourceCache {
+	return &sourceCache{maxBytes: maxBytes, lru: list.New(), entries: map[cacheKey]*list.Element{}, metrics: m}
+}
+
+// stats returns the numbers of hits and misses so far.
+func (c *sourceCache) stats() (int, int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.hits, c.misses
+}
+
+func (c *sourceCache) get(key cacheKey) ([]*dedupSeries, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		c.metrics.sourceCacheMisses.Inc()
+		return nil, false
+	}
+	c.hits++
+	c.metrics.sourceCacheHits.Inc()
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).series, true
+}
+
+// add caches the series of key, unless they are larger than the cache.
+func (c *sourceCache) add(key cacheKey, series []*dedupSeries) {
+	var bytes int64
+	for _, s := range series {
+		bytes += int64(sampleSize(s.lset)) + int64(len(s.samples))*cachedSampleBytes
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if _, ok := c.entries[key]; ok || bytes > c.maxBytes {
+		return
+	}
+	for c.bytes+bytes > c.maxBytes {
+		oldest := c.lru.Back()
+		e := c.lru.Remove(oldest).(*cacheEntry)
+		delete(c.entries, e.key)
+		c.bytes -= e.bytes
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, series: series, bytes: bytes})
+	c.bytes += bytes
+	c.metrics.sourceCacheBytes.Set(float64(c.bytes))
+}
+
+// cachedQueryable serves the selects of the queries evaluating the rules from
+// the source cache, reading the windows missing from it from the source.
+type cachedQueryable struct {
+	src   storage.Queryable
+	cache *sourceCache
+}
+
+func (q *cachedQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	sq, err := q.src.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedQuerier{Querier: sq, ctx: ctx, src: q.src, cache: q.cache, mint: mint, maxt: maxt}, nil
+}
+
+type cachedQuerier struct {
+	storage.Querier
+	ctx        context.Context
+	src        storage.Queryable
+	cache      *sourceCache
+	mint, maxt int64
+}
+
+// Select returns the series of the matchers with their samples in the range
+// of the hints, or else of the querier, sorted by their labels.
+func (q *cachedQuerier) Select(_ bool, hints *storage.SelectHints, matchers ...*labels.Matcher) (storage.SeriesSet, storage.Warnings, error) {
+	mint, maxt := q.mint, q.maxt
+	if hints != nil {
+		mint, maxt = hints.Start, hints.End
+	}
+	window := sourceCacheWindow.Milliseconds()
+	if floorDiv(maxt, window)-floorDiv(mint, window) >= maxCacheWindows {
+		return q.Querier.Select(true, hints, matchers...)
+	}
+	ms := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		ms = append(ms, m.String())
+	}
+	sort.Strings(ms)
+	key := strings.Join(ms, ",")
+
+	var (
+		series  []*dedupSeries
+		byLabel = map[string]*dedupSeries{}
+	)
+	for w := floorDiv(mint, window); w <= floorDiv(maxt, window); w++ {
+		ws, err := q.window(cacheKey{matchers: key, window: w}, matchers)
+		if err != nil {
+			return nil, nil, err
+		}
+		// The windows are in order, so are the samples appended to a series.
+		for _, s := range ws {
+			samples := samplesBetween(s.samples, mint, maxt)
+			if len(samples) == 0 {
+				continue
+			}
+			ls := s.lset.String()
+			ds, ok := byLabel[ls]
+			if !ok {
+				ds = &dedupSeries{lset: s.lset}
+				byLabel[ls] = ds
+				series = append(series, ds)
+			}
+			ds.samples = append(ds.samples, samples...)
+		}
+	}
+	sort.Slice(series, func(i, j int) bool { return labels.Compare(series[i].lset, series[j].lset) < 0 })
+	return &dedupSeriesSet{series: series, i: -1}, nil, nil
+}
+
+// window returns the series of the matchers in window w, from the cache or
+// else read from the source.
+func (q *cachedQuerier) window(key cacheKey, matchers []*labels.Matcher) ([]*dedupSeries, error) {
+	if series, ok := q.cache.get(key); ok {
+		return series, nil
+	}
+	window := sourceCacheWindow.Milliseconds()
+	mint, maxt := key.window*window, (key.window+1)*window-1
+	sq, err := q.src.Querier(q.ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	defer sq.Close()
+	ss, _, err := sq.Select(false, &storage.SelectHints{Start: mint, End: maxt}, matchers...)
+	if err != nil {
+		return nil, err
+	}
+	var series []*dedupSeries
+	for ss.Next() {
+		s := ss.At()
+		samples, err := readSamples(s.Iterator())
+		if err != nil {
+			return nil, errors.Wrapf(err, "read series %s", s.Labels())
+		}
+		if samples = samplesBetween(samples, mint, maxt); len(samples) > 0 {
+			series = append(series, &dedupSeries{lset: s.Labels(), samples: samples})
+		}
+	}
+	if err := ss.Err(); err != nil {
+		return nil, err
+	}
+	q.cache.add(key, series)
+	return series, nil
+}
+
+// samplesBetween returns the samples in [mint, maxt] of the ordered samples.
+func samplesBetween(samples []tsdbutil.Sample, mint, maxt int64) []tsdbutil.Sample {
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].T() >= mint })
+	j := sort.Search(len(samples), func(i int) bool { return samples[i].T() > maxt })
+	return samples[i:j]
+}
+
+// floorDiv returns a/b rounded towards negative infinity.
+func floorDiv(a, b int64) int64 {
+	if a < 0 && a%b != 0 {
+		return a/b - 1
+	}
+	return a / b
+}
@@ -0,0 +1,236 @@
+package backfill
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/tsdbutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// StoreAPIOptions configures a Thanos StoreAPI, e.g. of a store gateway, as
+// the source.
+type StoreAPIOptions struct {
+	// Address is the host:port of the StoreAPI.
+	Address string
+	// TLS connects with TLS. The CA file is used to verify the server instead
+	// of the system roots if set, the certificate and key files are sent as
+	// the client certificate if set.
+	TLS                       bool
+	CAFile, CertFile, KeyFile string
+	ServerName                string
+	InsecureSkipVerify        bool
+	// MaxSeries and MaxSamples fail a select returning more series or
+	// samples, 0 means no limit.
+	MaxSeries, MaxSamples int
+}
+
+// storeAPISource is a Thanos StoreAPI used as the source data. As it
+// doesn't tell its time range, the backfill range has to be given.
+type storeAPISource struct {
+	conn   *grpc.ClientConn
+	opts   StoreAPIOptions
+	logger log.Logger
+}
+
+func newStoreAPISource(opts StoreAPIOptions, logger log.Logger) (*storeAPISource, error) {
+	creds := grpc.WithInsecure()
+	if opts.TLS {
+		cfg, err := clientTLSConfig(opts.CAFile, opts.CertFile, opts.KeyFile, opts.ServerName, opts.InsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(cfg))
+	}
+	conn, err := grpc.Dial(opts.Address, creds)
+	if err != nil {
+		return nil, err
+	}
+	return &storeAPISource{conn: conn, opts: opts, logger: logger}, nil
+}
+
+// clientTLSConfig returns the TLS config of a client verifying the server
+// with the CA file instead of the system roots if set, and presenting the
+// certificate and key files as its certificate if set.
+func clientTLSConfig(caFile, certFile, keyFile, serverName string, insecureSkipVerify bool) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if caFile != "" {
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read CA file")
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(b) {
+			return nil, errors.Errorf("no certificates in CA file %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load client certificate")
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func (s *storeAPISource) MinTime() int64 { return math.MinInt64 }
+
+func (s *storeAPISource) MaxTime() int64 { return math.MaxInt64 }
+
+func (s *storeAPISource) Close() error { return s.conn.Close() }
+
+func (s *storeAPISource) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	return &storeAPIQuerier{ctx: ctx, src: s, mint: mint, maxt: maxt}, nil
+}
+
+type storeAPIQuerier struct {
+	ctx        context.Context
+	src        *storeAPISource
+	mint, maxt int64
+	cancels    []context.CancelFunc
+}
+
+// Select streams the matching series from the StoreAPI. The time range of the
+// hints is pushed down, the series are decoded as they are read.
+func (q *storeAPIQuerier) Select(_ bool, hints *storage.SelectHints, matchers ...*labels.Matcher) (storage.SeriesSet, storage.Warnings, error) {
+	req := &storeSeriesRequest{minTime: q.mint, maxTime: q.maxt, matchers: matchers}
+	if hints != nil {
+		req.minTime, req.maxTime = hints.Start, hints.End
+	}
+
+	ctx, cancel := context.WithCancel(q.ctx)
+	q.cancels = append(q.cancels, cancel)
+	stream, err := q.src.conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, storeSeriesMethod, grpc.ForceCodec(storeCodec{}))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "call Series")
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return nil, nil, errors.Wrap(err, "send Series request")
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, nil, errors.Wrap(err, "send Series request")
+	}
+	return &storeSeriesSet{stream: stream, opts: q.src.opts, logger: q.src.logger}, nil, nil
+}
+
+func (q *storeAPIQuerier) LabelValues(string) ([]string, storage.Warnings, error) {
+	return nil, nil, errors.New("label values are not supported by the StoreAPI source")
+}
+
+func (q *storeAPIQuerier) LabelNames() ([]string, storage.Warnings, error) {
+	return nil, nil, errors.New("label names are not supported by the StoreAPI source")
+}
+
+// Close cancels the streams of all selects.
+func (q *storeAPIQuerier) Close() error {
+	for _, cancel := range q.cancels {
+		cancel()
+	}
+	return nil
+}
+
+// storeSeriesSet reads the series of a Series stream one at a time.
+type storeSeriesSet struct {
+	stream  grpc.ClientStream
+	opts    StoreAPIOptions
+	logger  log.Logger
+	cur     *storeAPISeries
+	series  int
+	samples int
+	err     error
+}
+
+func (s *storeSeriesSet) Next() bool {
+	for {
+		var resp storeSeriesResponse
+		if err := s.stream.RecvMsg(&resp); err != nil {
+			if err != io.EOF {
+				s.err = errors.Wrap(err, "receive series")
+			}
+			return false
+		}
+		if resp.warning != "" {
+			level.Warn(s.logger).Log("msg", "StoreAPI returned a warning", "warning", resp.warning)
+			continue
+		}
+		if resp.series == nil {
+			continue
+		}
+		if resp.series.histogram {
+			level.Warn(s.logger).Log("msg", "skipping series with native histogram samples, which aren't supported", "series", resp.series.lset)
+			continue
+		}
+
+		series := &storeAPISeries{lset: resp.series.lset}
+		for _, data := range resp.series.chunks {
+			chk, err := chunkenc.FromData(chunkenc.EncXOR, data)
+			if err != nil {
+				s.err = errors.Wrapf(err, "decode chunk of series %s", resp.series.lset)
+				return false
+			}
+			it := chk.Iterator(nil)
+			for it.Next() {
+				t, v := it.At()
+				// Skip samples that aren't after the previous one in case chunks overlap.
+				if n := len(series.samples); n > 0 && t <= series.samples[n-1].T() {
+					continue
+				}
+				series.samples = append(series.samples, storeSample{t: t, v: v})
+			}
+			if err := it.Err(); err != nil {
+				s.err = errors.Wrapf(err, "decode chunk of series %s", resp.series.lset)
+				return false
+			}
+			s.samples += chk.NumSamples()
+		}
+		s.series++
+		if s.opts.MaxSeries > 0 && s.series > s.opts.MaxSeries {
+			s.err = errors.Errorf("select returned more than %d series", s.opts.MaxSeries)
+			return false
+		}
+		if s.opts.MaxSamples > 0 && s.samples > s.opts.MaxSamples {
+			s.err = errors.Errorf("select returned more than %d samples", s.opts.MaxSamples)
+			return false
+		}
+		s.cur = series
+		return true
+	}
+}
+
+func (s *storeSeriesSet) At() storage.Series { return s.cur }
+
+func (s *storeSeriesSet) Err() error { return s.err }
+
+type storeAPISeries struct {
+	lset    labels.Labels
+	samples []tsdbutil.Sample
+}
+
+func (s *storeAPISeries) Labels() labels.Labels { return s.lset }
+
+func (s *storeAPISeries) Iterator() chunkenc.Iterator {
+	return storage.NewListSeriesIterator(s.samples)
+}
+
+type storeSample struct {
+	t int64
+	v float64
+}
+
+func (s storeSample) T() int64   { return s.t }
+func (s storeSample) V() float64 { return s.v }
@@ -0,0 +1,233 @@
+package backfill
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// This file implements the wire format of the subset of the Thanos StoreAPI
+// (package thanos in pkg/store/storepb) the StoreAPI source uses, so the
+// backfiller doesn't depend on the Thanos module.
+
+// storeSeriesMethod is the full name of the Series call of the StoreAPI.
+const storeSeriesMethod = "/thanos.Store/Series"
+
+// Field numbers of the StoreAPI messages.
+const (
+	seriesRequestMinTime                 = 1
+	seriesRequestMaxTime                 = 2
+	seriesRequestMatchers                = 3
+	seriesRequestAggregates              = 5
+	seriesRequestPartialResponseDisabled = 6
+	seriesRequestPartialResponseStrategy = 7
+
+	labelMatcherType  = 1
+	labelMatcherName  = 2
+	labelMatcherValue = 3
+
+	seriesResponseSeries  = 1
+	seriesResponseWarning = 2
+
+	seriesLabels = 1
+	seriesChunks = 2
+
+	labelName  = 1
+	labelValue = 2
+
+	aggrChunkRaw = 3
+
+	chunkType = 1
+	chunkData = 2
+)
+
+const (
+	// aggrRaw selects raw, not downsampled, chunks.
+	aggrRaw = 0
+	// partialResponseAbort fails the call if a store behind the API fails.
+	partialResponseAbort = 1
+	// chunkXOR is the encoding of float chunks.
+	chunkXOR = 0
+	// chunkHistogram and chunkFloatHistogram are the encodings of native
+	// histogram chunks, which this version of the TSDB can't read.
+	chunkHistogram      = 1
+	chunkFloatHistogram = 2
+)
+
+// storeCodec marshals the hand-written StoreAPI messages for gRPC.
+type storeCodec struct{}
+
+func (storeCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(interface{ Marshal() ([]byte, error) })
+	if !ok {
+		return nil, errors.Errorf("cannot marshal %T", v)
+	}
+	return m.Marshal()
+}
+
+func (storeCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(interface{ Unmarshal([]byte) error })
+	if !ok {
+		return errors.Errorf("cannot unmarshal into %T", v)
+	}
+	return m.Unmarshal(data)
+}
+
+func (storeCodec) Name() string { return "proto" }
+
+// storeSeriesRequest is a SeriesRequest of raw data that fails on partial responses.
+type storeSeriesRequest struct {
+	minTime, maxTime int64
+	matchers         []*labels.Matcher
+}
+
+func (r *storeSeriesRequest) Marshal() ([]byte, error) {
+	var b []byte
+	b = protowire.AppendTag(b, seriesRequestMinTime, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(r.minTime))
+	b = protowire.AppendTag(b, seriesRequestMaxTime, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(r.maxTime))
+	for _, m := range r.matchers {
+		// The matcher types of the StoreAPI are in the same order as in Prometheus.
+		var mb []byte
+		mb = protowire.AppendTag(mb, labelMatcherType, protowire.VarintType)
+		mb = protowire.AppendVarint(mb, uint64(m.Type))
+		mb = protowire.AppendTag(mb, labelMatcherName, protowire.BytesType)
+		mb = protowire.AppendString(mb, m.Name)
+		mb = protowire.AppendTag(mb, labelMatcherValue, protowire.BytesType)
+		mb = protowire.AppendString(mb, m.Value)
+
+		b = protowire.AppendTag(b, seriesRequestMatchers, protowire.BytesType)
+		b = protowire.AppendBytes(b, mb)
+	}
+	b = protowire.AppendTag(b, seriesRequestAggregates, protowire.BytesType)
+	b = protowire.AppendBytes(b, protowire.AppendVarint(nil, aggrRaw))
+	b = protowire.AppendTag(b, seriesRequestPartialResponseDisabled, protowire.VarintType)
+	b = protowire.AppendVarint(b, 1)
+	b = protowire.AppendTag(b, seriesRequestPartialResponseStrategy, protowire.VarintType)
+	b = protowire.AppendVarint(b, partialResponseAbort)
+	return b, nil
+}
+
+// storeSeriesResponse is a SeriesResponse. Responses with hints have neither
+// a series nor a warning.
+type storeSeriesResponse struct {
+	series  *storeSeries
+	warning string
+}
+
+type storeSeries struct {
+	lset   labels.Labels
+	chunks [][]byte
+	// histogram is set if the series has native histogram chunks, which are dropped.
+	histogram bool
+}
+
+func (r *storeSeriesResponse) Unmarshal(b []byte) error {
+	return walkFields(b, func(num protowire.Number, _ uint64, data []byte) error {
+		switch num {
+		case seriesResponseSeries:
+			r.series = &storeSeries{}
+			return r.series.unmarshal(data)
+		case seriesResponseWarning:
+			r.warning = string(data)
+		}
+		return nil
+	})
+}
+
+func (s *storeSeries) unmarshal(b []byte) error {
+	return walkFields(b, func(num protowire.Number, _ uint64, data []byte) error {
+		switch num {
+		case seriesLabels:
+			var l labels.Label
+			if err := walkFields(data, func(num protowire.Number, _ uint64, data []byte) error {
+				switch num {
+				case labelName:
+					l.Name = string(data)
+				case labelValue:
+					l.Value = string(data)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			s.lset = append(s.lset, l)
+		case seriesChunks:
+			return walkFields(data, func(num protowire.Number, _ uint64, data []byte) error {
+				if num != aggrChunkRaw {
+					return nil
+				}
+				return s.unmarshalChunk(data)
+			})
+		}
+		return nil
+	})
+}
+
+func (s *storeSeries) unmarshalChunk(b []byte) error {
+	var (
+		enc  uint64
+		data []byte
+	)
+	if err := walkFields(b, func(num protowire.Number, v uint64, d []byte) error {
+		switch num {
+		case chunkType:
+			enc = v
+		case chunkData:
+			// The message buffer isn't ours to keep.
+			data = append([]byte(nil), d...)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	switch enc {
+	case chunkXOR:
+	case chunkHistogram, chunkFloatHistogram:
+		s.histogram = true
+		return nil
+	default:
+		return errors.Errorf("unsupported chunk encoding %d", enc)
+	}
+	s.chunks = append(s.chunks, data)
+	return nil
+}
+
+// walkFields calls fn for every field of the protobuf message b, with the
+// value of varint fields or the data of length-delimited fields. Fields of
+// other types are skipped.
+func walkFields(b []byte, fn func(num protowire.Number, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var (
+			v    uint64
+			data []byte
+		)
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			data, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if typ != protowire.VarintType && typ != protowire.BytesType {
+			continue
+		}
+		if err := fn(num, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package backfill
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql"
+	prom_rules "github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/template"
+)
+
+// templateDefs are the convenience variables available to label templates,
+// the same ones alerting rule templates get.
+var templateDefs = []string{
+	"{{$labels := .Labels}}",
+	"{{$externalLabels := .ExternalLabels}}",
+	"{{$value := .Value}}",
+}
+
+// isTemplate reports whether a label value has to go through the template engine.
+func isTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+func newLabelExpander(ctx context.Context, name, text string, data interface{}, t time.Time, queryFunc template.QueryFunc) *template.Expander {
+	return template.NewTemplateExpander(
+		ctx,
+		strings.Join(append(templateDefs, text), ""),
+		"__record_"+name,
+		data,
+		model.Time(timestamp.FromTime(t)),
+		queryFunc,
+		nil,
+	)
+}
+
+// checkLabelTemplates makes sure the templated labels can be parsed.
+func checkLabelTemplates(name string, tmplLabels labels.Labels) error {
+	data := template.AlertTemplateData(map[string]string{}, map[string]string{}, 0)
+	for _, l := range tmplLabels {
+		if err := newLabelExpander(context.TODO(), name, l.Value, data, time.Now(), nil).ParseTest(); err != nil {
+			return errors.Wrapf(err, "label %q", l.Name)
+		}
+	}
+	return nil
+}
+
+// expandLabels renders the templated labels of the rule with the labels and value of the sample.
+func expandLabels(ctx context.Context, rule *recordingRule, sample promql.Sample, queryFunc prom_rules.QueryFunc) (labels.Labels, error) {
+	l := make(map[string]string, len(sample.Metric))
+	for _, lbl := range sample.Metric {
+		l[lbl.Name] = lbl.Value
+	}
+	data := template.AlertTemplateData(l, map[string]string{}, sample.V)
+
+	res := make(labels.Labels, 0, len(rule.tmplLabels))
+	for _, tl := range rule.tmplLabels {
+		v, err := newLabelExpander(ctx, rule.name, tl.Value, data, timestamp.Time(sample.T), template.QueryFunc(queryFunc)).Expand()
+		if err != nil {
+			return nil, errors.Wrapf(err, "label %q", tl.Name)
+		}
+		res = append(res, labels.Label{Name: tl.Name, Value: v})
+	}
+	return res, nil
+}
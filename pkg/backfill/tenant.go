@@ -0,0 +1,120 @@
+package backfill
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// pendingBlock are the buffered samples written into a block in the
+// directory of a tenant, which is empty without Options.TenantLabel or
+// Options.TenantFromRules.
+type pendingBlock struct {
+	tenant           string
+	mss              []*tsdb.MetricSample
+	minTime, maxTime int64
+	series           int
+	bytes            int64
+}
+
+// splitTenants partitions the samples by their tenant, ordered by tenant.
+func splitTenants(mss []*tsdb.MetricSample, tenantOf func(labels.Labels) string) []*pendingBlock {
+	tenants := map[string]*pendingBlock{}
+	series := map[string]map[uint64]struct{}{}
+	for _, s := range mss {
+		t := tenantOf(s.Labels)
+		pb, ok := tenants[t]
+		if !ok {
+			pb = &pendingBlock{tenant: t, minTime: math.MaxInt64, maxTime: math.MinInt64}
+			tenants[t] = pb
+			series[t] = map[uint64]struct{}{}
+		}
+		pb.mss = append(pb.mss, s)
+		pb.minTime = min(pb.minTime, s.TimestampMs)
+		pb.maxTime = max(pb.maxTime, s.TimestampMs)
+		pb.bytes += sampleSize(s.Labels)
+		series[t][s.Labels.Hash()] = struct{}{}
+	}
+
+	blocks := make([]*pendingBlock, 0, len(tenants))
+	for t, pb := range tenants {
+		pb.series = len(series[t])
+		blocks = append(blocks, pb)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].tenant < blocks[j].tenant })
+	return blocks
+}
+
+// checkTenant checks that a tenant can be used as the name of its directory.
+func checkTenant(tenant string) error {
+	// Hidden directories like the staging directory aren't tenants.
+	if tenant == "" || strings.HasPrefix(tenant, ".") || strings.ContainsAny(tenant, `/\`) {
+		return errors.Errorf("tenant %q can't be used as a directory name", tenant)
+	}
+	if _, err := ulid.ParseStrict(tenant); err == nil {
+		return errors.Errorf("tenant %q would be mistaken for a block", tenant)
+	}
+	return nil
+}
+
+// tenantOverlappingBlocks returns the blocks in the tenant directories in dir
+// that overlap [mint, maxt], as paths relative to dir.
+func tenantOverlappingBlocks(dir string, mint, maxt int64) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var overlapping []string
+	for _, f := range files {
+		if !f.IsDir() || checkTenant(f.Name()) != nil {
+			continue
+		}
+		blocks, err := overlappingBlocks(filepath.Join(dir, f.Name()), mint, maxt, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range blocks {
+			overlapping = append(overlapping, filepath.Join(f.Name(), b))
+		}
+	}
+	return overlapping, nil
+}
+
+// TenantResult summarizes the output of a tenant.
+type TenantResult struct {
+	Tenant string
+	// Blocks and Samples are the numbers of blocks and samples written into
+	// the directory of the tenant.
+	Blocks  int
+	Samples int
+}
+
+// tenantResults sums up the written blocks, identified by their path in the
+// destination, and their numbers of samples by tenant, ordered by tenant.
+func tenantResults(blocks []string, samples []int) []TenantResult {
+	tenants := map[string]*TenantResult{}
+	for i, b := range blocks {
+		t := filepath.Dir(b)
+		tr, ok := tenants[t]
+		if !ok {
+			tr = &TenantResult{Tenant: t}
+			tenants[t] = tr
+		}
+		tr.Blocks++
+		tr.Samples += samples[i]
+	}
+	res := make([]TenantResult, 0, len(tenants))
+	for _, tr := range tenants {
+		res = append(res, *tr)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Tenant < res[j].Tenant })
+	return res
+}
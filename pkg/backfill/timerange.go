@@ -0,0 +1,316 @@
+package backfill
+
+import (
+	"bufio"
+	"context"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+)
+
+type timeRange struct {
+	start time.Time
+	end   time.Time
+}
+
+// lastEval returns the last timestamp of the range that may be evaluated. With
+// an exclusive end, the range is [start, end) like in Prometheus range
+// semantics, so live evaluations can own the end timestamp.
+func (tr *timeRange) lastEval(endExclusive bool) int64 {
+	if endExclusive {
+		return timestamp.FromTime(tr.end) - 1
+	}
+	return timestamp.FromTime(tr.end)
+}
+
+// errEmptyRange is returned by getTimeRange when the range ends before it
+// starts, e.g. because the source has no data after the start yet.
+var errEmptyRange = errors.New("start time should be before end time")
+
+// getTimeRange resolves the backfill range from the user provided start and end,
+// clamped to the [minTime, maxTime] range of the source data and, unless it's
+// zero, to notAfter.
+func getTimeRange(minTime, maxTime int64, start, end string, notAfter time.Time) (*timeRange, error) {
+	var (
+		stime, etime time.Time
+		err          error
+	)
+
+	if start != "" {
+		stime, err = parseTime(start)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse start time")
+		}
+		if timestamp.FromTime(stime) < minTime {
+			stime = timestamp.Time(minTime)
+		}
+	} else {
+		stime = timestamp.Time(minTime)
+	}
+
+	if end != "" {
+		etime, err = parseTime(end)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse end time")
+		}
+		if timestamp.FromTime(etime) > maxTime {
+			etime = timestamp.Time(maxTime)
+		}
+	} else {
+		etime = timestamp.Time(maxTime)
+	}
+
+	tr, capped := (&timeRange{stime, etime}).capEnd(notAfter)
+	if tr.start.After(tr.end) {
+		if capped {
+			return nil, errors.Wrapf(errEmptyRange, "start time %s is after %s, the newest time old enough to backfill", stime.Format(time.RFC3339), notAfter.Format(time.RFC3339))
+		}
+		return nil, errEmptyRange
+	}
+	return tr, nil
+}
+
+// capEnd returns tr with its end capped to notAfter unless it's zero, and
+// whether it was capped.
+func (tr *timeRange) capEnd(notAfter time.Time) (*timeRange, bool) {
+	if notAfter.IsZero() || !tr.end.After(notAfter) {
+		return tr, false
+	}
+	return &timeRange{tr.start, notAfter}, true
+}
+
+// capStart returns tr with its start raised to notBefore unless it's zero,
+// and how much of tr was cut off.
+func (tr *timeRange) capStart(notBefore time.Time) (*timeRange, time.Duration) {
+	if notBefore.IsZero() || !tr.start.Before(notBefore) {
+		return tr, 0
+	}
+	return &timeRange{notBefore, tr.end}, notBefore.Sub(tr.start)
+}
+
+// alignTime returns the first multiple of interval (in epoch ms) at or after t.
+func alignTime(t time.Time, interval time.Duration) time.Time {
+	ts, step := timestamp.FromTime(t), interval.Milliseconds()
+	if r := ts % step; r != 0 {
+		ts += step - r
+	}
+	return timestamp.Time(ts)
+}
+
+// maxUnixSeconds is the largest Unix timestamp in seconds accepted without a
+// unit suffix, in the year 5138. Larger values are most likely milliseconds or
+// nanoseconds.
+const maxUnixSeconds = 1e11
+
+// parseTime parses an RFC3339 timestamp or a Unix timestamp. Unix timestamps
+// are in seconds, unless they have an ms or ns suffix.
+func parseTime(s string) (time.Time, error) {
+	for _, u := range []struct {
+		suffix string
+		unit   time.Duration
+	}{{"ms", time.Millisecond}, {"ns", time.Nanosecond}} {
+		if !strings.HasSuffix(s, u.suffix) {
+			continue
+		}
+		if t, err := strconv.ParseInt(strings.TrimSuffix(s, u.suffix), 10, 64); err == nil {
+			return time.Unix(0, 0).Add(time.Duration(t) * u.unit), nil
+		}
+	}
+	if t, err := strconv.ParseFloat(strings.TrimSuffix(s, "s"), 64); err == nil {
+		if math.IsNaN(t) || math.IsInf(t, 0) {
+			return time.Time{}, errors.Errorf("cannot parse %q to a valid timestamp", s)
+		}
+		if math.Abs(t) > maxUnixSeconds {
+			return time.Time{}, errors.Errorf("Unix timestamp %q is too far in the future, use the ms or ns suffix for milliseconds or nanoseconds", s)
+		}
+		s, ns := math.Modf(t)
+		return time.Unix(int64(s), int64(ns*float64(time.Second))), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errors.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+func max(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min(a, b int64) int64 {
+	if a > b {
+		return b
+	}
+	return a
+}
+
+// evalSteps are the evaluation timestamps of a rule: every interval in
+// [first, last], or the explicit timestamps if they aren't nil.
+type evalSteps struct {
+	first, last, interval int64
+	timestamps            []int64
+}
+
+func (r *recordingRule) evalSteps(opts Options) evalSteps {
+	if r.timestamps == nil {
+		return evalSteps{first: timestamp.FromTime(r.tr.start), last: r.tr.lastEval(opts.EndExclusive), interval: r.evalInterval(opts).Milliseconds()}
+	}
+	if len(r.timestamps) == 0 {
+		return evalSteps{first: math.MaxInt64, last: math.MinInt64, timestamps: r.timestamps}
+	}
+	return evalSteps{first: r.timestamps[0], last: r.timestamps[len(r.timestamps)-1], timestamps: r.timestamps}
+}
+
+// next returns the step after t, which is after last if t is the last step.
+func (s evalSteps) next(t int64) int64 {
+	if s.timestamps == nil {
+		return t + s.interval
+	}
+	i := sort.Search(len(s.timestamps), func(i int) bool { return s.timestamps[i] > t })
+	if i == len(s.timestamps) {
+		return math.MaxInt64
+	}
+	return s.timestamps[i]
+}
+
+// from returns the first step at or after t, which is after last if there is none.
+func (s evalSteps) from(t int64) int64 {
+	if s.timestamps == nil {
+		if t <= s.first {
+			return s.first
+		}
+		return s.first + (t-s.first+s.interval-1)/s.interval*s.interval
+	}
+	i := sort.Search(len(s.timestamps), func(i int) bool { return s.timestamps[i] >= t })
+	if i == len(s.timestamps) {
+		return math.MaxInt64
+	}
+	return s.timestamps[i]
+}
+
+// batchEnd returns the last step of the batch of n steps starting at step ws.
+func (s evalSteps) batchEnd(ws, n int64) int64 {
+	if s.timestamps == nil {
+		return min(ws+(n-1)*s.interval, s.last)
+	}
+	i := sort.Search(len(s.timestamps), func(i int) bool { return s.timestamps[i] >= ws })
+	return s.timestamps[min(int64(i)+n-1, int64(len(s.timestamps)-1))]
+}
+
+// at returns the i-th step, counting from 0.
+func (s evalSteps) at(i int64) int64 {
+	if s.timestamps == nil {
+		return s.first + i*s.interval
+	}
+	return s.timestamps[i]
+}
+
+// count returns the number of steps.
+func (s evalSteps) count() int64 {
+	if s.timestamps != nil {
+		return int64(len(s.timestamps))
+	}
+	return (s.last-s.first)/s.interval + 1
+}
+
+// loadTimestamps reads the newline-separated timestamps in file, in any
+// format of parseTime, and returns them sorted and deduplicated. Empty lines
+// and lines starting with # are skipped.
+func loadTimestamps(file string) ([]int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ts []int64
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		t, err := parseTime(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", n)
+		}
+		ts = append(ts, timestamp.FromTime(t))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(ts, func(i, j int) bool { return ts[i] < ts[j] })
+	uniq := ts[:0]
+	for i, t := range ts {
+		if i == 0 || t != ts[i-1] {
+			uniq = append(uniq, t)
+		}
+	}
+	return uniq, nil
+}
+
+// timestampsIn returns the timestamps in [mint, maxt] of the sorted ts.
+func timestampsIn(ts []int64, mint, maxt int64) []int64 {
+	lo := sort.Search(len(ts), func(i int) bool { return ts[i] >= mint })
+	hi := sort.Search(len(ts), func(i int) bool { return ts[i] > maxt })
+	return ts[lo:hi:hi]
+}
+
+// referenceTimestamps returns the sorted and deduplicated timestamps of the
+// samples in [mint, maxt] of the series matching the selector in q, and the
+// number of these series.
+func referenceTimestamps(ctx context.Context, q storage.Queryable, selector string, mint, maxt int64) ([]int64, int, error) {
+	matchers, err := parser.ParseMetricSelector(selector)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "parse selector")
+	}
+	querier, err := q.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer querier.Close()
+
+	ss, _, err := querier.Select(false, &storage.SelectHints{Start: mint, End: maxt}, matchers...)
+	if err != nil {
+		return nil, 0, err
+	}
+	var (
+		ts     []int64
+		series int
+	)
+	for ss.Next() {
+		series++
+		it := ss.At().Iterator()
+		for it.Next() {
+			if t, _ := it.At(); t >= mint && t <= maxt {
+				ts = append(ts, t)
+			}
+		}
+		if err := it.Err(); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := ss.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	sort.Slice(ts, func(i, j int) bool { return ts[i] < ts[j] })
+	uniq := ts[:0]
+	for i, t := range ts {
+		if i == 0 || t != ts[i-1] {
+			uniq = append(uniq, t)
+		}
+	}
+	return uniq, series, nil
+}
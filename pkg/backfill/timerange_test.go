@@ -0,0 +1,53 @@
+package backfill
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want time.Time
+		err  bool
+	}{
+		{in: "1600000000", want: time.Unix(1600000000, 0)},
+		{in: "1600000000s", want: time.Unix(1600000000, 0)},
+		{in: "1600000000.5", want: time.Unix(1600000000, 500*int64(time.Millisecond))},
+		{in: "-60", want: time.Unix(-60, 0)},
+		{in: "1600000000123ms", want: time.Unix(1600000000, 123*int64(time.Millisecond))},
+		{in: "1600000000123456789ns", want: time.Unix(1600000000, 123456789)},
+		{in: "2020-09-13T12:26:40Z", want: time.Unix(1600000000, 0)},
+		{in: "2020-09-13T14:26:40.25+02:00", want: time.Unix(1600000000, 250*int64(time.Millisecond))},
+		// Bare values up to 1e11 are seconds, larger ones need a unit.
+		{in: "100000000000", want: time.Unix(1e11, 0)},
+		{in: "100000000001", err: true},
+		{in: "1600000000123", err: true},
+		{in: "-100000000001", err: true},
+		{in: "NaN", err: true},
+		{in: "nan", err: true},
+		{in: "Inf", err: true},
+		{in: "+Inf", err: true},
+		{in: "-Inf", err: true},
+		{in: "infs", err: true},
+		{in: "1.5ms", err: true},
+		{in: "", err: true},
+		{in: "yesterday", err: true},
+		{in: "2020-09-13", err: true},
+	} {
+		got, err := parseTime(tc.in)
+		if tc.err {
+			if err == nil {
+				t.Errorf("parseTime(%q) = %v, expected an error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTime(%q): %v", tc.in, err)
+			continue
+		}
+		if !got.Equal(tc.want) {
+			t.Errorf("parseTime(%q) = %v, want %v", tc.in, got.UTC(), tc.want.UTC())
+		}
+	}
+}